@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/yumosx/agent/internal/config"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/render"
+	"github.com/yumosx/agent/internal/report"
+	"github.com/yumosx/agent/internal/service"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// planCmd 只生成 plan, 输出到 stdout, plan id 输出到 stderr 方便在管道里使用
+func planCmd(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	format := fs.String("format", string(render.TEXT), "输出格式: text, json, markdown, mermaid")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return fmt.Errorf("配置错误:\n%w", err)
+	}
+	task, err := taskArg(fs)
+	if err != nil {
+		return err
+	}
+
+	sessions, closer, err := newSessions(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	session, err := sessions.Create(service.SessionConfig{})
+	if err != nil {
+		return err
+	}
+	if _, err = session.Plan(ctx, task); err != nil {
+		return err
+	}
+
+	output, err := render.Render(session.Record(), render.Format(*format))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "plan id: %s\n", session.Id)
+	fmt.Println(output)
+	return nil
+}
+
+// runCmd 生成 plan 之后在终端执行, 执行过程输出到 stderr, 最终报告输出到 stdout
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return fmt.Errorf("配置错误:\n%w", err)
+	}
+	task, err := taskArg(fs)
+	if err != nil {
+		return err
+	}
+
+	sessions, closer, err := newSessions(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	session, err := sessions.Create(service.SessionConfig{})
+	if err != nil {
+		return err
+	}
+
+	plan, err := session.Plan(ctx, task)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "plan id: %s\n%s\n", session.Id, plan)
+
+	return execute(ctx, session)
+}
+
+func resumeCmd(args []string) error {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return fmt.Errorf("配置错误:\n%w", err)
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: agent resume [flags] <plan-id>")
+	}
+
+	sessions, closer, err := newSessions(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	session, err := sessions.Resume(fs.Arg(0), service.SessionConfig{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "resume plan %s\n%s\n", session.Id, render.Text(session.Record()))
+
+	return execute(ctx, session)
+}
+
+// execute 在终端执行 plan, 需要审批的工具调用在终端确认
+func execute(ctx context.Context, session *service.Session) error {
+	out := &terminal{w: os.Stderr, lines: readLines(os.Stdin)}
+	session.Observe(out)
+	session.Gate.Notify(func(req policy.Request) {
+		out.decide(ctx, session.Gate, req)
+	})
+
+	err := session.Run(ctx)
+	fmt.Println(report.New(session.Record()).Markdown())
+	return err
+}
+
+func taskArg(fs *flag.FlagSet) (string, error) {
+	task := strings.Join(fs.Args(), " ")
+	if task == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		task = string(data)
+	}
+
+	if strings.TrimSpace(task) == "" {
+		return "", fmt.Errorf("usage: agent %s [flags] \"<task>\", 使用 - 从 stdin 读取任务", fs.Name())
+	}
+	return task, nil
+}
+
+// terminal 把执行进度输出到终端, 并且在终端里完成审批
+type terminal struct {
+	w io.Writer
+	// lines 只有 readLines 一个 goroutine 读取 stdin, 命令和审批的输入都从这里读取
+	lines <-chan string
+}
+
+// readLines 在后台按行读取 r, 读完或者出错时关闭 channel
+func readLines(r io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		in := bufio.NewReader(r)
+		for {
+			line, err := in.ReadString('\n')
+			if line != "" {
+				lines <- line
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// readLine 返回下一行输入, stdin 关闭时返回 io.EOF
+func (t *terminal) readLine(ctx context.Context) (string, error) {
+	select {
+	case line, ok := <-t.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return line, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (t *terminal) OnStep(index int, step domain.Step) {
+	switch step.State {
+	case domain.IN_PROGRESS:
+		fmt.Fprintf(t.w, "\n▶ step %d: %s\n", index, step.Content)
+	case domain.COMPLETED:
+		fmt.Fprintf(t.w, "✓ step %d completed\n", index)
+	case domain.BLOCKED:
+		fmt.Fprintf(t.w, "! step %d blocked\n", index)
+	case domain.ABORTED:
+		fmt.Fprintf(t.w, "× step %d aborted\n", index)
+	}
+}
+
+func (t *terminal) OnToolCall(record domain.ToolCallRecord) {
+	fmt.Fprintf(t.w, "  ⚙ %s %s (%s)\n", record.Name, record.Arguments, record.Duration.Round(time.Millisecond))
+	for _, line := range head(record.Output, 10) {
+		fmt.Fprintf(t.w, "    %s\n", line)
+	}
+}
+
+// decide 在终端完成审批, ctx 取消或者请求已经不在等待时返回
+func (t *terminal) decide(ctx context.Context, gate *policy.Gate, req policy.Request) {
+	for {
+		d, err := t.prompt(ctx, req)
+		if err != nil {
+			return
+		}
+		if err = gate.Decide(req.Id, d); err == nil || !pending(gate, req.Id) {
+			return
+		}
+		fmt.Fprintf(t.w, "审批失败: %v\n", err)
+	}
+}
+
+// prompt stdin 关闭时拒绝, ctx 取消时返回错误
+func (t *terminal) prompt(ctx context.Context, req policy.Request) (policy.Decision, error) {
+	fmt.Fprintf(t.w, "\n? %s 需要审批 (rule: %s)\n  %s\n", req.Tool, req.Rule, req.Arguments)
+	for {
+		fmt.Fprint(t.w, "  [a]pprove / [d]eny / [e]dit: ")
+		line, err := t.readLine(ctx)
+		if errors.Is(err, io.EOF) {
+			return policy.Decision{Action: policy.DENY, Reason: "no input"}, nil
+		}
+		if err != nil {
+			return policy.Decision{}, err
+		}
+
+		switch strings.TrimSpace(line) {
+		case "a", "approve":
+			return policy.Decision{Action: policy.APPROVE}, nil
+		case "d", "deny":
+			fmt.Fprint(t.w, "  reason: ")
+			reason, err := t.readLine(ctx)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return policy.Decision{}, err
+			}
+			return policy.Decision{Action: policy.DENY, Reason: strings.TrimSpace(reason)}, nil
+		case "e", "edit":
+			fmt.Fprint(t.w, "  arguments (JSON): ")
+			arguments, err := t.readLine(ctx)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return policy.Decision{}, err
+			}
+			return policy.Decision{Action: policy.EDIT, Arguments: strings.TrimSpace(arguments)}, nil
+		}
+	}
+}
+
+func pending(gate *policy.Gate, id string) bool {
+	for _, req := range gate.Pending() {
+		if req.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func head(s string, n int) []string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = append(lines[:n], fmt.Sprintf("... (%d more lines)", len(lines)-n))
+	}
+	return lines
+}
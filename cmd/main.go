@@ -1,23 +1,191 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/cohesion-org/deepseek-go"
-	"github.com/gin-gonic/gin"
-	"github.com/yumosx/agent/internal/handler"
+	"github.com/yumosx/agent/internal/config"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/logging"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/policy"
 	"github.com/yumosx/agent/internal/service"
 	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/service/llm/cassette"
+	"github.com/yumosx/agent/internal/tracing"
+	"github.com/yumosx/agent/internal/webhook"
+	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const usage = `usage: agent <command> [flags] [args]
+
+commands:
+  serve              启动 HTTP 服务 (默认)
+  plan "<task>"      生成 plan 并输出, 之后可以通过 resume 执行
+  run "<task>"       生成 plan 并在终端执行
+  resume <plan-id>   继续执行保存的 plan
+  repl               交互式终端
+  keygen <name>      生成 API key 以及填到 auth.keys 的配置
+
+使用 agent <command> -h 查看每个命令的参数
+`
+
 func main() {
-	token := os.Getenv("token")
-	client := deepseek.NewClient(token)
-	llmHandler := llm.NewHandler(client)
-	executor := service.NewPlanExecutor(llmHandler)
-	plan := service.NewPlanService(llmHandler, executor)
-	hd := handler.NewHandler(plan)
-
-	router := gin.Default()
-	hd.SetupRoutes(router)
-	router.Run(":8080")
+	args := os.Args[1:]
+
+	command := "serve"
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "plan":
+		err = planCmd(args)
+	case "run":
+		err = runCmd(args)
+	case "resume":
+		err = resumeCmd(args)
+	case "repl":
+		err = repl(args)
+	case "keygen":
+		err = keygen(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newSessions 根据配置创建 Sessions, 返回的 close 用来释放审计日志等资源, m 为空时不记录指标
+func newSessions(cfg *config.Config, m *metrics.Metrics) (*service.Sessions, func(), error) {
+	logger, err := logging.New(os.Stderr, cfg.Log)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.SetDefault(logger)
+
+	shutdown, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var invoker llm.Invoker
+	var middlewares []domain.ToolMiddleware
+	// 最后导出剩下的 span
+	closer := func() {
+		if err := shutdown(context.Background()); err != nil {
+			slog.Error("export traces failed", "error", err)
+		}
+	}
+
+	switch cfg.LLM.Cassette.Mode {
+	case "replay":
+		player, err := cassette.NewPlayer(cfg.LLM.Cassette.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		invoker = player
+		middlewares = append(middlewares, player.Tools)
+		done := closer
+		closer = func() {
+			if err := player.Done(); err != nil {
+				slog.Error("replay incomplete", "error", err)
+			}
+			done()
+		}
+	default:
+		invoker, err = newInvoker(cfg.LLM, m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if cfg.LLM.Cassette.Mode == "record" {
+			recorder := cassette.NewRecorder(invoker, cfg.LLM.Cassette.Path)
+			invoker = recorder
+			middlewares = append(middlewares, recorder.Tools)
+		}
+	}
+
+	invoker = llm.NewTracing(llm.NewLogger(llm.NewMeter(invoker, cfg.LLM.Pricing)))
+
+	// 先投递完剩下的 webhook, 再导出 span
+	webhooks := webhook.New(cfg.Webhooks)
+	done := closer
+	closer = func() {
+		webhooks.Close()
+		done()
+	}
+
+	opts := []service.SessionsOption{
+		service.WithDefaultSandbox(cfg.Sandbox),
+		service.WithBudget(cfg.Agent.Budget),
+		service.WithMetrics(m),
+		service.WithWebhooks(webhooks),
+		service.WithExecutorOptions(
+			service.WithMaxStep(cfg.Agent.MaxSteps),
+			service.WithBashTimeout(cfg.Agent.BashTimeout),
+			service.WithTools(cfg.Agent.Tools),
+			service.WithContextLimit(cfg.Agent.ContextTokens),
+			service.WithOutputLimit(cfg.Agent.OutputLimit),
+			service.WithToolMiddleware(middlewares...),
+		),
+	}
+	if cfg.Agent.Trajectory {
+		opts = append(opts, service.WithTrajectory(filepath.Join(cfg.Agent.Workspace, ".trajectories")))
+	}
+	if cfg.Policy != "" {
+		policyCfg, err := policy.Load(cfg.Policy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载策略文件失败: %w", err)
+		}
+
+		var audit *policy.Audit
+		if policyCfg.AuditLog != "" {
+			audit, err = policy.NewAudit(policyCfg.AuditLog)
+			if err != nil {
+				return nil, nil, fmt.Errorf("打开审计日志失败: %w", err)
+			}
+			done := closer
+			closer = func() {
+				done()
+				_ = audit.Close()
+			}
+		}
+		opts = append(opts, service.WithPolicy(policyCfg, audit))
+	}
+
+	return service.NewSessions(invoker, cfg.Agent.Workspace, opts...), closer, nil
+}
+
+// newInvoker 每个模型单独重试, 配置了 fallback 时按照顺序切换模型, 每次重试单独记录指标
+func newInvoker(cfg config.LLM, m *metrics.Metrics) (llm.Invoker, error) {
+	var candidates []llm.Candidate
+	for _, model := range cfg.Models() {
+		client, err := deepseek.NewClientWithOptions(model.APIKey, deepseek.WithBaseURL(model.BaseURL))
+		if err != nil {
+			return nil, fmt.Errorf("创建模型 %s 的客户端失败: %w", model.Name(), err)
+		}
+		handler := llm.NewInstrument(llm.NewHandler(client, model.Model), model.Name(), m)
+		candidates = append(candidates, llm.Candidate{
+			Name:    model.Name(),
+			Invoker: llm.NewRetry(handler, cfg.Retry),
+		})
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	return llm.NewFallback(candidates...), nil
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/yumosx/agent/internal/config"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/render"
+	"github.com/yumosx/agent/internal/service"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `commands:
+  <message>       在 executor 的上下文里直接对话
+  /plan           查看当前 plan
+  /plan <task>    为 task 生成新的 plan
+  /run            执行 plan 里未完成的 step
+  /skip <n>       跳过第 n 个 step
+  /retry <n>      重新执行第 n 个 step
+  /help           查看帮助
+  /exit           退出, 也可以使用 Ctrl-D
+执行过程中按 Ctrl-C 取消当前操作
+`
+
+// confirmTools -confirm 时需要确认的工具, 只读的 view_file 和 terminate 不需要确认
+var confirmTools = []string{"bash", "golang_execute"}
+
+// repl 交互式终端, 同一个 session 的 executor 上下文在多次输入之间保留
+func repl(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	confirm := fs.Bool("confirm", true, "执行 bash 和 golang_execute 之前都需要确认")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return fmt.Errorf("配置错误:\n%w", err)
+	}
+
+	sessions, closer, err := newSessions(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var sessionCfg service.SessionConfig
+	if *confirm {
+		for _, name := range confirmTools {
+			sessionCfg.Rules = append(sessionCfg.Rules, policy.Rule{Name: "confirm", Tool: name})
+		}
+	}
+	session, err := sessions.Create(sessionCfg)
+	if err != nil {
+		return err
+	}
+
+	out := &terminal{w: os.Stdout, lines: readLines(os.Stdin)}
+	session.Observe(out)
+	// 审批请求交给 interruptible 在读取命令的 goroutine 里处理, 不会和之后的命令抢输入
+	approvals := make(chan policy.Request, 1)
+	session.Gate.Notify(func(req policy.Request) {
+		select {
+		case approvals <- req:
+		default:
+		}
+	})
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	fmt.Fprintf(out.w, "session %s, 输入 /help 查看帮助\n", session.Id)
+	for {
+		fmt.Fprint(out.w, "> ")
+		line, err := out.readLine(context.Background())
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(out.w)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "/exit" || line == "/quit" {
+			return nil
+		}
+
+		if err = interruptible(interrupt, func(ctx context.Context) error {
+			return replCommand(ctx, session, out, line)
+		}, func(ctx context.Context, req policy.Request) {
+			out.decide(ctx, session.Gate, req)
+		}, approvals); err != nil {
+			fmt.Fprintf(out.w, "error: %v\n", err)
+		}
+	}
+}
+
+// interruptible 执行 fn, 期间的审批请求交给 approve 在当前 goroutine 里处理,
+// 收到 Ctrl-C 时取消 fn 和等待中的审批, 不退出 repl
+func interruptible(interrupt chan os.Signal, fn func(ctx context.Context) error, approve func(ctx context.Context, req policy.Request), approvals chan policy.Request) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			// 取消之后还没有处理的审批请求已经失效
+			select {
+			case <-approvals:
+			default:
+			}
+			if ctx.Err() != nil {
+				return errors.New("canceled")
+			}
+			return err
+		case req := <-approvals:
+			approve(ctx, req)
+		}
+	}
+}
+
+func replCommand(ctx context.Context, session *service.Session, out *terminal, line string) error {
+	if !strings.HasPrefix(line, "/") {
+		result, err := session.Chat(ctx, line)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out.w, result.Summary)
+		return nil
+	}
+
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch command {
+	case "/help":
+		fmt.Fprint(out.w, replHelp)
+	case "/plan":
+		if arg == "" {
+			fmt.Fprint(out.w, render.Text(session.Record()))
+			return nil
+		}
+		plan, err := session.Plan(ctx, arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out.w, plan)
+	case "/run":
+		if err := session.Run(ctx); err != nil {
+			return err
+		}
+		fmt.Fprintln(out.w, session.Record().Summary)
+	case "/skip", "/retry":
+		index, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("usage: %s <n>", command)
+		}
+		if command == "/skip" {
+			err = session.Skip(index)
+		} else {
+			err = session.Retry(index)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out.w, render.Text(session.Record()))
+	default:
+		return fmt.Errorf("unknown command %s, 输入 /help 查看帮助", command)
+	}
+	return nil
+}
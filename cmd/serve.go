@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/yumosx/agent/internal/auth"
+	"github.com/yumosx/agent/internal/config"
+	"github.com/yumosx/agent/internal/handler"
+	"github.com/yumosx/agent/internal/metrics"
+	"log/slog"
+)
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return fmt.Errorf("配置错误:\n%w", err)
+	}
+
+	var opts []handler.HandlerOption
+	var m *metrics.Metrics
+	if cfg.Server.Metrics {
+		m = metrics.New()
+		opts = append(opts, handler.WithMetrics(m))
+	}
+
+	sessions, closer, err := newSessions(cfg, m)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	authenticator := auth.New(cfg.Auth)
+	if !authenticator.Enabled() {
+		slog.Warn("auth.keys is empty, all endpoints are open")
+	}
+	opts = append(opts, handler.WithAuth(authenticator))
+
+	hd := handler.NewHandler(sessions, opts...)
+	router := gin.Default()
+	hd.SetupRoutes(router)
+	return router.Run(cfg.Server.Listen)
+}
+
+// keygen 只输出 key 一次, 配置里保存的是哈希
+func keygen(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: agent keygen <name>")
+	}
+
+	key, err := auth.Generate()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("key: %s\n\n", key)
+	fmt.Printf("auth:\n  keys:\n    - name: %s\n      hash: %s\n", args[0], auth.Hash(key))
+	return nil
+}
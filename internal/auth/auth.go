@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix 生成的 key 的前缀, 方便在日志和代码里识别
+const prefix = "agent_"
+
+// Key 一个调用方的 API key, 配置里只保存 key 的哈希
+type Key struct {
+	// Name 用来区分调用方, session 属于创建它的 key
+	Name string `yaml:"name"`
+	// Hash sha256:<hex>, 通过 agent keygen 生成
+	Hash string `yaml:"hash"`
+	// RateLimit 每分钟最多的请求数, 0 表示不限制
+	RateLimit int `yaml:"rate_limit"`
+	// Burst 允许的突发请求数, 为 0 时等于 RateLimit
+	Burst int `yaml:"burst"`
+	// MaxRuns 同时执行的 plan 数量, 0 表示不限制
+	MaxRuns int `yaml:"max_runs"`
+}
+
+// Config Keys 为空时不检查 API key, 所有接口都可以直接访问
+type Config struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// Validate 返回所有不合法的配置项
+func (c Config) Validate() error {
+	var errs []error
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+	for i, key := range c.Keys {
+		if key.Name == "" {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].name 不能为空", i))
+		} else if names[key.Name] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].name 重复: %q", i, key.Name))
+		}
+		names[key.Name] = true
+
+		if !validHash(key.Hash) {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].hash 必须是 sha256:<hex>, 通过 agent keygen 生成", i))
+		} else if hashes[key.Hash] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].hash 重复", i))
+		}
+		hashes[key.Hash] = true
+
+		if key.RateLimit < 0 || key.Burst < 0 || key.MaxRuns < 0 {
+			errs = append(errs, fmt.Errorf("auth.keys[%d] 的限制不能小于 0", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validHash(hash string) bool {
+	digest, ok := strings.CutPrefix(hash, "sha256:")
+	if !ok || len(digest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// Hash 返回 key 的哈希, 填到配置的 hash 里, key 是随机生成的, 不需要加盐
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Generate 生成一个随机的 key
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// Authenticator 校验 API key, 并且按照 key 限制请求的速率和同时执行的 plan, a 为空时不做限制
+type Authenticator struct {
+	// hashes key 的哈希到名称
+	hashes map[string]string
+	quotas map[string]*quota
+	now    func() time.Time
+}
+
+type quota struct {
+	key Key
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	running int
+}
+
+func New(cfg Config) *Authenticator {
+	a := &Authenticator{hashes: make(map[string]string), quotas: make(map[string]*quota), now: time.Now}
+	for _, key := range cfg.Keys {
+		a.hashes[strings.ToLower(key.Hash)] = key.Name
+		a.quotas[key.Name] = &quota{key: key, tokens: float64(burst(key))}
+	}
+	return a
+}
+
+// Enabled 没有配置 key 时不需要认证
+func (a *Authenticator) Enabled() bool {
+	return a != nil && len(a.hashes) != 0
+}
+
+// Authenticate 返回 key 的名称, key 不存在时返回 false
+func (a *Authenticator) Authenticate(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	name, ok := a.hashes[Hash(key)]
+	return name, ok
+}
+
+// Allow 按照令牌桶限制 name 的请求速率, 超过时返回需要等待的时间
+func (a *Authenticator) Allow(name string) (time.Duration, bool) {
+	q, ok := a.quota(name)
+	if !ok || q.key.RateLimit == 0 {
+		return 0, true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rate := float64(q.key.RateLimit) / 60
+	now := a.now()
+	if !q.last.IsZero() {
+		q.tokens = min(float64(burst(q.key)), q.tokens+now.Sub(q.last).Seconds()*rate)
+	}
+	q.last = now
+
+	if q.tokens < 1 {
+		return time.Duration((1 - q.tokens) / rate * float64(time.Second)), false
+	}
+	q.tokens--
+	return 0, true
+}
+
+// Acquire 占用 name 一个同时执行 plan 的名额, 执行结束之后调用 Release
+func (a *Authenticator) Acquire(name string) bool {
+	q, ok := a.quota(name)
+	if !ok {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.key.MaxRuns != 0 && q.running >= q.key.MaxRuns {
+		return false
+	}
+	q.running++
+	return true
+}
+
+func (a *Authenticator) Release(name string) {
+	q, ok := a.quota(name)
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running > 0 {
+		q.running--
+	}
+}
+
+func (a *Authenticator) quota(name string) (*quota, bool) {
+	if a == nil {
+		return nil, false
+	}
+	q, ok := a.quotas[name]
+	return q, ok
+}
+
+func burst(key Key) int {
+	if key.Burst > 0 {
+		return key.Burst
+	}
+	return key.RateLimit
+}
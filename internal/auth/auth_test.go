@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	key, err := Generate()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, prefix))
+
+	a := New(Config{Keys: []Key{{Name: "ci", Hash: Hash(key)}}})
+	assert.True(t, a.Enabled())
+
+	name, ok := a.Authenticate(key)
+	assert.True(t, ok)
+	assert.Equal(t, "ci", name)
+
+	_, ok = a.Authenticate(key + "x")
+	assert.False(t, ok)
+	_, ok = a.Authenticate("")
+	assert.False(t, ok)
+
+	assert.False(t, New(Config{}).Enabled())
+}
+
+func TestAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := New(Config{Keys: []Key{
+		{Name: "ci", Hash: Hash("a"), RateLimit: 60, Burst: 2},
+		{Name: "admin", Hash: Hash("b")},
+	}})
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, ok := a.Allow("ci")
+		assert.True(t, ok)
+	}
+	wait, ok := a.Allow("ci")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// 每秒恢复一个
+	now = now.Add(time.Second)
+	_, ok = a.Allow("ci")
+	assert.True(t, ok)
+	_, ok = a.Allow("ci")
+	assert.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		_, ok = a.Allow("admin")
+		assert.True(t, ok)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	a := New(Config{Keys: []Key{{Name: "ci", Hash: Hash("a"), MaxRuns: 1}}})
+
+	assert.True(t, a.Acquire("ci"))
+	assert.False(t, a.Acquire("ci"))
+	a.Release("ci")
+	a.Release("ci")
+	assert.True(t, a.Acquire("ci"))
+	assert.False(t, a.Acquire("ci"))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{Keys: []Key{{Name: "ci", Hash: Hash("a")}}}.Validate())
+
+	err := Config{Keys: []Key{
+		{Name: "ci", Hash: Hash("a")},
+		{Name: "ci", Hash: "plain-text-key", RateLimit: -1},
+		{Hash: Hash("a")},
+	}}.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `auth.keys[1].name 重复: "ci"`)
+	assert.Contains(t, err.Error(), "auth.keys[1].hash 必须是 sha256:<hex>")
+	assert.Contains(t, err.Error(), "auth.keys[1] 的限制不能小于 0")
+	assert.Contains(t, err.Error(), "auth.keys[2].name 不能为空")
+	assert.Contains(t, err.Error(), "auth.keys[2].hash 重复")
+}
@@ -0,0 +1,373 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/yumosx/agent/internal/auth"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/logging"
+	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/tool"
+	"github.com/yumosx/agent/internal/tracing"
+	"github.com/yumosx/agent/internal/webhook"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 目前支持的模型服务
+var providers = map[string]string{
+	"deepseek": "https://api.deepseek.com/",
+	"openai":   "https://api.openai.com/v1/",
+}
+
+// Tools executor 可以使用的工具, terminate 总是开启
+var Tools = []string{"create_chat_completion", "golang_execute", "bash", "view_file"}
+
+type Config struct {
+	Server  Server        `yaml:"server"`
+	LLM     LLM           `yaml:"llm"`
+	Agent   Agent         `yaml:"agent"`
+	Sandbox *tool.Sandbox `yaml:"sandbox"`
+	// Policy 审批规则和 bash 策略的配置文件, 为空时不检查
+	Policy string `yaml:"policy"`
+	// Log 日志的级别和格式, 日志输出到 stderr
+	Log logging.Config `yaml:"log"`
+	// Tracing plan、step、模型调用和工具调用的 trace
+	Tracing tracing.Config `yaml:"tracing"`
+	// Webhooks 接收所有 session 事件的 webhook 以及投递的重试
+	Webhooks webhook.Config `yaml:"webhooks"`
+	// Auth agent serve 的 API key, 为空时不需要认证
+	Auth auth.Config `yaml:"auth"`
+}
+
+type Server struct {
+	Listen string `yaml:"listen"`
+	// Metrics 是否提供 GET /metrics
+	Metrics bool `yaml:"metrics"`
+}
+
+type LLM struct {
+	Provider string `yaml:"provider"`
+	Model    string `yaml:"model"`
+	APIKey   string `yaml:"api_key"`
+	// BaseURL 为空时使用 provider 的默认地址
+	BaseURL string `yaml:"base_url"`
+	// Retry 每次模型调用的重试和超时
+	Retry llm.RetryPolicy `yaml:"retry"`
+	// Cassette 录制或者回放模型调用和工具输出
+	Cassette Cassette `yaml:"cassette"`
+	// Fallbacks 主模型失败或者重试用完之后按照顺序尝试的模型
+	Fallbacks []Model `yaml:"fallbacks"`
+	// Pricing 每个模型每百万 token 的价格, 用来计算费用, 和默认的价格表合并
+	Pricing llm.Prices `yaml:"pricing"`
+}
+
+// Model fallback 链上的一个模型, api_key 和 base_url 为空时和主模型的 provider 相同则沿用主模型的配置
+type Model struct {
+	Provider string `yaml:"provider"`
+	Model    string `yaml:"model"`
+	APIKey   string `yaml:"api_key"`
+	BaseURL  string `yaml:"base_url"`
+}
+
+// Models 主模型和 fallback 模型, 按照调用的顺序排列
+func (l LLM) Models() []Model {
+	models := []Model{{Provider: l.Provider, Model: l.Model, APIKey: l.APIKey, BaseURL: l.BaseURL}}
+	return append(models, l.Fallbacks...)
+}
+
+// Name provider/model, 记录在运行记录里
+func (m Model) Name() string {
+	return m.Provider + "/" + m.Model
+}
+
+type Cassette struct {
+	// Mode 为 record 或者 replay, 为空时不启用
+	Mode string `yaml:"mode"`
+	Path string `yaml:"path"`
+}
+
+type Agent struct {
+	MaxSteps    int           `yaml:"max_steps"`
+	BashTimeout time.Duration `yaml:"bash_timeout"`
+	Workspace   string        `yaml:"workspace"`
+	Tools       []string      `yaml:"tools"`
+	// Budget 每次执行 plan 的预算, 创建 session 时可以指定更严格的预算
+	Budget domain.Budget `yaml:"budget"`
+	// OutputLimit 工具输出的上限, 单位字节, 超过时只保留开头和结尾, 完整的输出保存到工作目录的 .outputs 下
+	OutputLimit int `yaml:"output_limit"`
+	// Trajectory 是否把每个 session 的运行轨迹保存到 workspace 的 .trajectories 下
+	Trajectory bool `yaml:"trajectory"`
+	// ContextTokens 模型的上下文窗口, 接近时总结较早的消息, 0 表示不压缩
+	ContextTokens int `yaml:"context_tokens"`
+}
+
+func Default() *Config {
+	return &Config{
+		Server:   Server{Listen: ":8080", Metrics: true},
+		Log:      logging.DefaultConfig(),
+		Tracing:  tracing.DefaultConfig(),
+		Webhooks: webhook.DefaultConfig(),
+		LLM: LLM{
+			Provider: "deepseek",
+			Model:    "deepseek-chat",
+			Retry:    llm.DefaultRetryPolicy(),
+			Pricing:  llm.DefaultPrices(),
+		},
+		Agent: Agent{
+			MaxSteps:    10,
+			BashTimeout: 20 * time.Second,
+			Workspace:   filepath.Join(os.TempDir(), "agent"),
+			Tools:       append([]string(nil), Tools...),
+			OutputLimit: 16 * 1024,
+			Trajectory:  true,
+			// deepseek-chat 的上下文是 64K
+			ContextTokens: 60000,
+		},
+	}
+}
+
+// Load 按照 默认值 < 配置文件 < 环境变量 < 命令行参数 的优先级加载配置,
+// 配置相关的参数会注册到 fs 上, 解析之后剩余的参数通过 fs.Args() 获取
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+
+	path := fs.String("config", os.Getenv("AGENT_CONFIG"), "配置文件路径, 也可以使用 AGENT_CONFIG")
+	listen := fs.String("listen", "", "监听地址")
+	model := fs.String("model", "", "模型名称")
+	apiKey := fs.String("api-key", "", "模型服务的 API key")
+	workspace := fs.String("workspace", "", "工具执行的工作目录")
+	maxSteps := fs.Int("max-steps", 0, "每个 step 最多调用模型的次数")
+	bashTimeout := fs.Duration("bash-timeout", 0, "bash 命令的超时时间")
+	policy := fs.String("policy", "", "策略配置文件路径")
+	record := fs.String("record", "", "把模型调用和工具输出录制到这个文件")
+	replay := fs.String("replay", "", "回放录制的文件, 不会调用模型和执行工具")
+	logLevel := fs.String("log-level", "", "日志级别: debug、info、warn 或者 error")
+	logFormat := fs.String("log-format", "", "日志格式: text 或者 json")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Server.Listen = *listen
+		case "model":
+			cfg.LLM.Model = *model
+		case "api-key":
+			cfg.LLM.APIKey = *apiKey
+		case "workspace":
+			cfg.Agent.Workspace = *workspace
+		case "max-steps":
+			cfg.Agent.MaxSteps = *maxSteps
+		case "bash-timeout":
+			cfg.Agent.BashTimeout = *bashTimeout
+		case "policy":
+			cfg.Policy = *policy
+		case "record":
+			cfg.LLM.Cassette = Cassette{Mode: "record", Path: *record}
+		case "replay":
+			cfg.LLM.Cassette = Cassette{Mode: "replay", Path: *replay}
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+
+	if err = yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	strs := map[string]*string{
+		"AGENT_LISTEN":     &c.Server.Listen,
+		"AGENT_PROVIDER":   &c.LLM.Provider,
+		"AGENT_MODEL":      &c.LLM.Model,
+		"AGENT_BASE_URL":   &c.LLM.BaseURL,
+		"AGENT_WORKSPACE":  &c.Agent.Workspace,
+		"AGENT_POLICY":     &c.Policy,
+		"AGENT_LOG_LEVEL":  &c.Log.Level,
+		"AGENT_LOG_FORMAT": &c.Log.Format,
+	}
+	for key, value := range strs {
+		if v, ok := os.LookupEnv(key); ok {
+			*value = v
+		}
+	}
+
+	// token 是之前使用的环境变量, 保留兼容
+	for _, key := range []string{"token", "AGENT_API_KEY"} {
+		if v, ok := os.LookupEnv(key); ok {
+			c.LLM.APIKey = v
+		}
+	}
+
+	if v, ok := os.LookupEnv("AGENT_MAX_STEPS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("AGENT_MAX_STEPS 非法: %w", err)
+		}
+		c.Agent.MaxSteps = n
+	}
+
+	if v, ok := os.LookupEnv("AGENT_BASH_TIMEOUT"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("AGENT_BASH_TIMEOUT 非法: %w", err)
+		}
+		c.Agent.BashTimeout = d
+	}
+	return nil
+}
+
+// Validate 返回所有不合法的配置项
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Listen == "" {
+		errs = append(errs, errors.New("server.listen 不能为空"))
+	}
+
+	if baseURL, ok := providers[c.LLM.Provider]; !ok {
+		errs = append(errs, fmt.Errorf("llm.provider 不支持 %q", c.LLM.Provider))
+	} else if c.LLM.BaseURL == "" {
+		c.LLM.BaseURL = baseURL
+	}
+	if c.LLM.Model == "" {
+		errs = append(errs, errors.New("llm.model 不能为空"))
+	}
+	for i := range c.LLM.Fallbacks {
+		errs = append(errs, c.LLM.validateFallback(i)...)
+	}
+	// 回放的时候不会调用模型
+	if c.LLM.APIKey == "" && c.LLM.Cassette.Mode != "replay" {
+		errs = append(errs, errors.New("llm.api_key 不能为空, 可以通过配置文件、AGENT_API_KEY 或者 -api-key 设置"))
+	}
+	if err := c.LLM.Retry.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("llm.%w", err))
+	}
+	switch c.LLM.Cassette.Mode {
+	case "":
+	case "record", "replay":
+		if c.LLM.Cassette.Path == "" {
+			errs = append(errs, errors.New("llm.cassette.path 不能为空"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("llm.cassette.mode 不支持 %q", c.LLM.Cassette.Mode))
+	}
+
+	if c.Agent.MaxSteps <= 0 {
+		errs = append(errs, errors.New("agent.max_steps 必须大于 0"))
+	}
+	if c.Agent.BashTimeout <= 0 {
+		errs = append(errs, errors.New("agent.bash_timeout 必须大于 0"))
+	}
+	if c.Agent.Workspace == "" {
+		errs = append(errs, errors.New("agent.workspace 不能为空"))
+	}
+	if c.Agent.OutputLimit < 0 {
+		errs = append(errs, errors.New("agent.output_limit 不能小于 0"))
+	}
+	if c.Agent.ContextTokens < 0 {
+		errs = append(errs, errors.New("agent.context_tokens 不能小于 0"))
+	}
+	if err := c.Agent.Budget.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("agent.%w", err))
+	}
+	if err := c.Sandbox.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, name := range c.Agent.Tools {
+		if !contains(Tools, name) {
+			errs = append(errs, fmt.Errorf("agent.tools 不支持 %q", name))
+		}
+	}
+
+	if err := c.Log.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Webhooks.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Policy != "" {
+		if _, err := os.Stat(c.Policy); err != nil {
+			errs = append(errs, fmt.Errorf("policy 文件不可用: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *LLM) validateFallback(i int) []error {
+	var errs []error
+	m := &l.Fallbacks[i]
+
+	baseURL, ok := providers[m.Provider]
+	if !ok {
+		errs = append(errs, fmt.Errorf("llm.fallbacks[%d].provider 不支持 %q", i, m.Provider))
+	}
+	if m.Model == "" {
+		errs = append(errs, fmt.Errorf("llm.fallbacks[%d].model 不能为空", i))
+	}
+
+	if m.Provider == l.Provider {
+		if m.APIKey == "" {
+			m.APIKey = l.APIKey
+		}
+		if m.BaseURL == "" {
+			m.BaseURL = l.BaseURL
+		}
+	}
+	if m.BaseURL == "" {
+		m.BaseURL = baseURL
+	}
+	if m.APIKey == "" && l.Cassette.Mode != "replay" {
+		errs = append(errs, fmt.Errorf("llm.fallbacks[%d].api_key 不能为空", i))
+	}
+	return errs
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
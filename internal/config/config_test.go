@@ -0,0 +1,120 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/auth"
+	"github.com/yumosx/agent/internal/logging"
+	"github.com/yumosx/agent/internal/webhook"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  listen: ":9090"
+llm:
+  model: deepseek-reasoner
+  api_key: file-key
+  pricing:
+    gpt-4o: {input: 2.5, output: 10}
+agent:
+  max_steps: 5
+  bash_timeout: 30s
+  tools: [bash]
+sandbox:
+  memory_mb: 256
+  go_timeout: 2m
+log:
+  format: json
+`), 0o644))
+
+	for _, key := range []string{"token", "AGENT_API_KEY"} {
+		t.Setenv(key, "")
+		require.NoError(t, os.Unsetenv(key))
+	}
+	t.Setenv("AGENT_MODEL", "env-model")
+	t.Setenv("AGENT_BASH_TIMEOUT", "1m")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-config", path, "-model", "flag-model", "-log-level", "debug", "task"})
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9090", cfg.Server.Listen)
+	assert.Equal(t, "flag-model", cfg.LLM.Model)
+	assert.Equal(t, "file-key", cfg.LLM.APIKey)
+	assert.Equal(t, "https://api.deepseek.com/", cfg.LLM.BaseURL)
+	assert.Equal(t, 5, cfg.Agent.MaxSteps)
+	assert.Equal(t, time.Minute, cfg.Agent.BashTimeout)
+	assert.Equal(t, []string{"bash"}, cfg.Agent.Tools)
+	assert.Equal(t, 256, cfg.Sandbox.MemoryMB)
+	assert.Equal(t, 2*time.Minute, cfg.Sandbox.GoTimeout)
+	assert.Equal(t, logging.Config{Level: "debug", Format: "json"}, cfg.Log)
+	// 配置文件里的价格和默认的价格表合并
+	assert.Equal(t, 10.0, cfg.LLM.Pricing["gpt-4o"].Output)
+	assert.Contains(t, cfg.LLM.Pricing, "deepseek-chat")
+	assert.Equal(t, []string{"task"}, fs.Args())
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.LLM.Provider = "unknown"
+	cfg.Agent.MaxSteps = 0
+	cfg.Agent.Tools = []string{"browser_use"}
+	cfg.LLM.Retry.Jitter = 2
+	cfg.Agent.Budget.MaxCost = -1
+	cfg.Log.Format = "xml"
+	cfg.Webhooks.Endpoints = []webhook.Endpoint{{URL: "https://ci.example.com/hooks"}}
+	cfg.Auth.Keys = []auth.Key{{Name: "ci", Hash: "plain-text-key"}}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `llm.provider 不支持 "unknown"`)
+	assert.Contains(t, err.Error(), "llm.api_key 不能为空")
+	assert.Contains(t, err.Error(), "agent.max_steps 必须大于 0")
+	assert.Contains(t, err.Error(), `agent.tools 不支持 "browser_use"`)
+	assert.Contains(t, err.Error(), "llm.retry.jitter 必须在 0 到 1 之间")
+	assert.Contains(t, err.Error(), "agent.budget 不能小于 0")
+	assert.Contains(t, err.Error(), `log.format 不支持 "xml"`)
+	assert.Contains(t, err.Error(), "webhooks.endpoints[0].secret 不能为空")
+	assert.Contains(t, err.Error(), "auth.keys[0].hash 必须是 sha256:<hex>")
+}
+
+func TestValidateReplay(t *testing.T) {
+	cfg := Default()
+	cfg.LLM.Cassette = Cassette{Mode: "replay", Path: "run.json"}
+	// 回放的时候不需要 api key
+	assert.NoError(t, cfg.Validate())
+
+	cfg.LLM.Cassette = Cassette{Mode: "rewind"}
+	assert.ErrorContains(t, cfg.Validate(), `llm.cassette.mode 不支持 "rewind"`)
+}
+
+func TestValidateFallbacks(t *testing.T) {
+	cfg := Default()
+	cfg.LLM.APIKey = "primary-key"
+	cfg.LLM.Fallbacks = []Model{
+		{Provider: "deepseek", Model: "deepseek-reasoner"},
+		{Provider: "openai", Model: "gpt-4o", APIKey: "openai-key"},
+	}
+	require.NoError(t, cfg.Validate())
+
+	models := cfg.LLM.Models()
+	require.Len(t, models, 3)
+	assert.Equal(t, "deepseek/deepseek-chat", models[0].Name())
+	// 同一个 provider 沿用主模型的 key 和地址
+	assert.Equal(t, "primary-key", models[1].APIKey)
+	assert.Equal(t, "https://api.deepseek.com/", models[1].BaseURL)
+	assert.Equal(t, "https://api.openai.com/v1/", models[2].BaseURL)
+
+	cfg.LLM.Fallbacks = []Model{{Provider: "openai"}}
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "llm.fallbacks[0].model 不能为空")
+	assert.Contains(t, err.Error(), "llm.fallbacks[0].api_key 不能为空")
+}
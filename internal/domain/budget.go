@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Budget 一次运行的上限, 0 表示不限制
+type Budget struct {
+	// MaxTokens 所有模型调用的 token 合计
+	MaxTokens int `yaml:"max_tokens" json:"max_tokens,omitempty"`
+	// MaxCost 按照价格表计算的费用, 单位美元
+	MaxCost float64 `yaml:"max_cost" json:"max_cost,omitempty"`
+	// MaxDuration 在 JSON 里和配置文件一样使用 "60s"、"30m" 这样的字符串
+	MaxDuration  time.Duration `yaml:"max_duration" json:"max_duration,omitempty"`
+	MaxToolCalls int           `yaml:"max_tool_calls" json:"max_tool_calls,omitempty"`
+	MaxLLMCalls  int           `yaml:"max_llm_calls" json:"max_llm_calls,omitempty"`
+}
+
+// Validate 预算不能小于 0
+func (b Budget) Validate() error {
+	if b.MaxTokens < 0 || b.MaxCost < 0 || b.MaxDuration < 0 || b.MaxToolCalls < 0 || b.MaxLLMCalls < 0 {
+		return errors.New("budget 不能小于 0")
+	}
+	return nil
+}
+
+// budget 没有 MarshalJSON 和 UnmarshalJSON, 用来编码其它字段
+type budget Budget
+
+func (b Budget) MarshalJSON() ([]byte, error) {
+	var duration string
+	if b.MaxDuration != 0 {
+		duration = b.MaxDuration.String()
+	}
+	return json.Marshal(struct {
+		budget
+		MaxDuration string `json:"max_duration,omitempty"`
+	}{budget(b), duration})
+}
+
+func (b *Budget) UnmarshalJSON(data []byte) error {
+	v := struct {
+		*budget
+		MaxDuration string `json:"max_duration"`
+	}{budget: (*budget)(b)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.MaxDuration == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(v.MaxDuration)
+	if err != nil {
+		return fmt.Errorf("max_duration 必须是 60s、30m 这样的时长: %w", err)
+	}
+	b.MaxDuration = d
+	return nil
+}
+
+// Merge 合并 session 自己的预算, 只允许比默认预算更严格
+func (b Budget) Merge(other *Budget) Budget {
+	if other == nil {
+		return b
+	}
+
+	return Budget{
+		MaxTokens:    Stricter(b.MaxTokens, other.MaxTokens),
+		MaxCost:      Stricter(b.MaxCost, other.MaxCost),
+		MaxDuration:  Stricter(b.MaxDuration, other.MaxDuration),
+		MaxToolCalls: Stricter(b.MaxToolCalls, other.MaxToolCalls),
+		MaxLLMCalls:  Stricter(b.MaxLLMCalls, other.MaxLLMCalls),
+	}
+}
+
+// Stricter 返回两个上限里更严格的一个, 0 表示不限制; b 小于等于 0 时返回 a, 只能收紧 a 不能放宽
+func Stricter[T int | float64 | time.Duration](a, b T) T {
+	if b <= 0 {
+		return a
+	}
+	if a <= 0 || b < a {
+		return b
+	}
+	return a
+}
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"context"
 	"github.com/yumosx/agent/internal/domain/params"
 )
 
@@ -46,6 +47,30 @@ type LLMResponse struct {
 	Content   string
 	Done      bool
 	ToolCalls []LLMToolCall
+	// Model 返回结果的模型
+	Model string
+	Usage Usage
+}
+
+// Usage 模型调用消耗的 token 和费用
+type Usage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	// CachedTokens 命中缓存的 prompt token, 包含在 PromptTokens 里
+	CachedTokens     int `json:"cached_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// Cost 按照价格表计算的费用, 单位美元, 没有配置价格时为 0
+	Cost float64 `json:"cost"`
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CachedTokens:     u.CachedTokens + other.CachedTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+		Cost:             u.Cost + other.Cost,
+	}
 }
 
 type LLMToolCall struct {
@@ -59,3 +84,9 @@ type LLMToolCallFunction struct {
 	Name      string
 	Arguments string
 }
+
+// ToolFunc 执行一次工具调用, 返回工具的输出
+type ToolFunc func(ctx context.Context, name string, args string) string
+
+// ToolMiddleware 包装工具的执行, 例如记录和回放工具的输出
+type ToolMiddleware func(next ToolFunc) ToolFunc
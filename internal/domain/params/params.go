@@ -88,6 +88,20 @@ func NewBashParams() *Parameters {
 	return parameters
 }
 
+func NewViewParams() *Parameters {
+	parameters := newParams()
+	parameters.Params["path"] = NewValue(
+		"string",
+		"The path of the file to view, relative to the workspace.")
+	parameters.Params["offset"] = NewValue(
+		"integer",
+		"The line number to start from, starting at 1. Defaults to 1.")
+	parameters.Params["limit"] = NewValue(
+		"integer",
+		"The maximum number of lines to return. Defaults to 200.")
+	return parameters
+}
+
 func NewBrowserUse() *Parameters {
 	parameters := newParams()
 	parameters.Params[""] = NewValue("", "")
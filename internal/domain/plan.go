@@ -1,13 +1,108 @@
 package domain
 
+import "time"
+
+const (
+	NO_STARTED  = "no_started"
+	IN_PROGRESS = "in_progress"
+	COMPLETED   = "completed"
+	BLOCKED     = "blocked"
+	// SKIPPED 用户跳过的 step, 不会执行
+	SKIPPED = "skipped"
+	// ABORTED 预算耗尽时没有执行完的 step, resume 的时候重新执行
+	ABORTED = "aborted"
+)
+
+// plan 整体的运行状态
+const (
+	PLANNED  = "planned"
+	RUNNING  = "running"
+	FINISHED = "finished"
+	FAILED   = "failed"
+)
+
 // Plan 大模型给我们返回的
 type Plan struct {
-	Id    string
-	Title string
-	Steps []Step
+	Id     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Steps  []Step `json:"steps"`
+	// Summary 全部 step 执行完之后模型生成的总结报告
+	Summary string `json:"summary,omitempty"`
+	// LLMCalls 生成 plan 和总结报告时的模型调用, step 里的调用记录在 step 上
+	LLMCalls []LLMCall `json:"llm_calls,omitempty"`
+	// Usage plan 自己和所有 step 的模型调用的合计
+	Usage Usage `json:"usage"`
+	// Exhausted 上一次运行耗尽的预算, 例如 tokens, 没有耗尽时为空
+	Exhausted string `json:"exhausted,omitempty"`
 }
 
 type Step struct {
-	State   string
-	Content string
+	State   string `json:"state"`
+	Content string `json:"content"`
+	// Notes 执行过程中模型输出的中间说明
+	Notes []string `json:"notes,omitempty"`
+	// Summary step 结束时模型给出的总结
+	Summary    string           `json:"summary,omitempty"`
+	ToolCalls  []ToolCallRecord `json:"tool_calls,omitempty"`
+	LLMCalls   []LLMCall        `json:"llm_calls,omitempty"`
+	Usage      Usage            `json:"usage"`
+	Artifacts  []string         `json:"artifacts,omitempty"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+}
+
+// ToolCallRecord 一次工具调用的记录
+type ToolCallRecord struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output"`
+	// ExitCode bash 和 golang_execute 的退出码, 其他工具或者没有执行时为空
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Decision 人工审批的结果, 不需要审批时为空
+	Decision  string        `json:"decision,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// LLMCall 一次成功的模型调用的记录
+type LLMCall struct {
+	// Model 实际返回结果的模型, 发生 fallback 时和配置的主模型不同
+	Model     string        `json:"model"`
+	Usage     Usage         `json:"usage"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// StepResult executor 执行一个 step 的结果
+type StepResult struct {
+	Summary   string
+	Notes     []string
+	ToolCalls []ToolCallRecord
+	LLMCalls  []LLMCall
+	Artifacts []string
+}
+
+// Usage 所有模型调用的合计
+func (r StepResult) Usage() Usage {
+	return sumCalls(r.LLMCalls)
+}
+
+func sumCalls(calls []LLMCall) Usage {
+	var total Usage
+	for _, call := range calls {
+		total = total.Add(call.Usage)
+	}
+	return total
+}
+
+// TotalUsage plan 自己和所有 step 的模型调用的合计
+func (p Plan) TotalUsage() Usage {
+	total := sumCalls(p.LLMCalls)
+	for _, step := range p.Steps {
+		total = total.Add(sumCalls(step.LLMCalls))
+	}
+	return total
 }
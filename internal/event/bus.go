@@ -0,0 +1,86 @@
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Handler 处理一个事件, 在发布事件的 goroutine 里同步调用, 耗时的处理需要自己放到后台
+type Handler func(ctx context.Context, ev Event)
+
+// Bus 进程内的发布订阅, 方法在 b 为空时什么都不做
+type Bus struct {
+	mu       sync.RWMutex
+	next     int
+	handlers []subscription
+}
+
+type subscription struct {
+	id      int
+	handler Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe 按照订阅的顺序接收之后发布的所有事件, 返回的函数用来取消订阅
+func (b *Bus) Subscribe(handler Handler) func() {
+	if b == nil {
+		return func() {}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.next++
+	id := b.next
+	b.handlers = append(b.handlers, subscription{id: id, handler: handler})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, sub := range b.handlers {
+			if sub.id == id {
+				b.handlers = append(b.handlers[:i:i], b.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish 填充事件的时间和 ctx 里的 step, 然后依次交给订阅方
+func (b *Bus) Publish(ctx context.Context, ev Event) {
+	if b == nil {
+		return
+	}
+
+	meta := ev.Metadata()
+	if meta.Time.IsZero() {
+		meta.Time = time.Now()
+	}
+	if index, ok := StepFrom(ctx); ok && meta.Step == nil {
+		meta.Step = &index
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, sub := range handlers {
+		sub.handler(ctx, ev)
+	}
+}
+
+type stepKey struct{}
+
+// WithStep 之后发布的事件记录为属于 index 这个 step
+func WithStep(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, stepKey{}, index)
+}
+
+func StepFrom(ctx context.Context) (int, bool) {
+	index, ok := ctx.Value(stepKey{}).(int)
+	return index, ok
+}
@@ -0,0 +1,49 @@
+package event
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	var order []string
+	var received []Event
+	bus.Subscribe(func(ctx context.Context, ev Event) {
+		order = append(order, "first")
+		received = append(received, ev)
+	})
+	cancel := bus.Subscribe(func(ctx context.Context, ev Event) {
+		order = append(order, "second")
+	})
+
+	bus.Publish(WithStep(context.Background(), 2), &ToolStarted{Meta: Meta{Session: "abc"}, Call: domain.ToolCallRecord{Name: "bash"}})
+	cancel()
+	bus.Publish(context.Background(), &PlanFinished{Meta: Meta{Session: "abc"}, Plan: domain.Plan{Status: domain.FINISHED}})
+
+	assert.Equal(t, []string{"first", "second", "first"}, order)
+	require.Len(t, received, 2)
+
+	started, ok := received[0].(*ToolStarted)
+	require.True(t, ok)
+	assert.Equal(t, TOOL_STARTED, started.Type())
+	assert.False(t, started.Time.IsZero())
+	require.NotNil(t, started.Step)
+	assert.Equal(t, 2, *started.Step)
+
+	plan, ok := PlanOf(received[1])
+	require.True(t, ok)
+	assert.Equal(t, domain.FINISHED, plan.Status)
+	assert.Nil(t, received[1].Metadata().Step)
+
+	_, ok = PlanOf(started)
+	assert.False(t, ok)
+
+	var empty *Bus
+	empty.Publish(context.Background(), &PlanUpdated{})
+	empty.Subscribe(func(ctx context.Context, ev Event) {})()
+}
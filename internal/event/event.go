@@ -0,0 +1,133 @@
+package event
+
+import (
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/policy"
+	"time"
+)
+
+// Event 的类型
+const (
+	PLAN_CREATED      = "plan.created"
+	PLAN_UPDATED      = "plan.updated"
+	PLAN_STARTED      = "plan.started"
+	PLAN_FINISHED     = "plan.finished"
+	STEP_CHANGED      = "step.changed"
+	LLM_REQUEST       = "llm.request"
+	LLM_RESPONSE      = "llm.response"
+	TOOL_STARTED      = "tool.started"
+	TOOL_FINISHED     = "tool.finished"
+	APPROVAL_REQUIRED = "approval.required"
+)
+
+// Event PlanService 和 PlanExecutor 发布的事件, 订阅方通过类型断言取得具体的事件
+type Event interface {
+	Type() string
+	Metadata() *Meta
+}
+
+// Meta 所有事件共有的字段, Time 和 Step 为空时由 Bus 在发布时填充
+type Meta struct {
+	Session string    `json:"session_id"`
+	Time    time.Time `json:"time"`
+	// Step 产生事件的 step, 生成 plan 和最后的总结不属于任何 step
+	Step *int `json:"step,omitempty"`
+}
+
+func (m *Meta) Metadata() *Meta {
+	return m
+}
+
+// PlanCreated 模型生成了新的 plan
+type PlanCreated struct {
+	Meta
+	Plan domain.Plan `json:"plan"`
+}
+
+// PlanUpdated plan 的内容发生变化, 例如生成了最后的总结
+type PlanUpdated struct {
+	Meta
+	Plan domain.Plan `json:"plan"`
+}
+
+// PlanStarted plan 开始执行
+type PlanStarted struct {
+	Meta
+	Plan domain.Plan `json:"plan"`
+}
+
+// PlanFinished 一次执行结束, Plan.Status 为 FINISHED 或者 FAILED
+type PlanFinished struct {
+	Meta
+	Plan domain.Plan `json:"plan"`
+}
+
+// StepChanged step 的状态发生变化
+type StepChanged struct {
+	Meta
+	Index int         `json:"index"`
+	Step  domain.Step `json:"step"`
+	// Plan 变化之后整个 plan 的拷贝, 用来保存, 不会序列化
+	Plan domain.Plan `json:"-"`
+}
+
+// LLMRequest 调用模型之前的完整请求
+type LLMRequest struct {
+	Meta
+	Request domain.LLMRequest `json:"request"`
+}
+
+// LLMResponse 模型的回复, 调用失败时 Error 不为空
+type LLMResponse struct {
+	Meta
+	Response domain.LLMResponse `json:"response"`
+	Error    string             `json:"error,omitempty"`
+	Duration time.Duration      `json:"duration"`
+}
+
+// ToolStarted 开始处理一次工具调用, 这时还没有经过策略检查和审批
+type ToolStarted struct {
+	Meta
+	Call domain.ToolCallRecord `json:"call"`
+}
+
+// ToolFinished 一次工具调用结束, Outcome 为 metrics 里定义的调用结果
+type ToolFinished struct {
+	Meta
+	Record  domain.ToolCallRecord `json:"record"`
+	Outcome string                `json:"outcome"`
+}
+
+// ApprovalRequired 工具调用等待审批, 通过 Request.Id 给出审批结果
+type ApprovalRequired struct {
+	Meta
+	Request policy.Request `json:"request"`
+}
+
+func (e *PlanCreated) Type() string      { return PLAN_CREATED }
+func (e *PlanUpdated) Type() string      { return PLAN_UPDATED }
+func (e *PlanStarted) Type() string      { return PLAN_STARTED }
+func (e *PlanFinished) Type() string     { return PLAN_FINISHED }
+func (e *StepChanged) Type() string      { return STEP_CHANGED }
+func (e *LLMRequest) Type() string       { return LLM_REQUEST }
+func (e *LLMResponse) Type() string      { return LLM_RESPONSE }
+func (e *ToolStarted) Type() string      { return TOOL_STARTED }
+func (e *ToolFinished) Type() string     { return TOOL_FINISHED }
+func (e *ApprovalRequired) Type() string { return APPROVAL_REQUIRED }
+
+// PlanOf 返回事件里变化之后的 plan, 和 plan 无关的事件返回 false
+func PlanOf(ev Event) (domain.Plan, bool) {
+	switch ev := ev.(type) {
+	case *PlanCreated:
+		return ev.Plan, true
+	case *PlanUpdated:
+		return ev.Plan, true
+	case *PlanStarted:
+		return ev.Plan, true
+	case *PlanFinished:
+		return ev.Plan, true
+	case *StepChanged:
+		return ev.Plan, true
+	}
+	return domain.Plan{}, false
+}
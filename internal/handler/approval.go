@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/yumosx/agent/internal/policy"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+)
+
+// approvalMessage 客户端通过 WebSocket 发送的审批结果
+type approvalMessage struct {
+	Approval string `json:"approval"`
+	policy.Decision
+}
+
+// approvalEvent 服务端通过 WebSocket 发送的消息, type 为 approval.required、approval.decided 或者 error
+type approvalEvent struct {
+	Type     string          `json:"type"`
+	Approval string          `json:"approval,omitempty"`
+	Request  *policy.Request `json:"request,omitempty"`
+	Action   string          `json:"action,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// handleApprovalSocket 通过 WebSocket 推送等待审批的工具调用, 连接时先推送已经在等待的请求,
+// 客户端发送 {"approval", "action", "arguments", "reason"} 给出审批结果
+func (h *Handler) handleApprovalSocket(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			serveApprovals(svc.Gate, ws)
+		},
+	}
+	server.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// sameOrigin 浏览器只能从同源的页面连接, 防止其他网站借用浏览器所在的网络审批工具调用
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return errors.New("origin 和 host 不一致")
+	}
+	config.Origin = u
+	return nil
+}
+
+func serveApprovals(gate *policy.Gate, ws *websocket.Conn) {
+	// 客户端太慢时丢弃, 不阻塞执行, 客户端可以通过 GET /sessions/:id/approvals 重新获取
+	requests := make(chan policy.Request, 64)
+	cancel := gate.Notify(func(req policy.Request) {
+		select {
+		case requests <- req:
+		default:
+		}
+	})
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	messages := make(chan approvalMessage)
+	go func() {
+		defer close(messages)
+		for {
+			var msg approvalMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// 订阅之后再读取等待中的请求, 同一个请求可能出现两次
+	sent := make(map[string]bool)
+	push := func(req policy.Request) error {
+		if sent[req.Id] {
+			return nil
+		}
+		sent[req.Id] = true
+		return websocket.JSON.Send(ws, approvalEvent{Type: "approval.required", Approval: req.Id, Request: &req})
+	}
+	for _, req := range gate.Pending() {
+		if push(req) != nil {
+			return
+		}
+	}
+
+	for {
+		var err error
+		select {
+		case req := <-requests:
+			err = push(req)
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			reply := approvalEvent{Type: "approval.decided", Approval: msg.Approval, Action: msg.Action}
+			if decideErr := gate.Decide(msg.Approval, msg.Decision); decideErr != nil {
+				reply = approvalEvent{Type: "error", Approval: msg.Approval, Error: decideErr.Error()}
+			}
+			err = websocket.JSON.Send(ws, reply)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -1,23 +1,140 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/yumosx/agent/internal/auth"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/render"
+	"github.com/yumosx/agent/internal/report"
 	"github.com/yumosx/agent/internal/service"
+	"github.com/yumosx/agent/internal/webhook"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// ownerKey gin.Context 里保存 API key 名称的 key
+const ownerKey = "owner"
+
 type Handler struct {
-	svc *service.PlanService
+	sessions *service.Sessions
+	// metrics 为空时不提供 /metrics
+	metrics *metrics.Metrics
+	// auth 为空或者没有配置 key 时所有接口都可以直接访问
+	auth *auth.Authenticator
+}
+
+type HandlerOption interface {
+	Option(h *Handler)
+}
+
+type HandlerOptionFunc func(h *Handler)
+
+func (fn HandlerOptionFunc) Option(h *Handler) {
+	fn(h)
+}
+
+// WithMetrics 记录每个请求的指标, 通过 GET /metrics 导出
+func WithMetrics(m *metrics.Metrics) HandlerOption {
+	return HandlerOptionFunc(func(h *Handler) {
+		h.metrics = m
+	})
 }
 
-func NewHandler(svc *service.PlanService) *Handler {
-	return &Handler{svc: svc}
+// WithAuth 除了首页和 /metrics 之外的接口都需要 API key, session 只有创建它的 key 可以访问
+func WithAuth(a *auth.Authenticator) HandlerOption {
+	return HandlerOptionFunc(func(h *Handler) {
+		h.auth = a
+	})
+}
+
+func NewHandler(sessions *service.Sessions, opts ...HandlerOption) *Handler {
+	h := &Handler{sessions: sessions}
+	for _, opt := range opts {
+		opt.Option(h)
+	}
+	return h
 }
 
 func (h *Handler) SetupRoutes(router *gin.Engine) {
+	// 中间件只对之后注册的路由生效
+	if h.metrics != nil {
+		router.Use(h.observe)
+		router.GET("/metrics", gin.WrapH(h.metrics.Handler()))
+	}
 	router.GET("/", h.serveIndex)
+	if h.auth.Enabled() {
+		router.Use(h.authenticate)
+	}
 	router.POST("/chat", h.handleChat)
 	router.POST("/code", h.handleCode)
+	router.GET("/sessions/:id", h.handleRecord)
+	router.DELETE("/sessions/:id", h.handleDelete)
+	router.GET("/sessions/:id/plan", h.handlePlan)
+	router.POST("/sessions/:id/execute", h.handleExecute)
+	router.GET("/sessions/:id/report", h.handleReport)
+	router.GET("/sessions/:id/usage", h.handleUsage)
+	router.GET("/sessions/:id/trajectory", h.handleTrajectory)
+	router.GET("/sessions/:id/events", h.handleEvents)
+	router.GET("/sessions/:id/webhooks", h.handleWebhooks)
+	router.POST("/sessions/:id/webhooks", h.handleRegister)
+	router.GET("/sessions/:id/approvals", h.handleApprovals)
+	router.GET("/sessions/:id/approvals/ws", h.handleApprovalSocket)
+	router.POST("/sessions/:id/approvals/:approval", h.handleDecide)
+}
+
+// observe 按照路由的模板记录, 没有匹配的路由统一记为 unmatched
+func (h *Handler) observe(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	h.metrics.ObserveHTTP(ctx.Request.Method, route, ctx.Writer.Status(), time.Since(start))
+}
+
+// authenticate 从 Authorization: Bearer 或者 X-API-Key 读取 key, 并且按照 key 限制请求的速率
+func (h *Handler) authenticate(ctx *gin.Context) {
+	key, _ := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if key == "" {
+		key = ctx.GetHeader("X-API-Key")
+	}
+	name, ok := h.auth.Authenticate(key)
+	if !ok {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key 无效"})
+		return
+	}
+	if wait, ok := h.auth.Allow(name); !ok {
+		ctx.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "请求太频繁"})
+		return
+	}
+
+	ctx.Set(ownerKey, name)
+	ctx.Next()
+}
+
+// session 返回路径里的 session, 不存在或者属于其他 key 时返回 404, 不暴露 session 是否存在
+func (h *Handler) session(ctx *gin.Context) (*service.Session, bool) {
+	svc, ok := h.sessions.Get(ctx.Param("id"))
+	if !ok || svc.Owner != ctx.GetString(ownerKey) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "session 不存在"})
+		return nil, false
+	}
+	return svc, true
 }
 
 func (h *Handler) serveIndex(ctx *gin.Context) {
@@ -26,7 +143,8 @@ func (h *Handler) serveIndex(ctx *gin.Context) {
 
 func (h *Handler) handleChat(ctx *gin.Context) {
 	var request struct {
-		Message string `json:"message"`
+		Message string `json:"message" binding:"required"`
+		service.SessionConfig
 	}
 
 	if err := ctx.ShouldBindJSON(&request); err != nil {
@@ -34,19 +152,330 @@ func (h *Handler) handleChat(ctx *gin.Context) {
 		return
 	}
 
-	plan, err := h.svc.Plan(ctx, request.Message)
+	format, err := render.ParseFormat(ctx.Query("format"), ctx.GetHeader("Accept"), render.TEXT)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 负数会被当作不限制, 不能用来放宽默认的预算和资源限制
+	if request.Budget != nil {
+		if err = request.Budget.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err = request.Sandbox.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(request.Webhooks) != 0 {
+		webhooks := h.sessions.Webhooks()
+		if webhooks == nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "没有开启 webhook"})
+			return
+		}
+		for _, endpoint := range request.Webhooks {
+			if err = webhooks.Check(endpoint); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("webhook 配置错误: %v", err)})
+				return
+			}
+		}
+	}
+
+	request.Owner = ctx.GetString(ownerKey)
+	svc, err := h.sessions.Create(request.SessionConfig)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
+		return
+	}
+
+	plan, err := svc.Plan(ctx, request.Message)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "内部错误"})
+		// 没有 plan 的 session 不能执行, 也不会返回给调用方, 直接删除
+		_ = h.sessions.Delete(svc.Id)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
 		return
 	}
 
 	response := gin.H{
-		"response": plan,
+		"session_id": svc.Id,
+		"format":     format,
+		"response":   plan,
+	}
+
+	switch format {
+	case render.TEXT:
+	case render.JSON:
+		response["response"] = svc.Record()
+	default:
+		output, err := render.Render(svc.Record(), format)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
+			return
+		}
+		response["response"] = output
 	}
 
 	ctx.JSON(http.StatusOK, response)
 }
 
+// handlePlan 按照 format 参数或者 Accept 头渲染 plan, 默认返回 JSON
+func (h *Handler) handlePlan(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	format, err := render.ParseFormat(ctx.Query("format"), ctx.GetHeader("Accept"), render.JSON)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	output, err := render.Render(svc.Record(), format)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
+		return
+	}
+	ctx.Data(http.StatusOK, render.ContentType(format), []byte(output))
+}
+
+func (h *Handler) handleRecord(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, svc.Record())
+}
+
+// handleDelete 删除 session, 执行中的 session 不能删除
+func (h *Handler) handleDelete(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	if err := h.sessions.Delete(svc.Id); err != nil {
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// handleUsage token 和费用, session 包括重新生成的 plan 和重试之前的 step, plan 只包含当前的记录
+func (h *Handler) handleUsage(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	record := svc.Record()
+	steps := make([]domain.Usage, len(record.Steps))
+	for i, step := range record.Steps {
+		steps[i] = step.Usage
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"session_id": svc.Id,
+		"session":    svc.Usage(),
+		"plan":       record.Usage,
+		"steps":      steps,
+	})
+}
+
+// handleTrajectory 下载 JSONL 格式的运行轨迹, 格式见 internal/trajectory
+func (h *Handler) handleTrajectory(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	path := svc.Trajectory.Path()
+	if path == "" {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "没有开启运行轨迹"})
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=trajectory-%s.jsonl", svc.Id))
+	ctx.Data(http.StatusOK, "application/x-ndjson; charset=utf-8", data)
+}
+
+// handleEvents 通过 SSE 推送 session 之后的事件, 一次执行结束或者客户端断开时关闭, 模型的完整请求太大, 不推送
+func (h *Handler) handleEvents(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	events := make(chan event.Event, 64)
+	cancel := svc.Subscribe(func(_ context.Context, ev event.Event) {
+		if ev.Type() == event.LLM_REQUEST {
+			return
+		}
+		// 客户端太慢时丢弃, 不阻塞执行
+		select {
+		case events <- ev:
+		default:
+		}
+	})
+	defer cancel()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case ev := <-events:
+			ctx.SSEvent(ev.Type(), ev)
+			return ev.Type() != event.PLAN_FINISHED
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// handleWebhooks 返回 session 的 webhook 和最近的投递记录, 不返回 secret
+func (h *Handler) handleWebhooks(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+	webhooks := h.sessions.Webhooks()
+	if webhooks == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "没有开启 webhook"})
+		return
+	}
+
+	endpoints := webhooks.Endpoints(svc.Id)
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	ctx.JSON(http.StatusOK, gin.H{"webhooks": endpoints, "deliveries": webhooks.Deliveries(svc.Id)})
+}
+
+// handleRegister 添加只接收这个 session 事件的 webhook
+func (h *Handler) handleRegister(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+	webhooks := h.sessions.Webhooks()
+	if webhooks == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "没有开启 webhook"})
+		return
+	}
+
+	var endpoint webhook.Endpoint
+	if err := ctx.ShouldBindJSON(&endpoint); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := webhooks.Register(svc.Id, endpoint); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"url": endpoint.URL, "events": endpoint.Events})
+}
+
+// handleExecute 在后台执行 plan, 通过 GET /sessions/:id 查看进度, 执行期间占用 key 的一个名额
+func (h *Handler) handleExecute(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	if !h.auth.Acquire(svc.Owner) {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "同时执行的 plan 达到上限"})
+		return
+	}
+	var once sync.Once
+	var cancel func()
+	release := func() {
+		once.Do(func() {
+			cancel()
+			h.auth.Release(svc.Owner)
+		})
+	}
+	cancel = svc.Subscribe(func(_ context.Context, ev event.Event) {
+		if ev.Type() == event.PLAN_FINISHED {
+			release()
+		}
+	})
+
+	if err := svc.Start(); err != nil {
+		release()
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"session_id": svc.Id})
+}
+
+func (h *Handler) handleApprovals(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"approvals": svc.Gate.Pending()})
+}
+
+// handleDecide 对等待中的工具调用给出审批结果: approve、deny 或者 edit
+func (h *Handler) handleDecide(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	var decision policy.Decision
+	if err := ctx.ShouldBindJSON(&decision); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := svc.Gate.Decide(ctx.Param("approval"), decision); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"approval": ctx.Param("approval"), "action": decision.Action})
+}
+
+// handleReport 下载运行报告, format 支持 md 和 json
+func (h *Handler) handleReport(ctx *gin.Context) {
+	svc, ok := h.session(ctx)
+	if !ok {
+		return
+	}
+
+	r := report.New(svc.Record())
+	switch ctx.DefaultQuery("format", "md") {
+	case "md":
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=report-%s.md", svc.Id))
+		ctx.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(r.Markdown()))
+	case "json":
+		data, err := r.JSON()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "内部错误"})
+			return
+		}
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=report-%s.json", svc.Id))
+		ctx.Data(http.StatusOK, "application/json; charset=utf-8", data)
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "format 非法"})
+	}
+}
+
 func (h *Handler) handleCode(ctx *gin.Context) {
 
 }
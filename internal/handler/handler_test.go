@@ -1,21 +1,88 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/yumosx/agent/internal/auth"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/service"
+	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"github.com/yumosx/agent/internal/webhook"
 	"github.com/yumosx/got/pkg/suitex"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type HandlerSuite struct {
-	server *gin.Engine
+	server  *gin.Engine
+	metrics *metrics.Metrics
 	suite.Suite
 }
 
 func (h *HandlerSuite) SetupSuite() {
+	gin.SetMode(gin.TestMode)
+
+	hello := llmtest.Call("hello", llmtest.Tool("terminate", `{"status": "success"}`))
+	hello.Usage = domain.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10, Cost: 0.01}
+	fake := llmtest.New().
+		When(llmtest.HasTool("planning"), llmtest.Call("",
+			llmtest.Tool("planning", `{"command": "create", "title": "hello", "steps": ["say hello"]}`))).
+		When(llmtest.SystemContains("reporting assistant"), llmtest.Text("said hello")).
+		When(llmtest.HasTool("terminate"), hello)
+
+	// 测试的接收方在本机
+	webhookConfig := webhook.DefaultConfig()
+	webhookConfig.AllowLocal = true
+
+	h.metrics = metrics.New()
+	invoker := llm.NewInstrument(fake, "llmtest/fake", h.metrics)
+	workspace := h.T().TempDir()
+	sessions := service.NewSessions(invoker, workspace,
+		service.WithMetrics(h.metrics),
+		service.WithTrajectory(filepath.Join(workspace, ".trajectories")),
+		service.WithWebhooks(webhook.New(webhookConfig)))
+	h.server = gin.New()
+	NewHandler(sessions, WithMetrics(h.metrics)).SetupRoutes(h.server)
+}
+
+func (h *HandlerSuite) get(path string, header ...string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	require.NoError(h.T(), err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp := httptest.NewRecorder()
+	h.server.ServeHTTP(resp, req)
+	return resp
+}
+
+func (h *HandlerSuite) chat(message string) string {
+	req, err := json.Marshal(map[string]string{"message": message})
+	require.NoError(h.T(), err)
+	response, err := suitex.MockPostResponse(h.server, "/chat", req)
+	require.NoError(h.T(), err)
+	require.Equal(h.T(), http.StatusOK, response.Code)
+
+	var body struct {
+		SessionId string `json:"session_id"`
+	}
+	require.NoError(h.T(), json.Unmarshal(response.Body.Bytes(), &body))
+	return body.SessionId
 }
 
 func (h *HandlerSuite) TestChat() {
@@ -29,11 +96,18 @@ func (h *HandlerSuite) TestChat() {
 		Name     string
 		Input    Msg
 		Expect   string
-		WantCode int64
+		WantCode int
 	}{
 		{
-			Name:  "请求",
-			Input: Msg{},
+			Name:     "请求",
+			Input:    Msg{},
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "生成 plan",
+			Input:    Msg{Message: "say hello"},
+			Expect:   "0. [-] say hello",
+			WantCode: http.StatusOK,
 		},
 	}
 
@@ -43,7 +117,421 @@ func (h *HandlerSuite) TestChat() {
 			require.NoError(t, err)
 			response, err := suitex.MockPostResponse(h.server, "/chat", req)
 			require.NoError(t, err)
-			assert.Equal(t, response.Code, tc.WantCode)
+			assert.Equal(t, tc.WantCode, response.Code)
+			assert.Contains(t, response.Body.String(), tc.Expect)
 		})
 	}
 }
+
+func (h *HandlerSuite) TestExecute() {
+	t := h.T()
+	id := h.chat("say hello")
+
+	response, err := suitex.MockPostResponse(h.server, "/sessions/"+id+"/execute", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, response.Code)
+
+	var plan domain.Plan
+	require.Eventually(t, func() bool {
+		resp := h.get("/sessions/" + id)
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &plan))
+		return plan.Status == domain.FINISHED
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "said hello", plan.Summary)
+	assert.Equal(t, "hello", plan.Steps[0].Summary)
+
+	resp := h.get("/sessions/"+id+"/plan", "Accept", "text/markdown")
+	assert.Equal(t, "# hello\n\n- [x] say hello\n", resp.Body.String())
+
+	resp = h.get("/sessions/" + id + "/report?format=json")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Disposition"), "report-"+id+".json")
+
+	var usage struct {
+		Session domain.Usage   `json:"session"`
+		Plan    domain.Usage   `json:"plan"`
+		Steps   []domain.Usage `json:"steps"`
+	}
+	resp = h.get("/sessions/" + id + "/usage")
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &usage))
+	assert.Equal(t, 10, usage.Plan.TotalTokens)
+	assert.Equal(t, 10, usage.Session.TotalTokens)
+	require.Len(t, usage.Steps, 1)
+	assert.Equal(t, 0.01, usage.Steps[0].Cost)
+
+	// 状态变成 finished 之后才会写入最后一条记录
+	require.Eventually(t, func() bool {
+		resp = h.get("/sessions/" + id + "/trajectory")
+		return strings.Contains(resp.Body.String(), `"type":"final"`)
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Disposition"), "trajectory-"+id+".jsonl")
+	lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+	assert.Contains(t, lines[0], `"type":"llm_request"`)
+	assert.Contains(t, lines[len(lines)-1], `"type":"final"`)
+	assert.Contains(t, lines[len(lines)-1], `"status":"finished"`)
+
+	resp = h.get("/sessions/not_exist")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	req, err := http.NewRequest(http.MethodDelete, "/sessions/"+id, nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	h.server.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, http.StatusNotFound, h.get("/sessions/"+id).Code)
+}
+
+func (h *HandlerSuite) TestChatBudget() {
+	t := h.T()
+
+	for _, body := range []string{
+		`{"message": "say hello", "budget": {"max_tokens": -1}}`,
+		`{"message": "say hello", "budget": {"max_duration": "-1s"}}`,
+	} {
+		response, err := suitex.MockPostResponse(h.server, "/chat", []byte(body))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+		assert.Contains(t, response.Body.String(), "budget 不能小于 0")
+	}
+}
+
+func (h *HandlerSuite) TestChatSandbox() {
+	t := h.T()
+
+	response, err := suitex.MockPostResponse(h.server, "/chat", []byte(`{"message": "say hello", "sandbox": {"cpu_seconds": -1, "memory_mb": -1}}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "sandbox 不能小于 0")
+}
+
+func (h *HandlerSuite) TestMetrics() {
+	t := h.T()
+	id := h.chat("say hello")
+
+	response, err := suitex.MockPostResponse(h.server, "/sessions/"+id+"/execute", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, response.Code)
+	require.Eventually(t, func() bool {
+		return h.record(id).Status == domain.FINISHED
+	}, 2*time.Second, 10*time.Millisecond)
+	h.get("/sessions/not_exist")
+
+	var body string
+	require.Eventually(t, func() bool {
+		body = h.get("/metrics").Body.String()
+		return strings.Contains(body, "agent_running_plans 0")
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Contains(t, body, `agent_http_requests_total{method="POST",route="/chat",status="200"}`)
+	assert.Contains(t, body, `agent_http_requests_total{method="GET",route="/sessions/:id",status="404"}`)
+	assert.Contains(t, body, `agent_llm_calls_total{model="llmtest/fake",outcome="ok"}`)
+	assert.Contains(t, body, `agent_llm_tokens_total{model="llmtest/fake",type="prompt"}`)
+	assert.Contains(t, body, `agent_tool_executions_total{outcome="ok",tool="terminate"}`)
+	assert.Contains(t, body, `agent_plans_total{status="finished"}`)
+	assert.Regexp(t, `agent_active_sessions [1-9]`, body)
+}
+
+func (h *HandlerSuite) TestEvents() {
+	t := h.T()
+	id := h.chat("say hello")
+
+	server := httptest.NewServer(h.server)
+	defer server.Close()
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	// 返回响应头的时候已经订阅, 之后的事件都能收到
+	stream, err := client.Get(server.URL + "/sessions/" + id + "/events")
+	require.NoError(t, err)
+	defer stream.Body.Close()
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+
+	response, err := suitex.MockPostResponse(h.server, "/sessions/"+id+"/execute", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, response.Code)
+
+	// 执行结束之后服务端关闭连接
+	data, err := io.ReadAll(stream.Body)
+	require.NoError(t, err)
+	body := string(data)
+	assert.Contains(t, body, "event:plan.started")
+	assert.Contains(t, body, "event:step.changed\ndata:{\"session_id\":\""+id+"\"")
+	assert.Contains(t, body, "event:tool.finished")
+	assert.Contains(t, body, "event:llm.response")
+	assert.NotContains(t, body, "event:llm.request")
+	assert.True(t, strings.HasPrefix(body[strings.LastIndex(body, "event:"):], "event:plan.finished"))
+
+	resp := h.get("/sessions/not_exist/events")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func (h *HandlerSuite) TestWebhooks() {
+	t := h.T()
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	req, err := json.Marshal(map[string]any{
+		"message":  "say hello",
+		"webhooks": []map[string]any{{"url": receiver.URL, "secret": "s3cret", "events": []string{"plan.completed"}}},
+	})
+	require.NoError(t, err)
+	response, err := suitex.MockPostResponse(h.server, "/chat", req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.Code)
+	var session struct {
+		SessionId string `json:"session_id"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &session))
+	id := session.SessionId
+
+	response, err = suitex.MockPostResponse(h.server, "/sessions/"+id+"/execute", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, response.Code)
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		assert.NoError(t, webhook.Verify("s3cret", r.Header, body, time.Minute))
+		var payload webhook.Payload
+		require.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, webhook.PLAN_COMPLETED, payload.Type)
+		assert.Equal(t, id, payload.Session)
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook 没有收到 plan.completed")
+	}
+
+	var body struct {
+		Webhooks   []webhook.Endpoint `json:"webhooks"`
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}
+	require.Eventually(t, func() bool {
+		resp := h.get("/sessions/" + id + "/webhooks")
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+		return len(body.Deliveries) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Len(t, body.Webhooks, 1)
+	assert.Empty(t, body.Webhooks[0].Secret)
+	assert.True(t, body.Deliveries[0].Delivered)
+
+	req, err = json.Marshal(map[string]any{"url": "not a url", "secret": "s3cret"})
+	require.NoError(t, err)
+	response, err = suitex.MockPostResponse(h.server, "/sessions/"+id+"/webhooks", req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	req, err = json.Marshal(map[string]any{"url": receiver.URL, "secret": "s3cret", "events": []string{"run.failed"}})
+	require.NoError(t, err)
+	response, err = suitex.MockPostResponse(h.server, "/sessions/"+id+"/webhooks", req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	req, err = json.Marshal(map[string]any{"message": "say hello", "webhooks": []map[string]any{{"url": receiver.URL}}})
+	require.NoError(t, err)
+	response, err = suitex.MockPostResponse(h.server, "/chat", req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// record 读取 session 的运行记录
+func (h *HandlerSuite) record(id string) domain.Plan {
+	var plan domain.Plan
+	resp := h.get("/sessions/" + id)
+	require.NoError(h.T(), json.Unmarshal(resp.Body.Bytes(), &plan))
+	return plan
+}
+
+func TestHandler(t *testing.T) {
+	suite.Run(t, new(HandlerSuite))
+}
+
+func TestAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// 执行时先等待 bash 的审批, 拒绝之后结束
+	fake := llmtest.New().
+		When(llmtest.HasTool("planning"), llmtest.Call("",
+			llmtest.Tool("planning", `{"command": "create", "title": "hello", "steps": ["say hello"]}`))).
+		When(llmtest.SystemContains("reporting assistant"), llmtest.Text("said hello")).
+		WhenOnce(llmtest.HasTool("terminate"), llmtest.Call("", llmtest.Tool("bash", `{"command": "echo hello"}`))).
+		When(llmtest.HasTool("terminate"), llmtest.Call("", llmtest.Tool("terminate", `{"status": "success"}`)))
+	sessions := service.NewSessions(fake, t.TempDir(),
+		service.WithPolicy(&policy.Config{Approval: []policy.Rule{{Name: "confirm", Tool: "bash"}}}, nil))
+	a := auth.New(auth.Config{Keys: []auth.Key{
+		{Name: "alice", Hash: auth.Hash("alice-key"), MaxRuns: 1},
+		{Name: "bob", Hash: auth.Hash("bob-key"), RateLimit: 60, Burst: 1},
+	}})
+	server := gin.New()
+	NewHandler(sessions, WithAuth(a)).SetupRoutes(server)
+
+	do := func(method, path, key string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, path, reader)
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp := httptest.NewRecorder()
+		server.ServeHTTP(resp, req)
+		return resp
+	}
+	chat := func() string {
+		resp := do(http.MethodPost, "/chat", "alice-key", map[string]string{"message": "say hello"})
+		require.Equal(t, http.StatusOK, resp.Code)
+		var body struct {
+			SessionId string `json:"session_id"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+		return body.SessionId
+	}
+
+	resp := do(http.MethodPost, "/chat", "", map[string]string{"message": "say hello"})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, "Bearer", resp.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/sessions/abc", "wrong-key", nil).Code)
+
+	first, second := chat(), chat()
+	svc, ok := sessions.Get(first)
+	require.True(t, ok)
+	assert.Equal(t, "alice", svc.Owner)
+
+	// 其他 key 看不到也不能执行 alice 的 session
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/sessions/"+first, "bob-key", nil).Code)
+	resp = do(http.MethodGet, "/sessions/"+first, "bob-key", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+
+	// 第一个 plan 等待审批的时候占用 alice 唯一的名额
+	require.Equal(t, http.StatusAccepted, do(http.MethodPost, "/sessions/"+first+"/execute", "alice-key", nil).Code)
+	require.Eventually(t, func() bool { return len(svc.Gate.Pending()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	resp = do(http.MethodPost, "/sessions/"+second+"/execute", "alice-key", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Contains(t, resp.Body.String(), "同时执行的 plan 达到上限")
+
+	approval := svc.Gate.Pending()[0].Id
+	resp = do(http.MethodPost, "/sessions/"+first+"/approvals/"+approval, "alice-key", policy.Decision{Action: policy.DENY, Reason: "no"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Eventually(t, func() bool { return svc.Record().Status == domain.FINISHED }, 2*time.Second, 10*time.Millisecond)
+
+	// 执行结束之后释放名额, 等第二个 plan 也执行结束, 避免清理工作目录的时候还在写入
+	next, ok := sessions.Get(second)
+	require.True(t, ok)
+	finished := make(chan struct{})
+	cancel := next.Subscribe(func(_ context.Context, ev event.Event) {
+		if ev.Type() == event.PLAN_FINISHED {
+			close(finished)
+		}
+	})
+	defer cancel()
+	require.Eventually(t, func() bool {
+		return do(http.MethodPost, "/sessions/"+second+"/execute", "alice-key", nil).Code == http.StatusAccepted
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "plan 没有执行结束")
+	}
+	assert.Equal(t, domain.FINISHED, next.Record().Status)
+
+	// 名额在 PLAN_FINISHED 的订阅里释放
+	require.Eventually(t, func() bool {
+		if !a.Acquire("alice") {
+			return false
+		}
+		a.Release("alice")
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestChatPlanFailed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// 没有调用 planning 工具, 创建 plan 失败
+	fake := llmtest.New().When(llmtest.HasTool("planning"), llmtest.Text("no plan"))
+	m := metrics.New()
+	sessions := service.NewSessions(fake, t.TempDir(), service.WithMetrics(m))
+	router := gin.New()
+	NewHandler(sessions, WithMetrics(m)).SetupRoutes(router)
+
+	response, err := suitex.MockPostResponse(router, "/chat", []byte(`{"message": "say hello"}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, response.Body.String(), "agent_active_sessions 0")
+}
+
+func TestApprovalSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	fake := llmtest.New().
+		When(llmtest.HasTool("planning"), llmtest.Call("",
+			llmtest.Tool("planning", `{"command": "create", "title": "hello", "steps": ["say hello"]}`))).
+		When(llmtest.SystemContains("reporting assistant"), llmtest.Text("said hello")).
+		WhenOnce(llmtest.HasTool("terminate"), llmtest.Call("", llmtest.Tool("bash", `{"command": "echo hello"}`))).
+		When(llmtest.HasTool("terminate"), llmtest.Call("", llmtest.Tool("terminate", `{"status": "success"}`)))
+	sessions := service.NewSessions(fake, t.TempDir(),
+		service.WithPolicy(&policy.Config{Approval: []policy.Rule{{Name: "confirm", Tool: "bash"}}}, nil))
+	router := gin.New()
+	NewHandler(sessions).SetupRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	response, err := suitex.MockPostResponse(router, "/chat", []byte(`{"message": "say hello"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.Code)
+	var body struct {
+		SessionId string `json:"session_id"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	svc, ok := sessions.Get(body.SessionId)
+	require.True(t, ok)
+
+	address := "ws" + strings.TrimPrefix(server.URL, "http") + "/sessions/" + body.SessionId + "/approvals/ws"
+	// 其他网站的页面不能连接
+	_, err = websocket.Dial(address, "", "http://evil.example")
+	assert.Error(t, err)
+
+	ws, err := websocket.Dial(address, "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.NoError(t, ws.SetDeadline(time.Now().Add(2*time.Second)))
+
+	response, err = suitex.MockPostResponse(router, "/sessions/"+body.SessionId+"/execute", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, response.Code)
+
+	var required approvalEvent
+	require.NoError(t, websocket.JSON.Receive(ws, &required))
+	assert.Equal(t, "approval.required", required.Type)
+	require.NotNil(t, required.Request)
+	assert.Equal(t, "bash", required.Request.Tool)
+
+	var failed approvalEvent
+	require.NoError(t, websocket.JSON.Send(ws, approvalMessage{Approval: "not_exist", Decision: policy.Decision{Action: policy.APPROVE}}))
+	require.NoError(t, websocket.JSON.Receive(ws, &failed))
+	assert.Equal(t, approvalEvent{Type: "error", Approval: "not_exist", Error: "审批请求不存在"}, failed)
+
+	var decided approvalEvent
+	edit := policy.Decision{Action: policy.EDIT, Arguments: `{"command": "echo edited"}`}
+	require.NoError(t, websocket.JSON.Send(ws, approvalMessage{Approval: required.Approval, Decision: edit}))
+	require.NoError(t, websocket.JSON.Receive(ws, &decided))
+	assert.Equal(t, approvalEvent{Type: "approval.decided", Approval: required.Approval, Action: policy.EDIT}, decided)
+
+	require.Eventually(t, func() bool { return svc.Record().Status == domain.FINISHED }, 2*time.Second, 10*time.Millisecond)
+	calls := svc.Record().Steps[0].ToolCalls
+	require.NotEmpty(t, calls)
+	assert.Equal(t, policy.EDIT, calls[0].Decision)
+	assert.Equal(t, "edited\n", calls[0].Output)
+}
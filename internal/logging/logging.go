@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Config 日志的级别和格式
+type Config struct {
+	// Level 为 debug、info、warn 或者 error
+	Level string `yaml:"level"`
+	// Format 为 text 或者 json
+	Format string `yaml:"format"`
+}
+
+func DefaultConfig() Config {
+	return Config{Level: "info", Format: "text"}
+}
+
+func (c Config) Validate() error {
+	if _, err := c.level(); err != nil {
+		return err
+	}
+	switch c.Format {
+	case "text", "json":
+		return nil
+	default:
+		return fmt.Errorf("log.format 不支持 %q", c.Format)
+	}
+}
+
+func (c Config) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, fmt.Errorf("log.level 不支持 %q", c.Level)
+	}
+	return level, nil
+}
+
+// New 按照配置创建写到 w 的 logger, 通过 With 放到 context 里的字段会自动加到每条日志上
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	level, _ := cfg.level()
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(&contextHandler{Handler: handler}), nil
+}
+
+type attrsKey struct{}
+
+// With 把 session、plan、step 等字段放到 ctx 里, 使用 slog.XxxContext 记录日志时带上这些字段
+func With(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	record := slog.NewRecord(time.Time{}, 0, "", 0)
+	record.Add(args...)
+
+	merged := make([]slog.Attr, 0, len(attrs)+record.NumAttrs())
+	merged = append(merged, attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		merged = append(merged, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, merged)
+}
+
+// Attrs 返回 ctx 里通过 With 设置的字段
+func Attrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := Attrs(ctx)
+	// 开启 trace 时带上 trace 和 span 的 id, 方便从日志找到对应的 span
+	if ctx != nil {
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			attrs = append(attrs[:len(attrs):len(attrs)], slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+		}
+	}
+	if len(attrs) != 0 {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
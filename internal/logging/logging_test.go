@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestContextAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "info", Format: "json"})
+	require.NoError(t, err)
+
+	ctx := With(context.Background(), "session_id", "abc")
+	ctx = With(ctx, "step", 1)
+	logger.InfoContext(ctx, "tool call", "tool", "bash")
+	logger.DebugContext(ctx, "hidden")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "tool call", line["msg"])
+	assert.Equal(t, "bash", line["tool"])
+	assert.Equal(t, "abc", line["session_id"])
+	assert.Equal(t, float64(1), line["step"])
+
+	// 父 context 不受影响
+	assert.Len(t, Attrs(context.Background()), 0)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+	assert.NoError(t, Config{Level: "DEBUG", Format: "text"}.Validate())
+	assert.Error(t, Config{Level: "verbose", Format: "text"}.Validate())
+	assert.Error(t, Config{Level: "info", Format: "xml"}.Validate())
+}
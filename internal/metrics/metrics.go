@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "agent"
+
+// 工具调用的结果
+const (
+	OK       = "ok"
+	FAILED   = "failed"
+	DENIED   = "denied"
+	BLOCKED  = "blocked"
+	DISABLED = "disabled"
+	ABORTED  = "aborted"
+)
+
+// Metrics 服务的 Prometheus 指标, 方法在 m 为空时什么都不做
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	llmCalls     *prometheus.CounterVec
+	llmDuration  *prometheus.HistogramVec
+	llmTokens    *prometheus.CounterVec
+	tools        *prometheus.CounterVec
+	toolDuration *prometheus.HistogramVec
+	sessions     prometheus.Gauge
+	running      prometheus.Gauge
+	plans        *prometheus.CounterVec
+}
+
+// New 使用独立的 registry, 除了 agent 的指标之外还包括 Go runtime 和进程的指标
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "http_requests_total", Help: "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "http_request_duration_seconds", Help: "HTTP request latency by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		llmCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "llm_calls_total", Help: "LLM API calls by model and outcome, each retry attempt counts once.",
+		}, []string{"model", "outcome"}),
+		llmDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "llm_call_duration_seconds", Help: "LLM API call latency by model.",
+			Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+		}, []string{"model"}),
+		llmTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "llm_tokens_total", Help: "Tokens used by model and type (prompt, cached, completion).",
+		}, []string{"model", "type"}),
+		tools: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "tool_executions_total", Help: "Tool executions by tool name and outcome.",
+		}, []string{"tool", "outcome"}),
+		toolDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "tool_duration_seconds", Help: "Tool execution latency by tool name.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60},
+		}, []string{"tool"}),
+		sessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "active_sessions", Help: "Sessions held in memory.",
+		}),
+		running: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "running_plans", Help: "Plans currently executing.",
+		}),
+		plans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "plans_total", Help: "Finished plan executions by status.",
+		}, []string{"status"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.llmCalls, m.llmDuration, m.llmTokens,
+		m.tools, m.toolDuration,
+		m.sessions, m.running, m.plans,
+	)
+	return m
+}
+
+// Handler 以 Prometheus 的文本格式输出所有指标
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Registry 用来在测试里读取指标
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// ObserveHTTP route 是路由的模板, 例如 /sessions/:id, 避免每个 session 一个时间序列
+func (m *Metrics) ObserveHTTP(method, route string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	m.httpDuration.WithLabelValues(method, route).Observe(d.Seconds())
+}
+
+// ObserveLLM 记录一次模型调用, err 不为空时不记录 token
+func (m *Metrics) ObserveLLM(model string, d time.Duration, usage domain.Usage, err error) {
+	if m == nil {
+		return
+	}
+	m.llmDuration.WithLabelValues(model).Observe(d.Seconds())
+	if err != nil {
+		m.llmCalls.WithLabelValues(model, "error").Inc()
+		return
+	}
+	m.llmCalls.WithLabelValues(model, OK).Inc()
+	m.llmTokens.WithLabelValues(model, "prompt").Add(float64(usage.PromptTokens))
+	m.llmTokens.WithLabelValues(model, "cached").Add(float64(usage.CachedTokens))
+	m.llmTokens.WithLabelValues(model, "completion").Add(float64(usage.CompletionTokens))
+}
+
+func (m *Metrics) ObserveTool(tool, outcome string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.tools.WithLabelValues(tool, outcome).Inc()
+	m.toolDuration.WithLabelValues(tool).Observe(d.Seconds())
+}
+
+func (m *Metrics) SetSessions(n int) {
+	if m == nil {
+		return
+	}
+	m.sessions.Set(float64(n))
+}
+
+// PlanStarted 和 PlanFinished 成对调用
+func (m *Metrics) PlanStarted() {
+	if m == nil {
+		return
+	}
+	m.running.Inc()
+}
+
+func (m *Metrics) PlanFinished(status string) {
+	if m == nil {
+		return
+	}
+	m.running.Dec()
+	m.plans.WithLabelValues(status).Inc()
+}
+
+// Handle 订阅 session 的事件, 记录工具调用和 plan 的执行
+func (m *Metrics) Handle(ctx context.Context, ev event.Event) {
+	switch ev := ev.(type) {
+	case *event.ToolFinished:
+		m.ObserveTool(ev.Record.Name, ev.Outcome, ev.Record.Duration)
+	case *event.PlanStarted:
+		m.PlanStarted()
+	case *event.PlanFinished:
+		m.PlanFinished(ev.Plan.Status)
+	}
+}
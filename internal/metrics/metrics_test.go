@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	m := New()
+	m.ObserveLLM("deepseek/deepseek-chat", time.Second, domain.Usage{PromptTokens: 10, CompletionTokens: 5}, nil)
+	m.ObserveLLM("deepseek/deepseek-chat", time.Second, domain.Usage{}, errors.New("rate limited"))
+	ctx := context.Background()
+	m.Handle(ctx, &event.ToolFinished{Record: domain.ToolCallRecord{Name: "bash", Duration: time.Millisecond}, Outcome: FAILED})
+	m.Handle(ctx, &event.PlanStarted{})
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.llmCalls.WithLabelValues("deepseek/deepseek-chat", "error")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(m.llmTokens.WithLabelValues("deepseek/deepseek-chat", "prompt")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.tools.WithLabelValues("bash", FAILED)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.running))
+
+	m.Handle(ctx, &event.PlanFinished{Plan: domain.Plan{Status: domain.FAILED}})
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.running))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.plans.WithLabelValues(domain.FAILED)))
+
+	// 为空时不记录
+	var empty *Metrics
+	empty.ObserveTool("bash", OK, time.Second)
+	empty.Handle(ctx, &event.PlanStarted{})
+	empty.SetSessions(1)
+}
@@ -0,0 +1,285 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	APPROVE = "approve"
+	DENY    = "deny"
+	EDIT    = "edit"
+)
+
+// Rule 命中规则的工具调用需要人工审批, 设置了的条件之间是 and 的关系
+type Rule struct {
+	Name string `yaml:"name"`
+	// Tool 工具名, 为空时匹配所有工具
+	Tool string `yaml:"tool"`
+	// Command 匹配 bash 的 command 或者 golang_execute 的 code
+	Command string `yaml:"command"`
+	// OutsideWorkspace 参数里出现工作目录之外的路径
+	OutsideWorkspace bool `yaml:"outside_workspace"`
+
+	command *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	if r.Command == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.Command)
+	if err != nil {
+		return fmt.Errorf("审批规则 %q 的 command 非法: %w", r.Name, err)
+	}
+	r.command = re
+	return nil
+}
+
+func (r *Rule) Match(workspace string, tool string, args string) bool {
+	if r.Tool != "" && r.Tool != tool {
+		return false
+	}
+
+	if r.command != nil && !r.command.MatchString(commandText(args)) {
+		return false
+	}
+
+	if r.OutsideWorkspace && !outsideWorkspace(workspace, args) {
+		return false
+	}
+	return true
+}
+
+// commandText 取出参数里可执行的内容, 解析失败时使用原始参数
+func commandText(args string) string {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(args), &parsed); err != nil {
+		return args
+	}
+
+	for _, key := range []string{"command", "code"} {
+		if s, ok := parsed[key].(string); ok {
+			return s
+		}
+	}
+	return args
+}
+
+// paths 取出参数里可能是路径的内容
+func paths(args string) []string {
+	var result []string
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(args), &parsed); err == nil {
+		for _, key := range []string{"path", "file", "file_path", "filename"} {
+			if s, ok := parsed[key].(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+
+	fields := strings.FieldsFunc(commandText(args), func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`'"();|&<>=,`+"`", r)
+	})
+	for _, field := range fields {
+		if strings.HasPrefix(field, "/") || strings.HasPrefix(field, "~") || strings.Contains(field, "..") {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+func outsideWorkspace(workspace string, args string) bool {
+	for _, path := range paths(args) {
+		if strings.HasPrefix(path, "~") {
+			return true
+		}
+		if workspace == "" {
+			if filepath.IsAbs(path) {
+				return true
+			}
+			continue
+		}
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workspace, path)
+		}
+		rel, err := filepath.Rel(workspace, filepath.Clean(path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decision 人工审批的结果, EDIT 时使用 Arguments 替换原来的参数
+type Decision struct {
+	Action    string `json:"action"`
+	Arguments string `json:"arguments,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Request 等待审批的工具调用
+type Request struct {
+	Id        string    `json:"id"`
+	Tool      string    `json:"tool"`
+	Arguments string    `json:"arguments"`
+	Rule      string    `json:"rule"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Approver executor 在执行工具之前调用, 返回是否允许执行
+type Approver interface {
+	Approve(ctx context.Context, tool string, args string) (Decision, error)
+}
+
+type pendingRequest struct {
+	req      Request
+	decision chan Decision
+}
+
+// Gate 根据规则暂停工具调用, 直到通过 Decide 给出审批结果
+type Gate struct {
+	rules     []Rule
+	workspace string
+
+	mu      sync.Mutex
+	seq     int
+	pending map[string]*pendingRequest
+	next    int
+	notify  []notifier
+}
+
+type notifier struct {
+	id int
+	fn func(Request)
+}
+
+func NewGate(rules []Rule, workspace string) (*Gate, error) {
+	compiled := make([]Rule, len(rules))
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		compiled[i] = rule
+	}
+	return &Gate{rules: compiled, workspace: workspace, pending: make(map[string]*pendingRequest)}, nil
+}
+
+// Match 返回第一条命中的规则
+func (g *Gate) Match(tool string, args string) (Rule, bool) {
+	for _, rule := range g.rules {
+		if rule.Match(g.workspace, tool, args) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (g *Gate) Approve(ctx context.Context, tool string, args string) (Decision, error) {
+	rule, ok := g.Match(tool, args)
+	if !ok {
+		return Decision{Action: APPROVE}, nil
+	}
+
+	g.mu.Lock()
+	g.seq += 1
+	p := &pendingRequest{
+		req: Request{
+			Id:        fmt.Sprintf("%d", g.seq),
+			Tool:      tool,
+			Arguments: args,
+			Rule:      rule.Name,
+			CreatedAt: time.Now(),
+		},
+		decision: make(chan Decision, 1),
+	}
+	g.pending[p.req.Id] = p
+	notify := g.notify
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.pending, p.req.Id)
+		g.mu.Unlock()
+	}()
+
+	for _, n := range notify {
+		n.fn(p.req)
+	}
+
+	select {
+	case <-ctx.Done():
+		return Decision{}, ctx.Err()
+	case d := <-p.decision:
+		return d, nil
+	}
+}
+
+// Notify 有新的审批请求时按照添加的顺序调用 fn, fn 里面可以直接调用 Decide, 返回的函数用来取消通知
+func (g *Gate) Notify(fn func(Request)) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.next++
+	id := g.next
+	g.notify = append(g.notify[:len(g.notify):len(g.notify)], notifier{id: id, fn: fn})
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for i, n := range g.notify {
+			if n.id == id {
+				g.notify = append(g.notify[:i:i], g.notify[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (g *Gate) Pending() []Request {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	result := make([]Request, 0, len(g.pending))
+	for _, p := range g.pending {
+		result = append(result, p.req)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (g *Gate) Decide(id string, d Decision) error {
+	switch d.Action {
+	case APPROVE, DENY:
+	case EDIT:
+		if !json.Valid([]byte(d.Arguments)) {
+			return errors.New("edit 的 arguments 不是合法的 JSON")
+		}
+	default:
+		return fmt.Errorf("不支持的审批操作: %s", d.Action)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.pending[id]
+	if !ok {
+		return errors.New("审批请求不存在")
+	}
+	delete(g.pending, id)
+	p.decision <- d
+	return nil
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRuleMatch(t *testing.T) {
+	gate, err := NewGate([]Rule{
+		{Name: "rm", Tool: "bash", Command: `\brm\b`},
+		{Name: "outside", OutsideWorkspace: true},
+	}, "/tmp/ws")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Name   string
+		Tool   string
+		Args   string
+		Expect string
+	}{
+		{Name: "普通命令", Tool: "bash", Args: `{"command": "ls -la"}`},
+		{Name: "rm", Tool: "bash", Args: `{"command": "rm -rf build"}`, Expect: "rm"},
+		{Name: "工作目录内的绝对路径", Tool: "bash", Args: `{"command": "cat /tmp/ws/a.txt"}`},
+		{Name: "工作目录外的绝对路径", Tool: "bash", Args: `{"command": "cat /etc/passwd"}`, Expect: "outside"},
+		{Name: "相对路径逃逸", Tool: "bash", Args: `{"command": "cat ../../etc/passwd"}`, Expect: "outside"},
+		{Name: "home 目录", Tool: "golang_execute", Args: `{"code": "os.ReadFile(\"~/.ssh/id_rsa\")"}`, Expect: "outside"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rule, ok := gate.Match(tc.Tool, tc.Args)
+			assert.Equal(t, tc.Expect != "", ok)
+			assert.Equal(t, tc.Expect, rule.Name)
+		})
+	}
+}
+
+func TestGateDecide(t *testing.T) {
+	gate, err := NewGate([]Rule{{Name: "bash", Tool: "bash"}}, "")
+	require.NoError(t, err)
+
+	d, err := gate.Approve(context.Background(), "golang_execute", `{"code": ""}`)
+	require.NoError(t, err)
+	assert.Equal(t, APPROVE, d.Action)
+
+	done := make(chan Decision, 1)
+	go func() {
+		d, err := gate.Approve(context.Background(), "bash", `{"command": "ls"}`)
+		assert.NoError(t, err)
+		done <- d
+	}()
+
+	require.Eventually(t, func() bool { return len(gate.Pending()) == 1 }, time.Second, 10*time.Millisecond)
+	req := gate.Pending()[0]
+	assert.Equal(t, "bash", req.Rule)
+
+	assert.Error(t, gate.Decide(req.Id, Decision{Action: EDIT, Arguments: "ls"}))
+	require.NoError(t, gate.Decide(req.Id, Decision{Action: EDIT, Arguments: `{"command": "ls -la"}`}))
+	d = <-done
+	assert.Equal(t, `{"command": "ls -la"}`, d.Arguments)
+	assert.Empty(t, gate.Pending())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = gate.Approve(ctx, "bash", `{"command": "ls"}`)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestGateNotify(t *testing.T) {
+	gate, err := NewGate([]Rule{{Name: "bash", Tool: "bash"}}, "")
+	require.NoError(t, err)
+
+	var first, second []string
+	cancel := gate.Notify(func(req Request) {
+		first = append(first, req.Id)
+	})
+	gate.Notify(func(req Request) {
+		second = append(second, req.Id)
+		assert.NoError(t, gate.Decide(req.Id, Decision{Action: APPROVE}))
+	})
+
+	_, err = gate.Approve(context.Background(), "bash", `{"command": "ls"}`)
+	require.NoError(t, err)
+	cancel()
+	_, err = gate.Approve(context.Background(), "bash", `{"command": "ls"}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1"}, first)
+	assert.Equal(t, []string{"1", "2"}, second)
+}
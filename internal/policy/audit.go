@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry 审计日志的一条记录
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Tool    string    `json:"tool"`
+	Command string    `json:"command"`
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Audit 以 JSONL 的格式追加写入审计日志
+type Audit struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewAudit(path string) (*Audit, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Audit{file: file}, nil
+}
+
+func (a *Audit) Record(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+func (a *Audit) Close() error {
+	return a.file.Close()
+}
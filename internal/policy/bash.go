@@ -0,0 +1,262 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 默认认为会访问网络的命令
+var defaultNetworkTools = []string{
+	"curl", "wget", "nc", "ncat", "netcat", "socat", "telnet", "ftp",
+	"ssh", "scp", "sftp", "rsync", "nmap", "ping",
+}
+
+// 这些命令后面跟着的才是真正执行的命令
+var wrappers = map[string]bool{
+	"env": true, "nohup": true, "time": true, "xargs": true,
+	"exec": true, "command": true, "nice": true, "timeout": true,
+}
+
+// 不管怎么配置都会禁止的命令
+var defaultDeny = []string{"sudo", "su", "doas", "shutdown", "reboot", "halt", "poweroff", "mkfs"}
+
+// shells -c 的参数是另外一段脚本, 从管道读到的内容也会被执行
+var shells = map[string]bool{"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "ash": true}
+
+// 只能出现在命令开头的关键字, 后面跟着的才是命令
+var keywords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"while": true, "until": true, "do": true, "done": true, "esac": true,
+}
+
+var forkBomb = regexp.MustCompile(`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`)
+
+// maxDepth sh -c、eval 和命令替换最多嵌套的层数
+const maxDepth = 8
+
+// BashPolicy bash 命令的白名单、黑名单和禁止的模式
+type BashPolicy struct {
+	// Allow 允许执行的命令, 为空时不限制
+	Allow []string `yaml:"allow"`
+	// Deny 禁止执行的命令
+	Deny []string `yaml:"deny"`
+	// Patterns 禁止出现在命令里的正则
+	Patterns []string `yaml:"patterns"`
+	// AllowNetwork 为 false 时禁止 NetworkTools 里的命令
+	AllowNetwork bool     `yaml:"allow_network"`
+	NetworkTools []string `yaml:"network_tools"`
+
+	patterns []*regexp.Regexp
+}
+
+// Violation 违反策略的命令, 作为工具的错误返回给模型
+type Violation struct {
+	Command string
+	Reason  string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("command blocked by policy: %s", v.Reason)
+}
+
+func (b *BashPolicy) compile() error {
+	b.patterns = make([]*regexp.Regexp, len(b.Patterns))
+	for i, pattern := range b.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("bash 策略的 pattern %q 非法: %w", pattern, err)
+		}
+		b.patterns[i] = re
+	}
+	return nil
+}
+
+// DefaultBashPolicy 没有配置 bash 策略时使用, 只禁止内置的危险命令
+func DefaultBashPolicy() *BashPolicy {
+	return &BashPolicy{AllowNetwork: true}
+}
+
+// Check 命令违反策略时返回 *Violation, sh -c、eval 和命令替换里的命令同样会检查,
+// sudo、rm -rf /、curl | sh 这些危险命令不管怎么配置都会禁止
+func (b *BashPolicy) Check(command string) error {
+	if reason := b.check(command, 0); reason != "" {
+		return &Violation{Command: command, Reason: reason}
+	}
+	return nil
+}
+
+// check 返回 script 违反策略的原因, depth 是嵌套的层数
+func (b *BashPolicy) check(script string, depth int) string {
+	if depth > maxDepth {
+		return "command is nested too deeply"
+	}
+	for i, re := range b.patterns {
+		if re.MatchString(script) {
+			return fmt.Sprintf("matches blocked pattern %q", b.Patterns[i])
+		}
+	}
+	if forkBomb.MatchString(script) {
+		return "fork bomb"
+	}
+
+	commands, subs, err := parseShell(script)
+	if err != nil {
+		return fmt.Sprintf("cannot parse command: %s", err)
+	}
+
+	// network 当前管道前面的命令访问了网络
+	network := false
+	for _, cmd := range commands {
+		if !cmd.piped {
+			network = false
+		}
+
+		binaries, args, reason := resolve(cmd.words)
+		if reason != "" {
+			return reason
+		}
+		for _, binary := range binaries {
+			if reason = b.binary(binary); reason != "" {
+				return reason
+			}
+			if network && shells[binary] {
+				return fmt.Sprintf("downloaded script is piped into %q", binary)
+			}
+		}
+		for _, binary := range binaries {
+			network = network || contains(b.networkTools(), binary)
+		}
+		if len(binaries) == 0 {
+			continue
+		}
+
+		switch binary := binaries[len(binaries)-1]; {
+		case binary == "rm" && removesRoot(args):
+			return "recursive rm of the root or home directory"
+		case binary == "eval":
+			words := make([]string, len(args))
+			for i, arg := range args {
+				if arg.dynamic {
+					return "eval of a command computed at runtime"
+				}
+				words[i] = arg.text
+			}
+			if reason = b.check(strings.Join(words, " "), depth+1); reason != "" {
+				return reason
+			}
+		case shells[binary]:
+			inner, ok := shellScript(args)
+			if !ok {
+				continue
+			}
+			if inner.dynamic {
+				return fmt.Sprintf("%s -c with a script computed at runtime", binary)
+			}
+			if reason = b.check(inner.text, depth+1); reason != "" {
+				return reason
+			}
+		}
+	}
+
+	for _, sub := range subs {
+		if reason := b.check(sub, depth+1); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// binary 按照内置的规则、黑名单、网络命令和白名单检查一个程序
+func (b *BashPolicy) binary(binary string) string {
+	if contains(b.Deny, binary) || contains(defaultDeny, binary) || strings.HasPrefix(binary, "mkfs.") {
+		return fmt.Sprintf("%q is denied", binary)
+	}
+	if !b.AllowNetwork && contains(b.networkTools(), binary) {
+		return fmt.Sprintf("network tool %q is not allowed", binary)
+	}
+	if len(b.Allow) != 0 && !contains(b.Allow, binary) {
+		return fmt.Sprintf("%q is not in the allowlist", binary)
+	}
+	return ""
+}
+
+func (b *BashPolicy) networkTools() []string {
+	if b.NetworkTools == nil {
+		return defaultNetworkTools
+	}
+	return b.NetworkTools
+}
+
+// resolve 返回一条命令实际执行的程序和最后一个程序的参数, wrapper 本身也算执行的程序
+func resolve(words []word) ([]string, []word, string) {
+	if len(words) != 0 && (words[0].text == "for" || words[0].text == "case" || words[0].text == "select") {
+		// 循环变量和 case 的值不是命令, 循环体是单独的命令
+		return nil, nil, ""
+	}
+
+	var result []string
+	for i, w := range words {
+		if len(result) == 0 && keywords[w.text] {
+			continue
+		}
+		// 跳过 FOO=bar 这样的环境变量和 wrapper 的参数
+		if strings.Contains(w.text, "=") || strings.HasPrefix(w.text, "-") || (w.text != "" && unicode.IsDigit(rune(w.text[0]))) {
+			continue
+		}
+		if w.dynamic {
+			return nil, nil, fmt.Sprintf("command name %q is computed at runtime", w.text)
+		}
+
+		binary := filepath.Base(w.text)
+		result = append(result, binary)
+		if !wrappers[binary] {
+			return result, words[i+1:], ""
+		}
+	}
+	return result, nil, ""
+}
+
+// shellScript 返回 sh -c 后面的脚本, 比如 bash -lc 'ls'
+func shellScript(args []word) (word, bool) {
+	command := false
+	for _, arg := range args {
+		if strings.HasPrefix(arg.text, "-") && !strings.HasPrefix(arg.text, "--") {
+			command = command || strings.Contains(arg.text, "c")
+			continue
+		}
+		if command && !strings.HasPrefix(arg.text, "--") {
+			return arg, true
+		}
+	}
+	return word{}, false
+}
+
+// removesRoot rm 带着 -r 删除根目录或者 home 目录
+func removesRoot(args []word) bool {
+	recursive, root := false, false
+	for _, arg := range args {
+		switch {
+		case arg.text == "--recursive":
+			recursive = true
+		case strings.HasPrefix(arg.text, "-") && !strings.HasPrefix(arg.text, "--"):
+			recursive = recursive || strings.ContainsAny(arg.text, "rR")
+		case arg.text == "/*" || arg.text == "~" || arg.text == "~/" || arg.text == "~/*" ||
+			arg.text == "$HOME" || arg.text == "${HOME}" || path.Clean(arg.text) == "/":
+			root = true
+		}
+	}
+	return recursive && root
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package policy
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// Config 策略配置文件
+type Config struct {
+	Approval []Rule `yaml:"approval"`
+	// Bash 为空时只禁止内置的危险命令, 比如 sudo、rm -rf /、curl | sh
+	Bash *BashPolicy `yaml:"bash"`
+	// AuditLog bash 命令检查结果的审计日志路径
+	AuditLog string `yaml:"audit_log"`
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Approval {
+		if err = cfg.Approval[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Bash != nil {
+		if err = cfg.Bash.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
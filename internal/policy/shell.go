@@ -0,0 +1,446 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+)
+
+// word 去掉引号和转义之后的一个单词
+type word struct {
+	text string
+	// dynamic 包含 $VAR、$(...) 或者 `...`, 实际的内容要到执行的时候才知道
+	dynamic bool
+}
+
+// simpleCommand 一条简单命令, 重定向的目标已经去掉
+type simpleCommand struct {
+	words []word
+	// piped 前一条命令的输出通过 | 传给这条命令
+	piped bool
+}
+
+// heredoc << 的分隔符, strip 对应 <<-, expand 为 true 时内容里的命令替换会执行
+type heredoc struct {
+	delimiter string
+	strip     bool
+	expand    bool
+}
+
+// shellParser 按照 bash 的引号、转义和命令分隔符把脚本拆成简单命令, 不展开变量,
+// $(...)、`...` 和 <(...) 的内容单独返回, 由调用方继续检查
+type shellParser struct {
+	s   string
+	cur simpleCommand
+	buf strings.Builder
+	// inWord 当前单词已经开始, 空的引号 '' 也是一个单词
+	inWord  bool
+	dynamic bool
+	// quoted 当前单词里有引号或者转义
+	quoted bool
+	// target 下一个单词是重定向的目标
+	target bool
+	// heredoc 正在等待 << 后面的分隔符
+	heredoc *heredoc
+	// heredocs 在下一个换行之后开始的 here document
+	heredocs []heredoc
+
+	commands []simpleCommand
+	subs     []string
+}
+
+func parseShell(s string) ([]simpleCommand, []string, error) {
+	p := &shellParser{s: s}
+	if err := p.parse(); err != nil {
+		return nil, nil, err
+	}
+	return p.commands, p.subs, nil
+}
+
+func (p *shellParser) parse() error {
+	s := p.s
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 < len(s) {
+				if s[i+1] != '\n' {
+					p.write(s[i+1])
+					p.quoted = true
+				}
+				i++
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return errors.New("unterminated single quote")
+			}
+			p.buf.WriteString(s[i+1 : i+1+end])
+			p.inWord, p.quoted = true, true
+			i += end + 1
+		case c == '"':
+			end, err := p.double(i + 1)
+			if err != nil {
+				return err
+			}
+			p.inWord, p.quoted = true, true
+			i = end
+		case strings.HasPrefix(s[i:], "$(("):
+			end, err := p.arithmetic(i + 3)
+			if err != nil {
+				return err
+			}
+			i = end
+		case c == '$' && i+1 < len(s) && s[i+1] == '(':
+			end, err := p.substitution(i + 2)
+			if err != nil {
+				return err
+			}
+			i = end
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			end, err := p.param(i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case c == '`':
+			end, err := p.backtick(i + 1)
+			if err != nil {
+				return err
+			}
+			i = end
+		case c == '$':
+			p.dynamic = true
+			p.write(c)
+		case (c == '<' || c == '>') && i+1 < len(s) && s[i+1] == '(':
+			// 进程替换
+			end, err := p.substitution(i + 2)
+			if err != nil {
+				return err
+			}
+			i = end
+		case c == '<' || c == '>':
+			i = p.redirect(i)
+		case c == '&' && i+1 < len(s) && s[i+1] == '>':
+			p.endWord()
+			i = p.redirect(i + 1)
+		case c == '#' && !p.inWord:
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				end = len(s) - i
+			}
+			i += end - 1
+		case c == '|':
+			if i+1 < len(s) && s[i+1] == '|' {
+				i++
+				p.endCommand(false)
+			} else {
+				// |& 同时传递 stderr
+				if i+1 < len(s) && s[i+1] == '&' {
+					i++
+				}
+				p.endCommand(true)
+			}
+		case c == '&':
+			if i+1 < len(s) && s[i+1] == '&' {
+				i++
+			}
+			p.endCommand(false)
+		case c == '\n':
+			p.endCommand(false)
+			if len(p.heredocs) != 0 {
+				i = p.heredocBody(i+1) - 1
+			}
+		case c == ';' || c == '(' || c == ')':
+			p.endCommand(false)
+		case c == ' ' || c == '\t' || c == '\r':
+			p.endWord()
+		default:
+			p.write(c)
+		}
+	}
+	p.endCommand(false)
+	return nil
+}
+
+func (p *shellParser) write(c byte) {
+	p.buf.WriteByte(c)
+	p.inWord = true
+}
+
+// double 处理双引号里的内容, 返回右引号的位置
+func (p *shellParser) double(i int) (int, error) {
+	s := p.s
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return i, nil
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0:
+			if s[i+1] != '\n' {
+				p.buf.WriteByte(s[i+1])
+			}
+			i++
+		case strings.HasPrefix(s[i:], "$(("):
+			end, err := p.arithmetic(i + 3)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case c == '$' && i+1 < len(s) && s[i+1] == '(':
+			end, err := p.substitution(i + 2)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			end, err := p.param(i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case c == '`':
+			end, err := p.backtick(i + 1)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case c == '$':
+			p.dynamic = true
+			p.buf.WriteByte(c)
+		default:
+			p.buf.WriteByte(c)
+		}
+	}
+	return 0, errors.New("unterminated double quote")
+}
+
+// substitution 记录 start 开始到匹配的右括号之间的命令, 返回右括号的位置
+func (p *shellParser) substitution(start int) (int, error) {
+	s := p.s
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return 0, errors.New("unterminated single quote")
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				p.subs = append(p.subs, s[start:i])
+				p.inWord, p.dynamic = true, true
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("unterminated command substitution")
+}
+
+// arithmetic 跳过 $((...)), 里面的命令替换仍然需要检查, 返回最后一个右括号的位置
+func (p *shellParser) arithmetic(start int) (int, error) {
+	s := p.s
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '(':
+			end, err := p.substitution(i + 2)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case s[i] == '`':
+			end, err := p.backtick(i + 1)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case s[i] == '(':
+			depth++
+		case s[i] == ')' && depth != 0:
+			depth--
+		case s[i] == ')':
+			if i+1 < len(s) && s[i+1] == ')' {
+				p.inWord, p.dynamic = true, true
+				return i + 1, nil
+			}
+			return 0, errors.New("unterminated arithmetic expansion")
+		}
+	}
+	return 0, errors.New("unterminated arithmetic expansion")
+}
+
+// param 把 ${...} 原样写入当前单词, 里面的空格不会拆分单词, 返回右括号的位置
+func (p *shellParser) param(start int) (int, error) {
+	s := p.s
+	depth := 0
+	for i := start + 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '(':
+			end, err := p.substitution(i + 2)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case s[i] == '`':
+			end, err := p.backtick(i + 1)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				p.buf.WriteString(s[start : i+1])
+				p.inWord, p.dynamic = true, true
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("unterminated parameter expansion")
+}
+
+func (p *shellParser) backtick(start int) (int, error) {
+	s := p.s
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '`':
+			p.subs = append(p.subs, s[start:i])
+			p.inWord, p.dynamic = true, true
+			return i, nil
+		}
+	}
+	return 0, errors.New("unterminated backtick")
+}
+
+// redirect 跳过 >、>>、2>&1、<<< 这样的重定向, 之后的单词是重定向的目标, 不是命令
+func (p *shellParser) redirect(i int) int {
+	if p.inWord && !p.dynamic && isDigits(p.buf.String()) {
+		p.buf.Reset()
+		p.inWord = false
+	} else {
+		p.endWord()
+	}
+	start := i
+	for i+1 < len(p.s) && strings.IndexByte("<>&|", p.s[i+1]) >= 0 {
+		i++
+	}
+	if p.s[start:i+1] == "<<" {
+		p.heredoc = &heredoc{}
+		if i+1 < len(p.s) && p.s[i+1] == '-' {
+			p.heredoc.strip = true
+			i++
+		}
+	}
+	p.target = true
+	return i
+}
+
+// heredocBody 跳过 start 开始的 here document, 返回之后第一个字符的位置,
+// 分隔符没有引号时内容里的命令替换仍然会执行
+func (p *shellParser) heredocBody(start int) int {
+	s := p.s
+	i := start
+	for _, doc := range p.heredocs {
+		for i < len(s) {
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				end = len(s)
+			} else {
+				end += i
+			}
+			line := s[i:end]
+			if doc.strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == doc.delimiter {
+				i = end + 1
+				break
+			}
+
+			j := i
+			for ; doc.expand && j < end; j++ {
+				switch {
+				case s[j] == '\\':
+					j++
+				case s[j] == '$' && j+1 < len(s) && s[j+1] == '(':
+					if k, err := p.substitution(j + 2); err == nil {
+						j = k
+					}
+				case s[j] == '`':
+					if k, err := p.backtick(j + 1); err == nil {
+						j = k
+					}
+				}
+			}
+			// 命令替换可能跨越多行
+			if j > end {
+				if next := strings.IndexByte(s[j:], '\n'); next < 0 {
+					end = len(s)
+				} else {
+					end = j + next
+				}
+			}
+			i = end + 1
+		}
+	}
+	p.heredocs = nil
+	p.inWord, p.dynamic = false, false
+	return min(i, len(s))
+}
+
+func (p *shellParser) endWord() {
+	if !p.inWord {
+		return
+	}
+	if p.target {
+		p.target = false
+		if p.heredoc != nil {
+			p.heredoc.delimiter, p.heredoc.expand = p.buf.String(), !p.quoted
+			p.heredocs = append(p.heredocs, *p.heredoc)
+			p.heredoc = nil
+		}
+	} else {
+		p.cur.words = append(p.cur.words, word{text: p.buf.String(), dynamic: p.dynamic})
+	}
+	p.buf.Reset()
+	p.inWord, p.dynamic, p.quoted = false, false, false
+}
+
+func (p *shellParser) endCommand(piped bool) {
+	p.endWord()
+	p.target, p.heredoc = false, nil
+	if len(p.cur.words) != 0 {
+		p.commands = append(p.commands, p.cur)
+	}
+	p.cur = simpleCommand{piped: piped}
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"mime"
+	"strings"
+)
+
+type Format string
+
+const (
+	TEXT     Format = "text"
+	JSON     Format = "json"
+	MARKDOWN Format = "markdown"
+	MERMAID  Format = "mermaid"
+)
+
+// 不直接使用 application/json, 避免普通的 JSON 客户端被切换到结构化输出
+var mediaTypes = map[string]Format{
+	"text/plain":                      TEXT,
+	"application/vnd.agent.plan+json": JSON,
+	"text/markdown":                   MARKDOWN,
+	"text/vnd.mermaid":                MERMAID,
+}
+
+var contentTypes = map[Format]string{
+	TEXT:     "text/plain; charset=utf-8",
+	JSON:     "application/json; charset=utf-8",
+	MARKDOWN: "text/markdown; charset=utf-8",
+	MERMAID:  "text/vnd.mermaid; charset=utf-8",
+}
+
+// ParseFormat 优先使用 query 参数, 其次按照 Accept 头的顺序匹配, 都没有时返回 def
+func ParseFormat(query string, accept string, def Format) (Format, error) {
+	if query != "" {
+		format := Format(query)
+		if _, ok := contentTypes[format]; !ok {
+			return "", fmt.Errorf("不支持的 format: %s", query)
+		}
+		return format, nil
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if format, ok := mediaTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+	return def, nil
+}
+
+func ContentType(format Format) string {
+	return contentTypes[format]
+}
+
+func Render(plan domain.Plan, format Format) (string, error) {
+	switch format {
+	case TEXT:
+		return Text(plan), nil
+	case JSON:
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case MARKDOWN:
+		return Markdown(plan), nil
+	case MERMAID:
+		return Mermaid(plan), nil
+	default:
+		return "", fmt.Errorf("不支持的 format: %s", format)
+	}
+}
+
+// Markdown 渲染为 checklist, 未完成的 step 标注当前状态
+func Markdown(plan domain.Plan) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", plan.Title)
+	for _, step := range plan.Steps {
+		switch step.State {
+		case domain.COMPLETED:
+			fmt.Fprintf(&b, "- [x] %s\n", step.Content)
+		case domain.IN_PROGRESS:
+			fmt.Fprintf(&b, "- [ ] %s _(in progress)_\n", step.Content)
+		case domain.BLOCKED:
+			fmt.Fprintf(&b, "- [ ] %s _(blocked)_\n", step.Content)
+		case domain.SKIPPED:
+			fmt.Fprintf(&b, "- [ ] ~~%s~~ _(skipped)_\n", step.Content)
+		case domain.ABORTED:
+			fmt.Fprintf(&b, "- [ ] %s _(aborted)_\n", step.Content)
+		default:
+			fmt.Fprintf(&b, "- [ ] %s\n", step.Content)
+		}
+	}
+	return b.String()
+}
+
+// Mermaid 渲染为顺序执行的 flowchart, 节点颜色表示 step 状态
+func Mermaid(plan domain.Plan) string {
+	var b strings.Builder
+
+	b.WriteString("flowchart TD\n")
+	fmt.Fprintf(&b, "    plan[\"%s\"]\n", mermaidLabel(plan.Title))
+
+	prev := "plan"
+	for i, step := range plan.Steps {
+		node := fmt.Sprintf("step%d", i)
+		fmt.Fprintf(&b, "    %s[\"%d. %s\"]:::%s\n", node, i, mermaidLabel(step.Content), mermaidClass(step.State))
+		fmt.Fprintf(&b, "    %s --> %s\n", prev, node)
+		prev = node
+	}
+
+	b.WriteString("    classDef no_started fill:#f5f5f5,stroke:#999\n")
+	b.WriteString("    classDef in_progress fill:#fff3cd,stroke:#d39e00\n")
+	b.WriteString("    classDef completed fill:#d4edda,stroke:#28a745\n")
+	b.WriteString("    classDef blocked fill:#f8d7da,stroke:#dc3545\n")
+	b.WriteString("    classDef skipped fill:#e2e3e5,stroke:#6c757d,stroke-dasharray:4\n")
+	b.WriteString("    classDef aborted fill:#ffe5d0,stroke:#fd7e14\n")
+	return b.String()
+}
+
+func mermaidLabel(s string) string {
+	s = strings.ReplaceAll(s, "\"", "#quot;")
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+func mermaidClass(state string) string {
+	switch state {
+	case domain.IN_PROGRESS, domain.COMPLETED, domain.BLOCKED, domain.SKIPPED, domain.ABORTED:
+		return state
+	default:
+		return domain.NO_STARTED
+	}
+}
@@ -0,0 +1,73 @@
+package render
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"testing"
+)
+
+func newPlan() domain.Plan {
+	return domain.Plan{
+		Id:    "1",
+		Title: "deploy",
+		Steps: []domain.Step{
+			{State: domain.COMPLETED, Content: "build"},
+			{State: domain.IN_PROGRESS, Content: `run "tests"`},
+			{State: domain.NO_STARTED, Content: "release"},
+		},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Query  string
+		Accept string
+		Expect Format
+		Err    bool
+	}{
+		{Name: "默认", Accept: "application/json, text/plain, */*", Expect: TEXT},
+		{Name: "query 优先", Query: "mermaid", Accept: "text/markdown", Expect: MERMAID},
+		{Name: "Accept", Accept: "text/markdown; charset=utf-8", Expect: MARKDOWN},
+		{Name: "结构化 JSON", Accept: "application/vnd.agent.plan+json", Expect: JSON},
+		{Name: "非法 format", Query: "yaml", Err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			format, err := ParseFormat(tc.Query, tc.Accept, TEXT)
+			if tc.Err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Expect, format)
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	plan := newPlan()
+
+	md, err := Render(plan, MARKDOWN)
+	require.NoError(t, err)
+	assert.Equal(t, "# deploy\n\n- [x] build\n- [ ] run \"tests\" _(in progress)_\n- [ ] release\n", md)
+
+	mermaid, err := Render(plan, MERMAID)
+	require.NoError(t, err)
+	assert.Contains(t, mermaid, "flowchart TD\n")
+	assert.Contains(t, mermaid, `step1["1. run #quot;tests#quot;"]:::in_progress`)
+	assert.Contains(t, mermaid, "step0 --> step1")
+
+	data, err := Render(plan, JSON)
+	require.NoError(t, err)
+	var decoded domain.Plan
+	require.NoError(t, json.Unmarshal([]byte(data), &decoded))
+	assert.Equal(t, plan.Steps, decoded.Steps)
+
+	text, err := Render(plan, TEXT)
+	require.NoError(t, err)
+	assert.Contains(t, text, "Progress: 1 / 3 steps completed (33.3%)")
+}
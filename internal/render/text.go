@@ -0,0 +1,78 @@
+package render
+
+import (
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"strings"
+)
+
+// Text 人类可读的纯文本, 也是拼接到 prompt 里的格式
+func Text(plan domain.Plan) string {
+	output := fmt.Sprintf("Plan: %s (ID: %s)\n", plan.Title, plan.Id)
+	output += strings.Repeat("=", len(output)) + "\n\n"
+	total := len(plan.Steps)
+
+	noStarted := 0
+	progress := 0
+	completed := 0
+	blocked := 0
+	skipped := 0
+	aborted := 0
+
+	for _, step := range plan.Steps {
+		if step.State == domain.NO_STARTED {
+			noStarted += 1
+		}
+
+		if step.State == domain.IN_PROGRESS {
+			progress += 1
+		}
+
+		if step.State == domain.COMPLETED {
+			completed += 1
+		}
+
+		if step.State == domain.BLOCKED {
+			blocked += 1
+		}
+
+		if step.State == domain.SKIPPED {
+			skipped += 1
+		}
+
+		if step.State == domain.ABORTED {
+			aborted += 1
+		}
+	}
+
+	output += fmt.Sprintf("Progress: %d / %d steps completed ", completed, total)
+	if total > 0 {
+		percentage := float64(completed) / float64(total) * 100
+		output += fmt.Sprintf("(%.1f%%)\n", percentage)
+	} else {
+		output += "(0%)\n"
+	}
+
+	output += fmt.Sprintf("status: %d completed, %d progress, %d no strated, %d blocked, %d skipped, %d aborted\n", completed, progress, noStarted, blocked, skipped, aborted)
+	output += "Steps:\n"
+
+	statusSymbol := "[ ]"
+	for i, step := range plan.Steps {
+		switch step.State {
+		case domain.NO_STARTED:
+			statusSymbol = "[-]"
+		case domain.IN_PROGRESS:
+			statusSymbol = "[→]"
+		case domain.COMPLETED:
+			statusSymbol = "[✓]"
+		case domain.BLOCKED:
+			statusSymbol = "[!]"
+		case domain.SKIPPED:
+			statusSymbol = "[»]"
+		case domain.ABORTED:
+			statusSymbol = "[×]"
+		}
+		output += fmt.Sprintf("%d. %s %s\n", i, statusSymbol, step.Content)
+	}
+	return output
+}
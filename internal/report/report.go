@@ -0,0 +1,98 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"strings"
+	"time"
+)
+
+// Report 一次运行的最终报告, 可以导出为 Markdown 或 JSON
+type Report struct {
+	Id          string       `json:"id"`
+	Title       string       `json:"title"`
+	Summary     string       `json:"summary"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	Completed   int          `json:"completed"`
+	Total       int          `json:"total"`
+	Usage       domain.Usage `json:"usage"`
+	// Exhausted 耗尽的预算, 没有耗尽时为空
+	Exhausted string        `json:"exhausted,omitempty"`
+	Steps     []domain.Step `json:"steps"`
+}
+
+func New(plan domain.Plan) Report {
+	r := Report{
+		Id:          plan.Id,
+		Title:       plan.Title,
+		Summary:     plan.Summary,
+		GeneratedAt: time.Now(),
+		Total:       len(plan.Steps),
+		Usage:       plan.Usage,
+		Exhausted:   plan.Exhausted,
+		Steps:       plan.Steps,
+	}
+
+	for _, step := range plan.Steps {
+		if step.State == domain.COMPLETED {
+			r.Completed += 1
+		}
+	}
+	return r
+}
+
+func (r Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r Report) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", r.Title)
+	fmt.Fprintf(&b, "- Plan ID: `%s`\n", r.Id)
+	fmt.Fprintf(&b, "- Generated: %s\n", r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Progress: %d / %d steps completed\n", r.Completed, r.Total)
+	fmt.Fprintf(&b, "- Usage: %s\n", formatUsage(r.Usage))
+	if r.Exhausted != "" {
+		fmt.Fprintf(&b, "- Budget exhausted: %s\n", r.Exhausted)
+	}
+	b.WriteString("\n")
+
+	b.WriteString("## Summary\n\n")
+	if r.Summary != "" {
+		b.WriteString(r.Summary + "\n\n")
+	} else {
+		b.WriteString("_No summary available._\n\n")
+	}
+
+	b.WriteString("## Steps\n\n")
+	for i, step := range r.Steps {
+		fmt.Fprintf(&b, "### %d. %s\n\n", i, step.Content)
+		fmt.Fprintf(&b, "- Status: %s\n", step.State)
+		if step.StartedAt != nil && step.FinishedAt != nil {
+			fmt.Fprintf(&b, "- Duration: %s\n", step.FinishedAt.Sub(*step.StartedAt).Round(time.Millisecond))
+		}
+		if len(step.ToolCalls) != 0 {
+			fmt.Fprintf(&b, "- Tool calls: %d\n", len(step.ToolCalls))
+		}
+		if step.Usage.TotalTokens != 0 {
+			fmt.Fprintf(&b, "- Usage: %s\n", formatUsage(step.Usage))
+		}
+		if len(step.Artifacts) != 0 {
+			b.WriteString("- Artifacts:\n")
+			for _, artifact := range step.Artifacts {
+				fmt.Fprintf(&b, "  - `%s`\n", artifact)
+			}
+		}
+		if step.Summary != "" {
+			fmt.Fprintf(&b, "\n%s\n", step.Summary)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatUsage(u domain.Usage) string {
+	return fmt.Sprintf("%d tokens (%d prompt, %d completion), $%.4f", u.TotalTokens, u.PromptTokens, u.CompletionTokens, u.Cost)
+}
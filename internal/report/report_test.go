@@ -0,0 +1,43 @@
+package report
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	plan := domain.Plan{
+		Id:      "1",
+		Title:   "list files",
+		Summary: "listed the workspace",
+		Usage:   domain.Usage{PromptTokens: 150, CompletionTokens: 50, TotalTokens: 200, Cost: 0.0005},
+		Steps: []domain.Step{
+			{State: domain.COMPLETED, Content: "run ls", Summary: "found a.txt", Artifacts: []string{"a.txt"},
+				Usage: domain.Usage{PromptTokens: 90, CompletionTokens: 10, TotalTokens: 100, Cost: 0.0002}},
+			{State: domain.BLOCKED, Content: "write report"},
+		},
+	}
+
+	r := New(plan)
+	assert.Equal(t, 1, r.Completed)
+	assert.Equal(t, 2, r.Total)
+
+	md := r.Markdown()
+	assert.Contains(t, md, "# list files")
+	assert.Contains(t, md, "listed the workspace")
+	assert.Contains(t, md, "### 0. run ls")
+	assert.Contains(t, md, "`a.txt`")
+	assert.Contains(t, md, "- Status: blocked")
+	assert.Contains(t, md, "- Usage: 200 tokens (150 prompt, 50 completion), $0.0005")
+	assert.Contains(t, md, "- Usage: 100 tokens (90 prompt, 10 completion), $0.0002")
+
+	data, err := r.JSON()
+	require.NoError(t, err)
+	var decoded Report
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "listed the workspace", decoded.Summary)
+	assert.Len(t, decoded.Steps, 2)
+}
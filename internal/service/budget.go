@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"sync"
+	"time"
+)
+
+// BudgetError 一次运行的某项预算耗尽
+type BudgetError struct {
+	// Budget 耗尽的预算: tokens、cost、duration、tool_calls 或者 llm_calls
+	Budget string
+	Used   string
+	Limit  string
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("预算耗尽: %s 已使用 %s, 上限 %s", e.Budget, e.Used, e.Limit)
+}
+
+// tracker 统计一次运行的消耗, 为空时不限制
+type tracker struct {
+	budget domain.Budget
+	start  time.Time
+
+	mu        sync.Mutex
+	usage     domain.Usage
+	llmCalls  int
+	toolCalls int
+}
+
+func newTracker(budget domain.Budget) *tracker {
+	return &tracker{budget: budget, start: time.Now()}
+}
+
+// check 在调用模型之前检查, 已经达到上限时返回 *BudgetError
+func (t *tracker) check() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.budget
+	if elapsed := time.Since(t.start); b.MaxDuration > 0 && elapsed >= b.MaxDuration {
+		return &BudgetError{Budget: "duration", Used: elapsed.Round(time.Millisecond).String(), Limit: b.MaxDuration.String()}
+	}
+	if b.MaxLLMCalls > 0 && t.llmCalls >= b.MaxLLMCalls {
+		return &BudgetError{Budget: "llm_calls", Used: fmt.Sprint(t.llmCalls), Limit: fmt.Sprint(b.MaxLLMCalls)}
+	}
+	if b.MaxTokens > 0 && t.usage.TotalTokens >= b.MaxTokens {
+		return &BudgetError{Budget: "tokens", Used: fmt.Sprint(t.usage.TotalTokens), Limit: fmt.Sprint(b.MaxTokens)}
+	}
+	if b.MaxCost > 0 && t.usage.Cost >= b.MaxCost {
+		return &BudgetError{Budget: "cost", Used: fmt.Sprintf("$%.4f", t.usage.Cost), Limit: fmt.Sprintf("$%.4f", b.MaxCost)}
+	}
+	return nil
+}
+
+// checkTool 在执行工具之前检查, 工具调用的次数没有超过上限时计入一次
+func (t *tracker) checkTool() error {
+	if t == nil {
+		return nil
+	}
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.budget.MaxToolCalls > 0 && t.toolCalls >= t.budget.MaxToolCalls {
+		return &BudgetError{Budget: "tool_calls", Used: fmt.Sprint(t.toolCalls), Limit: fmt.Sprint(t.budget.MaxToolCalls)}
+	}
+	t.toolCalls++
+	return nil
+}
+
+func (t *tracker) addCall(usage domain.Usage) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.llmCalls++
+	t.usage = t.usage.Add(usage)
+}
+
+// wrap 超过 MaxDuration 导致 ctx 取消时, 把返回的错误换成 *BudgetError
+func (t *tracker) wrap(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if budgetErr := t.check(); budgetErr != nil {
+		return budgetErr
+	}
+	return err
+}
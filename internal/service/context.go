@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	summarize = `You are compressing the history of an agent conversation so it fits in the context window.
+Summarize the earlier messages: keep the user's goals, decisions that were made, tool results later steps rely on (file names, values, errors) and open issues. Be concise and factual.`
+	summaryPrefix = "SUMMARY OF EARLIER CONVERSATION:\n"
+	// 超过上限的这个比例时开始压缩, 留出模型回复的空间
+	compactRatio = 0.8
+	// 压缩之后保留的最近的消息不超过上限的一半
+	keepRatio = 0.5
+	// 交给模型总结的时候每条消息最多保留的字符数
+	transcriptClip = 2000
+)
+
+// estimateTokens 粗略估计 token 数: ASCII 大约 4 个字符一个 token, 其他字符按照一个 token 计算
+func estimateTokens(s string) int {
+	ascii, other := 0, 0
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// estimateMsgs 每条消息另外加上角色等固定的开销
+func estimateMsgs(msgs []domain.Msg) int {
+	total := 0
+	for _, msg := range msgs {
+		total += 4 + estimateTokens(msg.Content)
+		for _, call := range msg.ToolCalls {
+			total += 8 + estimateTokens(call.Function.Name) + estimateTokens(call.Function.Arguments)
+		}
+	}
+	return total
+}
+
+func estimateRequest(req domain.LLMRequest) int {
+	total := estimateTokens(req.SystemContent) + estimateMsgs(req.Msgs)
+	for _, t := range req.Tools {
+		total += 16 + estimateTokens(t.Function.Name) + estimateTokens(t.Function.Description)
+	}
+	return total
+}
+
+// turns 按照轮次分组, 工具的结果和发起调用的 assistant 消息在同一组, 裁剪的时候不会被拆开
+func turns(msgs []domain.Msg) [][]domain.Msg {
+	var groups [][]domain.Msg
+	for _, msg := range msgs {
+		if msg.Role == domain.TOOL && len(groups) != 0 {
+			groups[len(groups)-1] = append(groups[len(groups)-1], msg)
+			continue
+		}
+		groups = append(groups, []domain.Msg{msg})
+	}
+	return groups
+}
+
+// fit 请求接近上下文上限时, 把较早的消息交给模型总结, 只保留最近的几轮
+func (p *PlanExecutor) fit(ctx context.Context, req domain.LLMRequest, result *domain.StepResult) error {
+	if p.contextLimit <= 0 || estimateRequest(req) <= int(float64(p.contextLimit)*compactRatio) {
+		return nil
+	}
+
+	groups := turns(p.messages)
+	keep := len(groups) - 1
+	size := estimateMsgs(groups[keep])
+	for keep > 0 {
+		next := estimateMsgs(groups[keep-1])
+		if size+next > int(float64(p.contextLimit)*keepRatio) {
+			break
+		}
+		size += next
+		keep--
+	}
+	if keep == 0 {
+		return nil
+	}
+
+	var older, recent []domain.Msg
+	for _, group := range groups[:keep] {
+		older = append(older, group...)
+	}
+	for _, group := range groups[keep:] {
+		recent = append(recent, group...)
+	}
+
+	ctx, span := tracing.Start(ctx, "context.compact", attribute.Int("context.dropped_messages", len(older)), attribute.Int("context.kept_messages", len(recent)))
+	defer span.End()
+
+	summary, err := p.summarize(ctx, older, result)
+	var budgetErr *BudgetError
+	if errors.As(err, &budgetErr) || ctx.Err() != nil {
+		return err
+	}
+	if err != nil {
+		// 总结失败的时候直接丢掉较早的消息
+		summary = fmt.Sprintf("%d earlier messages were dropped to fit the context window.", len(older))
+	}
+
+	p.messages = append([]domain.Msg{{Role: domain.USER, Content: summaryPrefix + summary}}, recent...)
+	return nil
+}
+
+func (p *PlanExecutor) summarize(ctx context.Context, msgs []domain.Msg, result *domain.StepResult) (string, error) {
+	var transcript strings.Builder
+	for _, msg := range msgs {
+		content := msg.Content
+		if len(content) > transcriptClip {
+			content = strings.ToValidUTF8(content[:transcriptClip], "") + "..."
+		}
+		fmt.Fprintf(&transcript, "[%s] %s\n", msg.Role, content)
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&transcript, "[%s calls %s] %s\n", msg.Role, call.Function.Name, call.Function.Arguments)
+		}
+	}
+
+	req := domain.LLMRequest{
+		SystemContent: summarize,
+		Msgs:          []domain.Msg{{Role: domain.USER, Content: transcript.String()}},
+	}
+
+	if err := p.tracker.check(); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	resp, err := invoke(ctx, p.bus, p.session, p.handler, req)
+	if err != nil {
+		return "", err
+	}
+	p.tracker.addCall(resp.Usage)
+	result.LLMCalls = append(result.LLMCalls, domain.LLMCall{Model: resp.Model, Usage: resp.Usage, StartedAt: start, Duration: time.Since(start)})
+	return resp.Content, nil
+}
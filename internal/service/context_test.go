@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	assert.Equal(t, 0, estimateTokens(""))
+	assert.Equal(t, 2, estimateTokens("hello"))
+	assert.Equal(t, 4, estimateTokens("执行命令"))
+}
+
+// history 构造 n 轮调用 bash 的历史, 每轮包含用户消息、工具调用和工具结果
+func history(n int) []domain.Msg {
+	var msgs []domain.Msg
+	for i := 0; i < n; i++ {
+		call := llmtest.Call("", llmtest.Tool("bash", `{"command": "ls"}`)).ToolCalls
+		msgs = append(msgs,
+			domain.Msg{Role: domain.USER, Content: strings.Repeat("step ", 100)},
+			domain.Msg{Role: domain.ASSISTANT, ToolCalls: call},
+			domain.Msg{Role: domain.TOOL, Id: call[0].ID, Content: strings.Repeat("output ", 100)},
+		)
+	}
+	return msgs
+}
+
+func TestTurns(t *testing.T) {
+	groups := turns(history(2))
+	require.Len(t, groups, 4)
+	assert.Len(t, groups[1], 2)
+	assert.Equal(t, domain.TOOL, groups[1][1].Role)
+}
+
+// assertPaired 每个工具结果前面都有发起调用的 assistant 消息
+func assertPaired(t *testing.T, msgs []domain.Msg) {
+	for i, msg := range msgs {
+		if msg.Role != domain.TOOL {
+			continue
+		}
+		j := i - 1
+		for j >= 0 && msgs[j].Role == domain.TOOL {
+			j--
+		}
+		require.GreaterOrEqual(t, j, 0)
+		assert.Equal(t, domain.ASSISTANT, msgs[j].Role)
+	}
+}
+
+func TestContextCompaction(t *testing.T) {
+	fake := llmtest.New().
+		When(llmtest.SystemContains("compressing"), llmtest.Text("listed files ten times")).
+		Then(llmtest.Text("done"))
+
+	executor := NewPlanExecutor(fake, WithContextLimit(1000))
+	executor.messages = history(10)
+
+	result, err := executor.Run(context.Background(), "list files again")
+	require.NoError(t, err)
+	assert.Equal(t, "done", result.Summary)
+	// 总结的调用也记录在 step 上
+	assert.Len(t, result.LLMCalls, 2)
+
+	requests := fake.Requests()
+	require.Len(t, requests, 2)
+	assert.Contains(t, requests[0].Msgs[0].Content, "[tool] output output")
+
+	req := requests[1]
+	assert.Equal(t, summaryPrefix+"listed files ten times", req.Msgs[0].Content)
+	assert.LessOrEqual(t, estimateRequest(req), 1000)
+	assertPaired(t, req.Msgs)
+	assert.Equal(t, "list files again", req.Msgs[len(req.Msgs)-2].Content)
+}
+
+func TestContextCompactionFallback(t *testing.T) {
+	fake := llmtest.New().
+		WhenError(llmtest.SystemContains("compressing"), errors.New("rate limited")).
+		Then(llmtest.Text("done"))
+
+	executor := NewPlanExecutor(fake, WithContextLimit(1000))
+	executor.messages = history(10)
+
+	_, err := executor.Run(context.Background(), "list files again")
+	require.NoError(t, err)
+
+	requests := fake.Requests()
+	req := requests[len(requests)-1]
+	assert.Contains(t, req.Msgs[0].Content, "earlier messages were dropped")
+	assertPaired(t, req.Msgs)
+}
@@ -0,0 +1,69 @@
+// Package cassette 录制一次真实运行的模型调用和工具输出, 之后离线按照相同的顺序回放,
+// 用来做回归测试和复现问题
+package cassette
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const version = 1
+
+// Interaction 一次模型调用的请求和结果
+type Interaction struct {
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	// Failure 错误的类型和字段, 没有时回放成只有 Error 信息的错误
+	Failure *Failure `json:"failure,omitempty"`
+}
+
+// ToolCall 一次工具调用和它的输出
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output"`
+}
+
+// Cassette 模型调用和工具调用分别按照发生的顺序保存
+type Cassette struct {
+	Version      int           `json:"version"`
+	Interactions []Interaction `json:"interactions"`
+	Tools        []ToolCall    `json:"tools"`
+}
+
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 cassette 失败: %w", err)
+	}
+
+	var c Cassette
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("解析 cassette %s 失败: %w", path, err)
+	}
+	if c.Version != version {
+		return nil, fmt.Errorf("cassette %s 的版本 %d 不支持", path, c.Version)
+	}
+	return &c, nil
+}
+
+// Save 先写临时文件再重命名, 录制中途退出也不会留下损坏的文件
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
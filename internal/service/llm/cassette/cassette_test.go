@@ -0,0 +1,130 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"github.com/cohesion-org/deepseek-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func request(content string) domain.LLMRequest {
+	return domain.LLMRequest{
+		SystemContent: "system",
+		Msgs:          []domain.Msg{{Role: domain.USER, Content: content}},
+	}
+}
+
+func record(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "run.json")
+	fake := llmtest.New().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command":"date"}`))).
+		ThenError(errors.New("rate limited"))
+	recorder := NewRecorder(fake, path)
+
+	ctx := context.Background()
+	resp, err := recorder.Invoke(ctx, request("plan 0123456789abcdef"))
+	require.NoError(t, err)
+	require.Len(t, resp.ToolCalls, 1)
+
+	output := recorder.Tools(func(ctx context.Context, name string, args string) string {
+		return "Mon Oct 19"
+	})(ctx, "bash", `{"command":"date"}`)
+	assert.Equal(t, "Mon Oct 19", output)
+
+	_, err = recorder.Invoke(ctx, request("again"))
+	require.EqualError(t, err, "rate limited")
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	player, err := NewPlayer(record(t))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	// plan id 每次运行都不一样, 比较的时候忽略
+	resp, err := player.Invoke(ctx, request("plan fedcba9876543210"))
+	require.NoError(t, err)
+	assert.Equal(t, "bash", resp.ToolCalls[0].Function.Name)
+
+	output := player.Tools(func(ctx context.Context, name string, args string) string {
+		t.Fatal("回放时不应该执行工具")
+		return ""
+	})(ctx, "bash", `{"command":"date"}`)
+	assert.Equal(t, "Mon Oct 19", output)
+
+	_, err = player.Invoke(ctx, request("again"))
+	assert.EqualError(t, err, "rate limited")
+	assert.NoError(t, player.Done())
+}
+
+func TestReplayMismatch(t *testing.T) {
+	player, err := NewPlayer(record(t))
+	require.NoError(t, err)
+
+	_, err = player.Invoke(context.Background(), request("something else"))
+	var mismatch *MismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, 0, mismatch.Index)
+	assert.Equal(t, "msgs[0]", mismatch.Field)
+
+	// 不一致之后的调用都会失败
+	_, err = player.Invoke(context.Background(), request("again"))
+	assert.ErrorAs(t, err, &mismatch)
+	assert.Error(t, player.Done())
+}
+
+func TestReplayExhausted(t *testing.T) {
+	player, err := NewPlayer(record(t))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, err = player.Invoke(ctx, request("plan 0123456789abcdef"))
+	require.NoError(t, err)
+	assert.ErrorContains(t, player.Done(), "只回放了 1 次")
+
+	_, _ = player.Invoke(ctx, request("again"))
+	_, err = player.Invoke(ctx, request("one more"))
+	assert.ErrorContains(t, err, "没有录制")
+}
+
+func TestReplayTypedError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.json")
+	server := llmtest.NewServer(t).ThenRateLimit(2*time.Second).ThenError(http.StatusUnauthorized, "bad key")
+	recorder := NewRecorder(llm.NewHandler(server.Client(), "deepseek-chat"), path)
+
+	ctx := context.Background()
+	_, limited := recorder.Invoke(ctx, request("plan 0123456789abcdef"))
+	require.Error(t, limited)
+	_, unauthorized := recorder.Invoke(ctx, request("again"))
+	require.Error(t, unauthorized)
+
+	player, err := NewPlayer(path)
+	require.NoError(t, err)
+
+	// 回放的错误信息和类型都和录制时一致, Retry 按照同样的规则重试
+	_, err = player.Invoke(ctx, request("plan 0123456789abcdef"))
+	assert.EqualError(t, err, limited.Error())
+	assert.True(t, llm.IsRetryable(err))
+	var llmErr *llm.Error
+	require.ErrorAs(t, err, &llmErr)
+	assert.Equal(t, http.StatusTooManyRequests, llmErr.Status)
+	assert.Equal(t, 2*time.Second, llmErr.RetryAfter)
+	var apiErr *deepseek.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+
+	_, err = player.Invoke(ctx, request("again"))
+	assert.EqualError(t, err, unauthorized.Error())
+	assert.False(t, llm.IsRetryable(err))
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.NoError(t, player.Done())
+}
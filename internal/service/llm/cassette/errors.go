@@ -0,0 +1,90 @@
+package cassette
+
+import (
+	"errors"
+	"github.com/cohesion-org/deepseek-go"
+	"github.com/yumosx/agent/internal/service/llm"
+	"time"
+)
+
+// Failure 模型调用失败时错误链上的 *llm.Error 和 *deepseek.APIError,
+// 回放的时候重建成同样类型的错误, 重试和 fallback 的判断和录制时一致
+type Failure struct {
+	LLM *LLMError `json:"llm,omitempty"`
+	API *APIError `json:"api,omitempty"`
+}
+
+// LLMError 对应 *llm.Error, Cause 是它包装的错误信息
+type LLMError struct {
+	Status    int  `json:"status,omitempty"`
+	Retryable bool `json:"retryable,omitempty"`
+	// RetryAfter "1.5s" 这样的时长
+	RetryAfter string `json:"retry_after,omitempty"`
+	Cause      string `json:"cause"`
+}
+
+// APIError 对应 *deepseek.APIError
+type APIError struct {
+	StatusCode   int    `json:"status_code"`
+	APICode      int    `json:"api_code,omitempty"`
+	Message      string `json:"message,omitempty"`
+	ResponseBody string `json:"response_body,omitempty"`
+}
+
+// newFailure 错误链上没有需要保留类型的错误时返回 nil
+func newFailure(err error) *Failure {
+	f := &Failure{}
+
+	var llmErr *llm.Error
+	if errors.As(err, &llmErr) {
+		f.LLM = &LLMError{Status: llmErr.Status, Retryable: llmErr.Retryable}
+		if llmErr.RetryAfter != 0 {
+			f.LLM.RetryAfter = llmErr.RetryAfter.String()
+		}
+		if llmErr.Err != nil {
+			f.LLM.Cause = llmErr.Err.Error()
+		}
+	}
+
+	var apiErr *deepseek.APIError
+	if errors.As(err, &apiErr) {
+		f.API = &APIError{StatusCode: apiErr.StatusCode, APICode: apiErr.APICode, Message: apiErr.Message, ResponseBody: apiErr.ResponseBody}
+	}
+
+	if f.LLM == nil && f.API == nil {
+		return nil
+	}
+	return f
+}
+
+// rebuild 返回的错误信息和录制时一致, 通过 errors.As 可以拿到 *llm.Error 和 *deepseek.APIError
+func (f *Failure) rebuild(message string) error {
+	var cause error
+	if f.API != nil {
+		cause = &deepseek.APIError{StatusCode: f.API.StatusCode, APICode: f.API.APICode, Message: f.API.Message, ResponseBody: f.API.ResponseBody}
+	}
+
+	if f.LLM != nil {
+		if cause == nil {
+			cause = errors.New(f.LLM.Cause)
+		}
+		// 手工修改的 cassette 解析失败时当作没有 Retry-After
+		retryAfter, _ := time.ParseDuration(f.LLM.RetryAfter)
+		cause = &llm.Error{Status: f.LLM.Status, Retryable: f.LLM.Retryable, RetryAfter: retryAfter, Err: cause}
+	}
+	return &replayedError{message: message, err: cause}
+}
+
+// replayedError 录制的错误信息可能包含重试和 fallback 加上的前缀, 原样返回
+type replayedError struct {
+	message string
+	err     error
+}
+
+func (e *replayedError) Error() string {
+	return e.message
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,233 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 每次运行都会重新生成的 plan id, 比较请求之前替换掉
+var planId = regexp.MustCompile(`\b[0-9a-f]{16}\b`)
+
+// MismatchError 回放时的请求和录制的不一致
+type MismatchError struct {
+	// Index 第几次调用, 从 0 开始
+	Index int
+	// Field 第一个不一致的字段, 例如 msgs[3]
+	Field string
+	Want  string
+	Got   string
+}
+
+func (e *MismatchError) Error() string {
+	want, got := clip(e.Want, e.Got)
+	return fmt.Sprintf("cassette: 第 %d 次调用和录制的不一致, %s\n  录制: %s\n  实际: %s", e.Index, e.Field, want, got)
+}
+
+type PlayerOption interface {
+	Option(p *Player)
+}
+
+type PlayerOptionFunc func(p *Player)
+
+func (fn PlayerOptionFunc) Option(p *Player) {
+	fn(p)
+}
+
+// WithIgnore 比较请求之前把匹配的内容替换掉, 用来忽略时间戳之类每次运行都会变化的内容
+func WithIgnore(patterns ...*regexp.Regexp) PlayerOption {
+	return PlayerOptionFunc(func(p *Player) {
+		p.ignore = append(p.ignore, patterns...)
+	})
+}
+
+// Player 按照录制的顺序返回结果, 请求和录制的不一致时返回 *MismatchError,
+// 之后的调用都会返回同一个错误
+type Player struct {
+	cassette *Cassette
+	ignore   []*regexp.Regexp
+
+	mu    sync.Mutex
+	calls int
+	tools int
+	err   error
+}
+
+func NewPlayer(path string, opts ...PlayerOption) (*Player, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return newPlayer(c, opts...), nil
+}
+
+func newPlayer(c *Cassette, opts ...PlayerOption) *Player {
+	p := &Player{cassette: c, ignore: []*regexp.Regexp{planId}}
+	for _, opt := range opts {
+		opt.Option(p)
+	}
+	return p
+}
+
+func (p *Player) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return domain.LLMResponse{}, p.err
+	}
+
+	index := p.calls
+	if index >= len(p.cassette.Interactions) {
+		p.err = fmt.Errorf("cassette: 第 %d 次调用没有录制, 一共录制了 %d 次", index, len(p.cassette.Interactions))
+		return domain.LLMResponse{}, p.err
+	}
+	p.calls++
+
+	interaction := p.cassette.Interactions[index]
+	var want domain.LLMRequest
+	if err := json.Unmarshal(interaction.Request, &want); err != nil {
+		p.err = fmt.Errorf("cassette: 解析第 %d 次调用的请求失败: %w", index, err)
+		return domain.LLMResponse{}, p.err
+	}
+
+	if err := p.compare(index, want, req); err != nil {
+		p.err = err
+		return domain.LLMResponse{}, err
+	}
+
+	if interaction.Failure != nil {
+		return domain.LLMResponse{}, interaction.Failure.rebuild(interaction.Error)
+	}
+	if interaction.Error != "" {
+		return domain.LLMResponse{}, errors.New(interaction.Error)
+	}
+
+	var resp domain.LLMResponse
+	if err := json.Unmarshal(interaction.Response, &resp); err != nil {
+		return domain.LLMResponse{}, fmt.Errorf("cassette: 解析第 %d 次调用的结果失败: %w", index, err)
+	}
+	return resp, nil
+}
+
+// Tools 返回录制的工具输出, 不会真正执行工具. 通过 service.WithToolMiddleware 使用
+func (p *Player) Tools(next domain.ToolFunc) domain.ToolFunc {
+	return func(ctx context.Context, name string, args string) string {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.err != nil {
+			return p.err.Error()
+		}
+
+		index := p.tools
+		if index >= len(p.cassette.Tools) {
+			p.err = fmt.Errorf("cassette: 第 %d 次工具调用没有录制, 一共录制了 %d 次", index, len(p.cassette.Tools))
+			return p.err.Error()
+		}
+		p.tools++
+
+		call := p.cassette.Tools[index]
+		if call.Name != name {
+			p.err = &MismatchError{Index: index, Field: "tool", Want: call.Name, Got: name}
+			return p.err.Error()
+		}
+		if p.normalize(call.Arguments) != p.normalize(args) {
+			p.err = &MismatchError{Index: index, Field: "tool arguments", Want: call.Arguments, Got: args}
+			return p.err.Error()
+		}
+		return call.Output
+	}
+}
+
+// Done 回放结束之后检查是否出现过不一致, 以及录制的调用是否全部回放了
+func (p *Player) Done() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if p.calls != len(p.cassette.Interactions) {
+		return fmt.Errorf("cassette: 录制了 %d 次调用, 只回放了 %d 次", len(p.cassette.Interactions), p.calls)
+	}
+	if p.tools != len(p.cassette.Tools) {
+		return fmt.Errorf("cassette: 录制了 %d 次工具调用, 只回放了 %d 次", len(p.cassette.Tools), p.tools)
+	}
+	return nil
+}
+
+func (p *Player) compare(index int, want, got domain.LLMRequest) error {
+	mismatch := func(field string, want, got any) error {
+		w, g := p.encode(want), p.encode(got)
+		if w == g {
+			return nil
+		}
+		return &MismatchError{Index: index, Field: field, Want: w, Got: g}
+	}
+
+	if err := mismatch("system", want.SystemContent, got.SystemContent); err != nil {
+		return err
+	}
+	for i := 0; i < len(want.Msgs) && i < len(got.Msgs); i++ {
+		if err := mismatch(fmt.Sprintf("msgs[%d]", i), want.Msgs[i], got.Msgs[i]); err != nil {
+			return err
+		}
+	}
+	if len(want.Msgs) != len(got.Msgs) {
+		return &MismatchError{
+			Index: index,
+			Field: "msgs",
+			Want:  fmt.Sprintf("%d 条消息", len(want.Msgs)),
+			Got:   fmt.Sprintf("%d 条消息", len(got.Msgs)),
+		}
+	}
+	if err := mismatch("tools", want.Tools, got.Tools); err != nil {
+		return err
+	}
+	return mismatch("choice", want.Choice, got.Choice)
+}
+
+func (p *Player) encode(v any) string {
+	data, _ := json.Marshal(v)
+	return p.normalize(string(data))
+}
+
+func (p *Player) normalize(s string) string {
+	for _, pattern := range p.ignore {
+		s = pattern.ReplaceAllString(s, "<ignored>")
+	}
+	return s
+}
+
+// clip 只保留第一个不同的位置附近的内容, 避免整条消息都打印出来
+func clip(want, got string) (string, string) {
+	const width = 80
+
+	i := 0
+	for i < len(want) && i < len(got) && want[i] == got[i] {
+		i++
+	}
+
+	start := max(i-width/2, 0)
+	cut := func(s string) string {
+		if start >= len(s) {
+			return "..."
+		}
+		end := min(start+width, len(s))
+		out := strings.ToValidUTF8(s[start:end], "")
+		if start > 0 {
+			out = "..." + out
+		}
+		if end < len(s) {
+			out += "..."
+		}
+		return out
+	}
+	return cut(want), cut(got)
+}
@@ -0,0 +1,56 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/service/llm"
+	"sync"
+)
+
+// Recorder 把 next 的每次调用追加到 cassette, 每次调用之后都会写文件
+type Recorder struct {
+	next llm.Invoker
+	path string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+func NewRecorder(next llm.Invoker, path string) *Recorder {
+	return &Recorder{next: next, path: path, cassette: Cassette{Version: version}}
+}
+
+func (r *Recorder) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	resp, err := r.next.Invoke(ctx, req)
+
+	interaction := Interaction{}
+	interaction.Request, _ = json.Marshal(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.Failure = newFailure(err)
+	} else {
+		interaction.Response, _ = json.Marshal(resp)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	if saveErr := r.cassette.Save(r.path); saveErr != nil && err == nil {
+		return resp, saveErr
+	}
+	return resp, err
+}
+
+// Tools 记录工具的输出, 通过 service.WithToolMiddleware 使用
+func (r *Recorder) Tools(next domain.ToolFunc) domain.ToolFunc {
+	return func(ctx context.Context, name string, args string) string {
+		output := next(ctx, name, args)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.cassette.Tools = append(r.cassette.Tools, ToolCall{Name: name, Arguments: args, Output: output})
+		_ = r.cassette.Save(r.path)
+		return output
+	}
+}
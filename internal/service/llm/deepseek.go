@@ -4,19 +4,52 @@ import (
 	"context"
 	"github.com/cohesion-org/deepseek-go"
 	"github.com/yumosx/agent/internal/domain"
+	"net/http"
+	"time"
 )
 
 type Handler struct {
 	client *deepseek.Client
+	model  string
 }
 
-func NewHandler(client *deepseek.Client) *Handler {
-	return &Handler{client: client}
+// NewHandler 会替换 client 的 HTTPClient, 用来读取 Retry-After 等响应头;
+// 返回结果的 Model 是接口使用的模型名称, 通过 Candidate 调用时记录为 provider/model
+func NewHandler(client *deepseek.Client, model string) *Handler {
+	next := client.HTTPClient
+	if next == nil {
+		next = http.DefaultClient
+	}
+	client.HTTPClient = &transport{next: next}
+	return &Handler{client: client, model: model}
+}
+
+type exchangeKey struct{}
+
+// exchange 记录一次请求收到的响应, 通过 context 传给 transport
+type exchange struct {
+	response *http.Response
+	err      error
+}
+
+type transport struct {
+	next deepseek.HTTPDoer
+}
+
+func (t *transport) Do(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.Do(req)
+	if ex, ok := req.Context().Value(exchangeKey{}).(*exchange); ok {
+		ex.response, ex.err = resp, err
+	}
+	return resp, err
 }
 
 func (h *Handler) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	ex := &exchange{}
+	ctx = context.WithValue(ctx, exchangeKey{}, ex)
+
 	request := &deepseek.ChatCompletionRequest{
-		Model:      deepseek.DeepSeekChat,
+		Model:      h.model,
 		Messages:   []deepseek.ChatCompletionMessage{},
 		ToolChoice: "auto",
 	}
@@ -34,7 +67,11 @@ func (h *Handler) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLM
 			}
 			if msg.Role == domain.ASSISTANT {
 				request.Messages = append(request.Messages,
-					deepseek.ChatCompletionMessage{Role: deepseek.ChatMessageRoleAssistant, Content: msg.Content})
+					deepseek.ChatCompletionMessage{Role: deepseek.ChatMessageRoleAssistant, Content: msg.Content, ToolCalls: toToolCalls(msg.ToolCalls)})
+			}
+			if msg.Role == domain.TOOL {
+				request.Messages = append(request.Messages,
+					deepseek.ChatCompletionMessage{Role: deepseek.ChatMessageRoleTool, Content: msg.Content, ToolCallID: msg.Id})
 			}
 		}
 	}
@@ -55,12 +92,17 @@ func (h *Handler) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLM
 
 	response, err := h.client.CreateChatCompletion(ctx, request)
 	if err != nil {
-		return domain.LLMResponse{}, err
+		return domain.LLMResponse{}, classify(ctx, ex, err)
 	}
 
 	ch := response.Choices[0].Message
 
-	resp := domain.LLMResponse{Content: ch.Content}
+	resp := domain.LLMResponse{Content: ch.Content, Model: h.model, Usage: domain.Usage{
+		PromptTokens:     response.Usage.PromptTokens,
+		CachedTokens:     response.Usage.PromptCacheHitTokens,
+		CompletionTokens: response.Usage.CompletionTokens,
+		TotalTokens:      response.Usage.TotalTokens,
+	}}
 
 	if len(ch.ToolCalls) == 0 {
 		return resp, nil
@@ -82,3 +124,47 @@ func (h *Handler) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLM
 
 	return resp, nil
 }
+
+func toToolCalls(calls []domain.LLMToolCall) []deepseek.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	result := make([]deepseek.ToolCall, len(calls))
+	for i, call := range calls {
+		result[i] = deepseek.ToolCall{
+			Index: call.Index,
+			ID:    call.ID,
+			Type:  call.Type,
+			Function: deepseek.ToolCallFunction{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		}
+	}
+	return result
+}
+
+// classify 把客户端返回的错误转换成 *Error, 调用方取消时原样返回
+func classify(ctx context.Context, ex *exchange, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+
+	// 没有收到响应, 网络错误或者连接被重置
+	if ex.response == nil {
+		return &Error{Retryable: true, Err: err}
+	}
+
+	status := ex.response.StatusCode
+	if status < 400 {
+		// 响应格式不对, 重试大概率也是一样的结果
+		return &Error{Status: status, Err: err}
+	}
+	return &Error{
+		Status:     status,
+		Retryable:  retryableStatus(status),
+		RetryAfter: parseRetryAfter(ex.response.Header.Get("Retry-After"), time.Now()),
+		Err:        err,
+	}
+}
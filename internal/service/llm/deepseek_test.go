@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"github.com/cohesion-org/deepseek-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/domain/params"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandlerRequest(t *testing.T) {
+	server := llmtest.NewServer(t).Then(llmtest.Text("done"))
+	handler := NewHandler(server.Client(), "deepseek-chat")
+
+	call := llmtest.Call("", llmtest.Tool("bash", `{"command":"ls"}`)).ToolCalls
+	resp, err := handler.Invoke(context.Background(), domain.LLMRequest{
+		SystemContent: "system",
+		Msgs: []domain.Msg{
+			{Role: domain.USER, Content: "list files"},
+			{Role: domain.ASSISTANT, ToolCalls: call},
+			{Role: domain.TOOL, Content: "main.go", Id: "call_0"},
+		},
+		Tools: []domain.Tool{{
+			Type: "function",
+			Function: domain.Function{
+				Name:        "bash",
+				Description: "run bash",
+				Parameters:  &domain.FunctionParameters{Properties: params.NewBashParams(), Required: []string{"command"}},
+			},
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "done", resp.Content)
+	assert.Empty(t, resp.ToolCalls)
+
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	req := requests[0]
+	assert.Equal(t, "deepseek-chat", req.Model)
+	assert.Equal(t, "auto", req.ToolChoice)
+
+	require.Len(t, req.Messages, 4)
+	assert.Equal(t, deepseek.ChatMessageRoleSystem, req.Messages[0].Role)
+	assert.Equal(t, deepseek.ChatMessageRoleUser, req.Messages[1].Role)
+	assert.Equal(t, deepseek.ChatMessageRoleAssistant, req.Messages[2].Role)
+	require.Len(t, req.Messages[2].ToolCalls, 1)
+	assert.Equal(t, "call_0", req.Messages[2].ToolCalls[0].ID)
+	assert.Equal(t, `{"command":"ls"}`, req.Messages[2].ToolCalls[0].Function.Arguments)
+	assert.Equal(t, deepseek.ChatMessageRoleTool, req.Messages[3].Role)
+	assert.Equal(t, "call_0", req.Messages[3].ToolCallID)
+
+	require.Len(t, req.Tools, 1)
+	assert.Equal(t, "bash", req.Tools[0].Function.Name)
+	assert.Equal(t, "object", req.Tools[0].Function.Parameters.Type)
+	assert.Equal(t, []string{"command"}, req.Tools[0].Function.Parameters.Required)
+	assert.Contains(t, req.Tools[0].Function.Parameters.Properties, "command")
+}
+
+func TestHandlerToolCalls(t *testing.T) {
+	server := llmtest.NewServer(t).Then(llmtest.Call("checking",
+		llmtest.Tool("bash", `{"command":"date"}`),
+		llmtest.Tool("terminate", `{"status":"success"}`),
+	))
+	handler := NewHandler(server.Client(), "deepseek-chat")
+
+	resp, err := handler.Invoke(context.Background(), domain.LLMRequest{Msgs: []domain.Msg{{Role: domain.USER, Content: "date"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "checking", resp.Content)
+	require.Len(t, resp.ToolCalls, 2)
+	assert.Equal(t, "call_1", resp.ToolCalls[1].ID)
+	assert.Equal(t, 1, resp.ToolCalls[1].Index)
+	assert.Equal(t, "function", resp.ToolCalls[1].Type)
+	assert.Equal(t, "terminate", resp.ToolCalls[1].Function.Name)
+	assert.Equal(t, `{"status":"success"}`, resp.ToolCalls[1].Function.Arguments)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	server := llmtest.NewServer(t).
+		ThenError(http.StatusInternalServerError, "server exploded").
+		ThenRateLimit(3*time.Second).
+		ThenRaw(http.StatusOK, `{"id":"chatcmpl-1","choices":[]}`).
+		ThenRaw(http.StatusOK, `not json`)
+	handler := NewHandler(server.Client(), "deepseek-chat")
+	req := domain.LLMRequest{Msgs: []domain.Msg{{Role: domain.USER, Content: "hi"}}}
+	ctx := context.Background()
+
+	var apiErr *deepseek.APIError
+	_, err := handler.Invoke(ctx, req)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	assert.Equal(t, "server exploded", apiErr.Message)
+	assert.True(t, IsRetryable(err))
+
+	_, err = handler.Invoke(ctx, req)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	assert.True(t, e.Retryable)
+	assert.Equal(t, 3*time.Second, e.RetryAfter)
+
+	_, err = handler.Invoke(ctx, req)
+	assert.ErrorContains(t, err, "no choices")
+	assert.False(t, IsRetryable(err))
+
+	_, err = handler.Invoke(ctx, req)
+	assert.Error(t, err)
+	assert.Zero(t, server.Remaining())
+}
+
+func TestHandlerSlow(t *testing.T) {
+	server := llmtest.NewServer(t).ThenSlow(time.Minute, llmtest.Text("too late"))
+	handler := NewHandler(server.Client(), "deepseek-chat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := handler.Invoke(ctx, domain.LLMRequest{Msgs: []domain.Msg{{Role: domain.USER, Content: "hi"}}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
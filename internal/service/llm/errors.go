@@ -0,0 +1,65 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error 模型调用失败的原因, Retryable 为 true 时可以重试
+type Error struct {
+	// Status HTTP 状态码, 没有收到响应时为 0
+	Status    int
+	Retryable bool
+	// RetryAfter 服务端要求等待的时间, 没有时为 0
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	kind := "fatal"
+	if e.Retryable {
+		kind = "retryable"
+	}
+	if e.Status != 0 {
+		return fmt.Sprintf("llm %s error (HTTP %d): %v", kind, e.Status, e.Err)
+	}
+	return fmt.Sprintf("llm %s error: %v", kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable err 是否是可以重试的模型调用错误
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
+
+// retryableStatus 限流、超时和服务端错误可以重试, 其他的 4xx 重试也不会成功
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter 支持秒数和 HTTP 时间两种格式
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
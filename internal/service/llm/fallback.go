@@ -0,0 +1,61 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+)
+
+// Candidate fallback 链上的一个模型, Name 一般是 provider/model
+type Candidate struct {
+	Name    string
+	Invoker Invoker
+}
+
+// Invoke 返回结果的 Model 记录为 Name, 只有一个模型时也使用同样的格式
+func (c Candidate) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	resp, err := c.Invoker.Invoke(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Model = c.Name
+	return resp, nil
+}
+
+// Fallback 按照顺序调用模型, 前一个失败时换下一个, 返回结果的 Model 为实际使用的模型.
+// 每个 Invoker 一般自己带 Retry, 到这里的错误都是不可重试或者已经重试过了
+type Fallback struct {
+	candidates []Candidate
+}
+
+func NewFallback(candidates ...Candidate) *Fallback {
+	return &Fallback{candidates: candidates}
+}
+
+func (f *Fallback) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	var errs []error
+	for _, c := range f.candidates {
+		resp, err := c.Invoke(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return domain.LLMResponse{}, err
+		}
+		slog.WarnContext(ctx, "llm model failed, trying next", "model", c.Name, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("fallback", trace.WithAttributes(
+			attribute.String("llm.model", c.Name),
+			attribute.String("llm.error", err.Error()),
+		))
+		errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+	}
+
+	if len(errs) == 0 {
+		return domain.LLMResponse{}, errors.New("没有可用的模型")
+	}
+	return domain.LLMResponse{}, fmt.Errorf("所有模型都调用失败: %w", errors.Join(errs...))
+}
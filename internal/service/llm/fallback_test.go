@@ -0,0 +1,67 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"net/http"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	primary := llmtest.NewServer(t).ThenError(http.StatusServiceUnavailable, "overloaded")
+	secondary := llmtest.NewServer(t).ThenError(http.StatusUnauthorized, "bad key")
+	backup := llmtest.NewServer(t).Then(llmtest.Text("ok"))
+
+	fallback := NewFallback(
+		Candidate{Name: "deepseek/deepseek-chat", Invoker: NewHandler(primary.Client(), "deepseek-chat")},
+		Candidate{Name: "openai/gpt-4o", Invoker: NewHandler(secondary.Client(), "gpt-4o")},
+		Candidate{Name: "deepseek/deepseek-reasoner", Invoker: NewHandler(backup.Client(), "deepseek-reasoner")},
+	)
+
+	resp, err := fallback.Invoke(context.Background(), hi)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Content)
+	assert.Equal(t, "deepseek/deepseek-reasoner", resp.Model)
+	assert.Len(t, primary.Requests(), 1)
+	assert.Len(t, secondary.Requests(), 1)
+}
+
+func TestCandidate(t *testing.T) {
+	server := llmtest.NewServer(t).Then(llmtest.Text("ok"))
+	candidate := Candidate{Name: "deepseek/deepseek-chat", Invoker: NewHandler(server.Client(), "deepseek-chat")}
+
+	// 只有一个模型时也记录为 provider/model
+	resp, err := candidate.Invoke(context.Background(), hi)
+	require.NoError(t, err)
+	assert.Equal(t, "deepseek/deepseek-chat", resp.Model)
+}
+
+func TestFallbackAllFailed(t *testing.T) {
+	fallback := NewFallback(
+		Candidate{Name: "a", Invoker: llmtest.New().ThenError(errors.New("down"))},
+		Candidate{Name: "b", Invoker: llmtest.New().ThenError(&Error{Status: http.StatusTooManyRequests, Retryable: true, Err: errors.New("slow down")})},
+	)
+
+	_, err := fallback.Invoke(context.Background(), hi)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a: down")
+	assert.Contains(t, err.Error(), "b: llm retryable error (HTTP 429): slow down")
+	assert.True(t, IsRetryable(err))
+}
+
+func TestFallbackCanceled(t *testing.T) {
+	second := llmtest.New().Then(llmtest.Text("ok"))
+	fallback := NewFallback(
+		Candidate{Name: "a", Invoker: llmtest.New().ThenError(context.Canceled)},
+		Candidate{Name: "b", Invoker: second},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := fallback.Invoke(ctx, hi)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, second.Requests())
+}
@@ -0,0 +1,11 @@
+package llm
+
+import (
+	"context"
+	"github.com/yumosx/agent/internal/domain"
+)
+
+// Invoker 调用大模型, Handler 是基于 deepseek 的实现
+type Invoker interface {
+	Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error)
+}
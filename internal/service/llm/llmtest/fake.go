@@ -0,0 +1,169 @@
+package llmtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"strings"
+	"sync"
+)
+
+// Predicate 判断请求是否命中脚本里的一条规则
+type Predicate func(req domain.LLMRequest) bool
+
+type rule struct {
+	match Predicate
+	resp  domain.LLMResponse
+	err   error
+	once  bool
+	used  bool
+}
+
+// Fake 按照脚本返回结果的大模型, 用来在测试里替代真实的模型.
+// When 注册的规则优先匹配, 没有命中时按照 Then 的顺序依次返回
+type Fake struct {
+	mu       sync.Mutex
+	rules    []*rule
+	queue    []*rule
+	requests []domain.LLMRequest
+}
+
+func New() *Fake {
+	return &Fake{}
+}
+
+// Then 按照调用顺序返回 resp
+func (f *Fake) Then(resp domain.LLMResponse) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, &rule{resp: resp})
+	return f
+}
+
+// ThenError 按照调用顺序返回 err
+func (f *Fake) ThenError(err error) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, &rule{err: err})
+	return f
+}
+
+// When 每次命中 match 的请求都返回 resp
+func (f *Fake) When(match Predicate, resp domain.LLMResponse) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, &rule{match: match, resp: resp})
+	return f
+}
+
+// WhenOnce 只在第一次命中 match 的时候返回 resp
+func (f *Fake) WhenOnce(match Predicate, resp domain.LLMResponse) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, &rule{match: match, resp: resp, once: true})
+	return f
+}
+
+// WhenError 每次命中 match 的请求都返回 err
+func (f *Fake) WhenError(match Predicate, err error) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, &rule{match: match, err: err})
+	return f
+}
+
+func (f *Fake) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req)
+	if err := ctx.Err(); err != nil {
+		return domain.LLMResponse{}, err
+	}
+
+	for _, r := range f.rules {
+		if r.once && r.used {
+			continue
+		}
+		if r.match(req) {
+			r.used = true
+			return r.resp, r.err
+		}
+	}
+
+	if len(f.queue) == 0 {
+		return domain.LLMResponse{}, fmt.Errorf("llmtest: no scripted response for request #%d", len(f.requests))
+	}
+	r := f.queue[0]
+	f.queue = f.queue[1:]
+	return r.resp, r.err
+}
+
+// Requests 返回收到的所有请求
+func (f *Fake) Requests() []domain.LLMRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]domain.LLMRequest(nil), f.requests...)
+}
+
+// Remaining 返回还没有被使用的顺序脚本数量
+func (f *Fake) Remaining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue)
+}
+
+// Text 只包含文本的回复
+func Text(content string) domain.LLMResponse {
+	return domain.LLMResponse{Content: content}
+}
+
+// Call 调用一个或多个工具的回复
+func Call(content string, calls ...domain.LLMToolCall) domain.LLMResponse {
+	for i := range calls {
+		calls[i].Index = i
+		if calls[i].ID == "" {
+			calls[i].ID = fmt.Sprintf("call_%d", i)
+		}
+	}
+	return domain.LLMResponse{Content: content, ToolCalls: calls}
+}
+
+// Tool 构造一次工具调用, args 是 JSON 字符串
+func Tool(name string, args string) domain.LLMToolCall {
+	return domain.LLMToolCall{
+		Type:     "function",
+		Function: domain.LLMToolCallFunction{Name: name, Arguments: args},
+	}
+}
+
+// HasTool 请求里提供了 name 工具
+func HasTool(name string) Predicate {
+	return func(req domain.LLMRequest) bool {
+		for _, t := range req.Tools {
+			if t.Function.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SystemContains system prompt 包含 s
+func SystemContains(s string) Predicate {
+	return func(req domain.LLMRequest) bool {
+		return strings.Contains(req.SystemContent, s)
+	}
+}
+
+// UserContains 任意一条用户消息包含 s
+func UserContains(s string) Predicate {
+	return func(req domain.LLMRequest) bool {
+		for _, msg := range req.Msgs {
+			if msg.Role == domain.USER && strings.Contains(msg.Content, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,189 @@
+package llmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cohesion-org/deepseek-go"
+	"github.com/yumosx/agent/internal/domain"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Token Server 接受的 API key
+const Token = "llmtest-token"
+
+type reply struct {
+	status int
+	header http.Header
+	body   any
+	delay  time.Duration
+}
+
+// Server 兼容 OpenAI/DeepSeek chat completions 接口的本地服务, 按照脚本的顺序返回结果,
+// 用来在没有网络的情况下测试真实的 HTTP 客户端
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	queue    []reply
+	requests []deepseek.ChatCompletionRequest
+}
+
+// NewServer 测试结束时自动关闭
+func NewServer(t testing.TB) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client 返回指向 Server 的客户端
+func (s *Server) Client() *deepseek.Client {
+	client, _ := deepseek.NewClientWithOptions(Token, deepseek.WithBaseURL(s.URL+"/"))
+	return client
+}
+
+// Then 按照调用顺序返回 resp
+func (s *Server) Then(resp domain.LLMResponse) *Server {
+	return s.push(reply{status: http.StatusOK, body: completion(resp)})
+}
+
+// ThenSlow 等待 delay 之后再返回 resp, 客户端取消请求时提前结束
+func (s *Server) ThenSlow(delay time.Duration, resp domain.LLMResponse) *Server {
+	return s.push(reply{status: http.StatusOK, body: completion(resp), delay: delay})
+}
+
+// ThenError 返回 status 状态码和 DeepSeek 格式的错误
+func (s *Server) ThenError(status int, message string) *Server {
+	return s.push(reply{status: status, body: apiError(status, message)})
+}
+
+// ThenRateLimit 返回 429, retryAfter 不为 0 时设置 Retry-After
+func (s *Server) ThenRateLimit(retryAfter time.Duration) *Server {
+	header := http.Header{}
+	if retryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	return s.push(reply{status: http.StatusTooManyRequests, header: header, body: apiError(http.StatusTooManyRequests, "rate limit reached")})
+}
+
+// ThenRaw 原样返回 body, 用来测试不合法的响应
+func (s *Server) ThenRaw(status int, body string) *Server {
+	return s.push(reply{status: status, body: body})
+}
+
+// Requests 返回收到的所有请求
+func (s *Server) Requests() []deepseek.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]deepseek.ChatCompletionRequest(nil), s.requests...)
+}
+
+// Remaining 返回还没有被使用的脚本数量
+func (s *Server) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+func (s *Server) push(r reply) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, r)
+	return s
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || strings.TrimSuffix(r.URL.Path, "/") != "/chat/completions" {
+		write(w, http.StatusNotFound, nil, apiError(http.StatusNotFound, "not found: "+r.URL.Path))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		write(w, http.StatusUnauthorized, nil, apiError(http.StatusUnauthorized, "invalid api key"))
+		return
+	}
+
+	var req deepseek.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		write(w, http.StatusBadRequest, nil, apiError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	n := len(s.requests)
+	if len(s.queue) == 0 {
+		s.mu.Unlock()
+		write(w, http.StatusInternalServerError, nil, apiError(http.StatusInternalServerError, fmt.Sprintf("llmtest: no scripted response for request #%d", n)))
+		return
+	}
+	next := s.queue[0]
+	s.queue = s.queue[1:]
+	s.mu.Unlock()
+
+	if next.delay > 0 {
+		select {
+		case <-time.After(next.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	write(w, next.status, next.header, next.body)
+}
+
+func write(w http.ResponseWriter, status int, header http.Header, body any) {
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+
+	if raw, ok := body.(string); ok {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(raw))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func completion(resp domain.LLMResponse) deepseek.ChatCompletionResponse {
+	message := deepseek.Message{Role: deepseek.ChatMessageRoleAssistant, Content: resp.Content}
+	finish := "stop"
+	for _, call := range resp.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, deepseek.ToolCall{
+			Index: call.Index,
+			ID:    call.ID,
+			Type:  call.Type,
+			Function: deepseek.ToolCallFunction{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		})
+		finish = "tool_calls"
+	}
+
+	return deepseek.ChatCompletionResponse{
+		ID:      "chatcmpl-llmtest",
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   "llmtest",
+		Choices: []deepseek.Choice{{Message: message, FinishReason: finish}},
+		Usage: deepseek.Usage{
+			PromptTokens:          resp.Usage.PromptTokens,
+			CompletionTokens:      resp.Usage.CompletionTokens,
+			TotalTokens:           resp.Usage.TotalTokens,
+			PromptCacheHitTokens:  resp.Usage.CachedTokens,
+			PromptCacheMissTokens: resp.Usage.PromptTokens - resp.Usage.CachedTokens,
+		},
+	}
+}
+
+func apiError(status int, message string) map[string]any {
+	return map[string]any{"code": status, "message": message}
+}
@@ -0,0 +1,38 @@
+package llm
+
+import (
+	"context"
+	"github.com/yumosx/agent/internal/domain"
+	"log/slog"
+	"time"
+)
+
+// Logger 记录每次模型调用的模型、耗时和 token, 放在 Meter 之外才能拿到费用
+type Logger struct {
+	next Invoker
+}
+
+func NewLogger(next Invoker) *Logger {
+	return &Logger{next: next}
+}
+
+func (l *Logger) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	start := time.Now()
+	resp, err := l.next.Invoke(ctx, req)
+	latency := time.Since(start)
+	if err != nil {
+		slog.ErrorContext(ctx, "llm call failed", "latency", latency, "error", err)
+		return resp, err
+	}
+
+	slog.InfoContext(ctx, "llm call",
+		"model", resp.Model,
+		"latency", latency,
+		"prompt_tokens", resp.Usage.PromptTokens,
+		"completion_tokens", resp.Usage.CompletionTokens,
+		"total_tokens", resp.Usage.TotalTokens,
+		"cost", resp.Usage.Cost,
+		"tool_calls", len(resp.ToolCalls),
+	)
+	return resp, nil
+}
@@ -0,0 +1,27 @@
+package llm
+
+import (
+	"context"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/metrics"
+	"time"
+)
+
+// Instrument 记录每次调用的耗时、结果和 token, 放在 Retry 里面时每次重试单独计数
+type Instrument struct {
+	next    Invoker
+	model   string
+	metrics *metrics.Metrics
+}
+
+// NewInstrument model 是指标的标签, 一般是 provider/model
+func NewInstrument(next Invoker, model string, m *metrics.Metrics) *Instrument {
+	return &Instrument{next: next, model: model, metrics: m}
+}
+
+func (i *Instrument) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	start := time.Now()
+	resp, err := i.next.Invoke(ctx, req)
+	i.metrics.ObserveLLM(i.model, time.Since(start), resp.Usage, err)
+	return resp, err
+}
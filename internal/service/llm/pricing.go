@@ -0,0 +1,71 @@
+package llm
+
+import (
+	"context"
+	"github.com/yumosx/agent/internal/domain"
+	"strings"
+)
+
+// Price 每百万 token 的价格, 单位美元
+type Price struct {
+	Input float64 `yaml:"input"`
+	// CachedInput 命中缓存的 prompt token 的价格, 为 0 时按照 Input 计算
+	CachedInput float64 `yaml:"cached_input"`
+	Output      float64 `yaml:"output"`
+}
+
+// Prices 按照模型名称查找价格, 名称可以是 model 或者 provider/model
+type Prices map[string]Price
+
+// DefaultPrices DeepSeek 官方的价格, 可以在配置文件里覆盖
+func DefaultPrices() Prices {
+	return Prices{
+		"deepseek-chat":     {Input: 0.27, CachedInput: 0.07, Output: 1.10},
+		"deepseek-reasoner": {Input: 0.55, CachedInput: 0.14, Output: 2.19},
+	}
+}
+
+func (p Prices) lookup(model string) (Price, bool) {
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		price, ok := p[model[i+1:]]
+		return price, ok
+	}
+	return Price{}, false
+}
+
+// Cost 计算一次调用的费用, 没有配置价格的模型返回 0
+func (p Prices) Cost(model string, usage domain.Usage) float64 {
+	price, ok := p.lookup(model)
+	if !ok {
+		return 0
+	}
+
+	cached := price.CachedInput
+	if cached == 0 {
+		cached = price.Input
+	}
+	miss := usage.PromptTokens - usage.CachedTokens
+	return (float64(miss)*price.Input + float64(usage.CachedTokens)*cached + float64(usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// Meter 按照价格表计算每次调用的费用, 放在 fallback 之外才能拿到实际使用的模型
+type Meter struct {
+	next   Invoker
+	prices Prices
+}
+
+func NewMeter(next Invoker, prices Prices) *Meter {
+	return &Meter{next: next, prices: prices}
+}
+
+func (m *Meter) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	resp, err := m.next.Invoke(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Usage.Cost = m.prices.Cost(resp.Model, resp.Usage)
+	return resp, nil
+}
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"testing"
+)
+
+func TestMeter(t *testing.T) {
+	resp := llmtest.Text("ok")
+	resp.Usage = domain.Usage{PromptTokens: 1_000_000, CachedTokens: 400_000, CompletionTokens: 100_000, TotalTokens: 1_100_000}
+	server := llmtest.NewServer(t).Then(resp)
+
+	prices := Prices{"deepseek-chat": {Input: 1, CachedInput: 0.5, Output: 10}}
+	meter := NewMeter(NewHandler(server.Client(), "deepseek-chat"), prices)
+
+	got, err := meter.Invoke(context.Background(), hi)
+	require.NoError(t, err)
+	assert.Equal(t, 1_000_000, got.Usage.PromptTokens)
+	assert.Equal(t, 400_000, got.Usage.CachedTokens)
+	assert.Equal(t, 100_000, got.Usage.CompletionTokens)
+	// 0.6 * 1 + 0.4 * 0.5 + 0.1 * 10
+	assert.InDelta(t, 1.8, got.Usage.Cost, 1e-9)
+}
+
+func TestPricesCost(t *testing.T) {
+	prices := Prices{"deepseek-chat": {Input: 2, Output: 4}}
+	usage := domain.Usage{PromptTokens: 500_000, CachedTokens: 500_000, CompletionTokens: 250_000}
+
+	// 没有缓存价格时按照 Input 计算, fallback 的 provider/model 也能找到价格
+	assert.InDelta(t, 2.0, prices.Cost("deepseek/deepseek-chat", usage), 1e-9)
+	assert.Zero(t, prices.Cost("openai/gpt-4o", usage))
+}
@@ -0,0 +1,134 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy 模型调用的重试和超时策略
+type RetryPolicy struct {
+	// MaxAttempts 包括第一次调用在内最多调用的次数, 小于等于 1 时不重试
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff 第一次重试前等待的时间, 之后每次翻倍, 不超过 MaxBackoff
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// Jitter 随机减少等待时间的比例, 取值 0 到 1, 避免多个 session 同时重试
+	Jitter float64 `yaml:"jitter"`
+	// Timeout 每次调用的超时时间, 0 表示只受调用方的 context 限制
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Jitter:         0.2,
+		Timeout:        2 * time.Minute,
+	}
+}
+
+// Validate 返回第一个不合法的配置项
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.Timeout < 0:
+		return errors.New("retry 的时间不能小于 0")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return errors.New("retry.jitter 必须在 0 到 1 之间")
+	}
+	return nil
+}
+
+// backoff 第 attempt 次重试之前等待的时间, 服务端的 Retry-After 更长时以服务端为准
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration, random float64) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	d -= time.Duration(float64(d) * p.Jitter * random)
+	return max(d, retryAfter)
+}
+
+// Retry 按照 RetryPolicy 重试 next 返回的可重试错误
+type Retry struct {
+	next   Invoker
+	policy RetryPolicy
+	// 测试里替换, 不用真的等待
+	sleep  func(ctx context.Context, d time.Duration) error
+	random func() float64
+}
+
+func NewRetry(next Invoker, policy RetryPolicy) *Retry {
+	return &Retry{next: next, policy: policy, sleep: sleep, random: rand.Float64}
+}
+
+func (r *Retry) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	attempts := max(r.policy.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp domain.LLMResponse
+		resp, err = r.invoke(ctx, req)
+		if err == nil || ctx.Err() != nil || !IsRetryable(err) {
+			return resp, err
+		}
+		if attempt == attempts {
+			break
+		}
+
+		var e *Error
+		errors.As(err, &e)
+		wait := r.policy.backoff(attempt, e.RetryAfter, r.random())
+		slog.WarnContext(ctx, "llm call failed, retrying", "attempt", attempt, "backoff", wait, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("llm.attempt", attempt),
+			attribute.String("llm.error", err.Error()),
+		))
+		if err = r.sleep(ctx, wait); err != nil {
+			return domain.LLMResponse{}, err
+		}
+	}
+
+	if attempts == 1 {
+		return domain.LLMResponse{}, err
+	}
+	return domain.LLMResponse{}, fmt.Errorf("调用 %d 次之后仍然失败: %w", attempts, err)
+}
+
+// invoke 单次调用, 超时的时候如果调用方没有取消就当作可以重试的错误
+func (r *Retry) invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	if r.policy.Timeout <= 0 {
+		return r.next.Invoke(ctx, req)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, r.policy.Timeout)
+	defer cancel()
+
+	resp, err := r.next.Invoke(callCtx, req)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return resp, &Error{Retryable: true, Err: fmt.Errorf("调用超过 %s: %w", r.policy.Timeout, err)}
+	}
+	return resp, err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,114 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestRetry(server *llmtest.Server, policy RetryPolicy) (*Retry, *[]time.Duration) {
+	var sleeps []time.Duration
+	retry := NewRetry(NewHandler(server.Client(), "deepseek-chat"), policy)
+	retry.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	retry.random = func() float64 { return 0 }
+	return retry, &sleeps
+}
+
+var hi = domain.LLMRequest{Msgs: []domain.Msg{{Role: domain.USER, Content: "hi"}}}
+
+func TestRetry(t *testing.T) {
+	server := llmtest.NewServer(t).
+		ThenRateLimit(3*time.Second).
+		ThenError(http.StatusServiceUnavailable, "overloaded").
+		Then(llmtest.Text("ok"))
+	retry, sleeps := newTestRetry(server, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute})
+
+	resp, err := retry.Invoke(context.Background(), hi)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Content)
+	// 第一次使用服务端的 Retry-After, 第二次是翻倍之后的 backoff
+	assert.Equal(t, []time.Duration{3 * time.Second, 2 * time.Second}, *sleeps)
+	assert.Len(t, server.Requests(), 3)
+}
+
+func TestRetryFatal(t *testing.T) {
+	server := llmtest.NewServer(t).ThenError(http.StatusUnauthorized, "bad key").Then(llmtest.Text("ok"))
+	retry, sleeps := newTestRetry(server, DefaultRetryPolicy())
+
+	_, err := retry.Invoke(context.Background(), hi)
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusUnauthorized, e.Status)
+	assert.False(t, IsRetryable(err))
+	assert.Empty(t, *sleeps)
+	assert.Len(t, server.Requests(), 1)
+}
+
+func TestRetryExhausted(t *testing.T) {
+	server := llmtest.NewServer(t).
+		ThenError(http.StatusInternalServerError, "boom").
+		ThenError(http.StatusBadGateway, "boom").
+		ThenError(http.StatusGatewayTimeout, "boom")
+	retry, sleeps := newTestRetry(server, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second})
+
+	_, err := retry.Invoke(context.Background(), hi)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "调用 3 次之后仍然失败")
+	assert.True(t, IsRetryable(err))
+	assert.Len(t, *sleeps, 2)
+	assert.Len(t, server.Requests(), 3)
+}
+
+func TestRetryTimeout(t *testing.T) {
+	server := llmtest.NewServer(t).
+		ThenSlow(time.Minute, llmtest.Text("too late")).
+		Then(llmtest.Text("ok"))
+	retry, _ := newTestRetry(server, RetryPolicy{MaxAttempts: 2, Timeout: 50 * time.Millisecond})
+
+	resp, err := retry.Invoke(context.Background(), hi)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Content)
+}
+
+func TestRetryCanceled(t *testing.T) {
+	server := llmtest.NewServer(t).ThenError(http.StatusServiceUnavailable, "overloaded")
+	retry, _ := newTestRetry(server, DefaultRetryPolicy())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	retry.sleep = func(context.Context, time.Duration) error {
+		cancel()
+		return context.Canceled
+	}
+
+	_, err := retry.Invoke(ctx, hi)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, server.Requests(), 1)
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Jitter: 0.5}
+
+	assert.Equal(t, time.Second, policy.backoff(1, 0, 0))
+	assert.Equal(t, 4*time.Second, policy.backoff(3, 0, 0))
+	assert.Equal(t, 5*time.Second, policy.backoff(10, 0, 0))
+	assert.Equal(t, 2500*time.Millisecond, policy.backoff(10, 0, 1))
+	assert.Equal(t, 8*time.Second, policy.backoff(1, 8*time.Second, 0))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 7*time.Second, parseRetryAfter("7", now))
+	assert.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
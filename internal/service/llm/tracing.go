@@ -0,0 +1,39 @@
+package llm
+
+import (
+	"context"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Tracing 每次模型调用一个 span, 放在 Meter 之外才能拿到实际使用的模型和费用
+type Tracing struct {
+	next Invoker
+}
+
+func NewTracing(next Invoker) *Tracing {
+	return &Tracing{next: next}
+}
+
+func (t *Tracing) Invoke(ctx context.Context, req domain.LLMRequest) (domain.LLMResponse, error) {
+	ctx, span := tracing.Start(ctx, "llm.invoke",
+		attribute.Int("llm.request.messages", len(req.Msgs)),
+		attribute.Int("llm.request.tools", len(req.Tools)),
+	)
+
+	resp, err := t.next.Invoke(ctx, req)
+	if err == nil {
+		span.SetAttributes(
+			attribute.String("llm.model", resp.Model),
+			attribute.Int("llm.usage.prompt_tokens", resp.Usage.PromptTokens),
+			attribute.Int("llm.usage.cached_tokens", resp.Usage.CachedTokens),
+			attribute.Int("llm.usage.completion_tokens", resp.Usage.CompletionTokens),
+			attribute.Int("llm.usage.total_tokens", resp.Usage.TotalTokens),
+			attribute.Float64("llm.usage.cost", resp.Usage.Cost),
+			attribute.Int("llm.response.tool_calls", len(resp.ToolCalls)),
+		)
+	}
+	tracing.End(span, err)
+	return resp, err
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/service/llm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"time"
+)
+
+type exitCodeKey struct{}
+
+type exitCode struct {
+	code int
+	set  bool
+}
+
+// withExitCode bash 和 golang_execute 通过 ctx 返回退出码, 工具的中间件只能看到输出
+func withExitCode(ctx context.Context) (context.Context, *exitCode) {
+	exit := &exitCode{}
+	return context.WithValue(ctx, exitCodeKey{}, exit), exit
+}
+
+func setExitCode(ctx context.Context, code int) {
+	if exit, ok := ctx.Value(exitCodeKey{}).(*exitCode); ok {
+		exit.code, exit.set = code, true
+	}
+}
+
+// newBus 创建事件总线, 默认把 step 和工具调用的进度记录到日志
+func newBus() *event.Bus {
+	bus := event.NewBus()
+	bus.Subscribe(logEvent)
+	return bus
+}
+
+func logEvent(ctx context.Context, ev event.Event) {
+	switch ev := ev.(type) {
+	case *event.StepChanged:
+		switch ev.Step.State {
+		case domain.IN_PROGRESS:
+			slog.InfoContext(ctx, "step started")
+		case domain.COMPLETED:
+			slog.InfoContext(ctx, "step completed", "tool_calls", len(ev.Step.ToolCalls), "llm_calls", len(ev.Step.LLMCalls))
+		case domain.BLOCKED, domain.ABORTED:
+			attrs := []any{"state", ev.Step.State}
+			// 失败的原因是 step 的最后一条记录
+			if n := len(ev.Step.Notes); n != 0 {
+				attrs = append(attrs, "error", ev.Step.Notes[n-1])
+			}
+			slog.WarnContext(ctx, "step failed", attrs...)
+		}
+	case *event.ToolFinished:
+		record := ev.Record
+		attrs := []any{"tool", record.Name, "call_id", record.Id, "duration", record.Duration}
+		if record.ExitCode != nil {
+			attrs = append(attrs, "exit_code", *record.ExitCode)
+		}
+		if record.Decision != "" {
+			attrs = append(attrs, "decision", record.Decision)
+		}
+		slog.InfoContext(ctx, "tool call", attrs...)
+	}
+}
+
+// observe 把事件转换成 Observer 的回调, 通过 PlanService.Subscribe 只接收一个 session 的事件
+func observe(observer Observer) event.Handler {
+	return func(ctx context.Context, ev event.Event) {
+		switch ev := ev.(type) {
+		case *event.StepChanged:
+			observer.OnStep(ev.Index, ev.Step)
+		case *event.ToolFinished:
+			observer.OnToolCall(ev.Record)
+		}
+	}
+}
+
+// invoke 调用模型, 调用前后分别发布请求和回复
+func invoke(ctx context.Context, bus *event.Bus, session string, handler llm.Invoker, req domain.LLMRequest) (domain.LLMResponse, error) {
+	bus.Publish(ctx, &event.LLMRequest{Meta: event.Meta{Session: session}, Request: req})
+
+	start := time.Now()
+	resp, err := handler.Invoke(ctx, req)
+	response := &event.LLMResponse{Meta: event.Meta{Session: session}, Response: resp, Duration: time.Since(start)}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	bus.Publish(ctx, response)
+	return resp, err
+}
+
+// endTool 非 0 的退出码和被拒绝的调用都标记为错误
+func endTool(span trace.Span, record domain.ToolCallRecord) {
+	if record.ExitCode != nil {
+		span.SetAttributes(attribute.Int("tool.exit_code", *record.ExitCode))
+		if *record.ExitCode != 0 {
+			span.SetStatus(codes.Error, fmt.Sprintf("exit status %d", *record.ExitCode))
+		}
+	}
+	if record.Decision != "" {
+		span.SetAttributes(attribute.String("tool.decision", record.Decision))
+	}
+	if record.Decision == policy.DENY {
+		span.SetStatus(codes.Error, "denied")
+	}
+	span.End()
+}
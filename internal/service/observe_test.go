@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/logging"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"log/slog"
+	"testing"
+)
+
+func TestExecuteLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.Config{Level: "info", Format: "text"})
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	fake := newFakePlan().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "exit 3"}`))).
+		Then(llmtest.Text("done")).
+		Then(llmtest.Text("done"))
+	invoker := llm.NewLogger(fake)
+	plan := NewPlanService(invoker, NewPlanExecutor(invoker, WithWorkspace(t.TempDir())))
+
+	_, err = plan.Plan(context.Background(), "write a file")
+	require.NoError(t, err)
+	require.NoError(t, plan.Run(context.Background()))
+
+	logs := buf.String()
+	assert.Contains(t, logs, "msg=\"tool call\" tool=bash")
+	assert.Contains(t, logs, "exit_code=3 session_id="+plan.Id+" plan_id="+plan.Id+" step=0")
+	assert.Contains(t, logs, "msg=\"llm call\"")
+	assert.Contains(t, logs, "step=1")
+}
+
+func TestExecuteEvents(t *testing.T) {
+	fake := newFakePlan().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "exit 3"}`))).
+		Then(llmtest.Text("done")).
+		Then(llmtest.Text("done"))
+	plan := NewPlanService(fake, NewPlanExecutor(fake, WithWorkspace(t.TempDir())))
+
+	var events []event.Event
+	plan.Subscribe(func(ctx context.Context, ev event.Event) {
+		events = append(events, ev)
+	})
+
+	_, err := plan.Plan(context.Background(), "write a file")
+	require.NoError(t, err)
+	require.NoError(t, plan.Run(context.Background()))
+
+	var types []string
+	for _, ev := range events {
+		assert.Equal(t, plan.Id, ev.Metadata().Session)
+		types = append(types, ev.Type())
+	}
+	assert.Equal(t, []string{
+		event.LLM_REQUEST, event.LLM_RESPONSE, event.PLAN_CREATED, event.PLAN_STARTED,
+		event.STEP_CHANGED, event.LLM_REQUEST, event.LLM_RESPONSE, event.TOOL_STARTED, event.TOOL_FINISHED,
+		event.LLM_REQUEST, event.LLM_RESPONSE, event.STEP_CHANGED,
+		event.STEP_CHANGED, event.LLM_REQUEST, event.LLM_RESPONSE, event.STEP_CHANGED,
+		event.LLM_REQUEST, event.LLM_RESPONSE, event.PLAN_UPDATED, event.PLAN_FINISHED,
+	}, types)
+
+	tool := events[8].(*event.ToolFinished)
+	assert.Equal(t, metrics.FAILED, tool.Outcome)
+	require.NotNil(t, tool.Step)
+	assert.Equal(t, 0, *tool.Step)
+	assert.Nil(t, events[0].Metadata().Step)
+
+	step := events[11].(*event.StepChanged)
+	assert.Equal(t, domain.COMPLETED, step.Step.State)
+	assert.Equal(t, domain.COMPLETED, step.Plan.Steps[0].State)
+	assert.Equal(t, domain.FINISHED, events[len(events)-1].(*event.PlanFinished).Plan.Status)
+}
+
+func TestExecuteSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	fake := newFakePlan().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "exit 3"}`))).
+		Then(llmtest.Text("done")).
+		Then(llmtest.Text("done"))
+	invoker := llm.NewTracing(fake)
+	plan := NewPlanService(invoker, NewPlanExecutor(invoker, WithWorkspace(t.TempDir())))
+
+	_, err := plan.Plan(context.Background(), "write a file")
+	require.NoError(t, err)
+	require.NoError(t, plan.Run(context.Background()))
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	require.Len(t, spans["plan.create"], 1)
+	require.Len(t, spans["plan.execute"], 1)
+	require.Len(t, spans["plan.step"], 2)
+	// 生成 plan 1 次, 两个 step 3 次, 最后的总结 1 次
+	assert.Len(t, spans["llm.invoke"], 5)
+
+	execute := spans["plan.execute"][0]
+	step := spans["plan.step"][0]
+	assert.Equal(t, execute.SpanContext().SpanID(), step.Parent().SpanID())
+	assert.Contains(t, step.Attributes(), attribute.String("step.state", domain.COMPLETED))
+
+	tool := spans["tool.execute"][0]
+	assert.Equal(t, step.SpanContext().SpanID(), tool.Parent().SpanID())
+	assert.Contains(t, tool.Attributes(), attribute.String("tool.name", "bash"))
+	assert.Contains(t, tool.Attributes(), attribute.Int("tool.exit_code", 3))
+	assert.Equal(t, codes.Error, tool.Status().Code)
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/domain/params"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// outputDir 工作目录下保存完整工具输出的目录, 不会被当作产物
+	outputDir = ".outputs"
+	// 默认的工具输出上限, 大约 4K token
+	defaultOutputLimit = 16 * 1024
+	// view_file 默认返回的行数
+	defaultViewLines = 200
+)
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// truncate 超过 limit 时保留开头和结尾, 中间替换成 note, 尽量在换行的位置截断
+func truncate(output string, limit int, note string) string {
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	headSize := limit * 2 / 3
+	tailSize := limit - headSize
+
+	head := output[:headSize]
+	if i := strings.LastIndexByte(head, '\n'); i > headSize/2 {
+		head = head[:i+1]
+	}
+	tail := output[len(output)-tailSize:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 && i < tailSize/2 {
+		tail = tail[i+1:]
+	}
+
+	omitted := len(output) - len(head) - len(tail)
+	head = strings.ToValidUTF8(head, "")
+	tail = strings.ToValidUTF8(tail, "")
+	return fmt.Sprintf("%s\n... [%d bytes omitted. %s] ...\n%s", head, omitted, note, tail)
+}
+
+// limitOutput 输出太长时截断, 完整的输出保存到工作目录, 模型可以通过 view_file 分页查看
+func (p *PlanExecutor) limitOutput(id string, output string) string {
+	if p.outputLimit <= 0 || len(output) <= p.outputLimit {
+		return output
+	}
+
+	path, err := p.spill(id, output)
+	note := fmt.Sprintf("full output saved to %s, use view_file to read it", path)
+	if err != nil {
+		note = fmt.Sprintf("full output could not be saved: %v", err)
+	}
+	return truncate(output, p.outputLimit, note)
+}
+
+// spill 按照工具调用的 id 命名, 回放时生成的文件名和录制时一致
+func (p *PlanExecutor) spill(id string, output string) (string, error) {
+	if p.workspace == "" {
+		return "", errors.New("no workspace")
+	}
+
+	dir := filepath.Join(p.workspace, outputDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	name := unsafeName.ReplaceAllString(id, "_")
+	if name == "" {
+		name = "output"
+	}
+	rel := filepath.Join(outputDir, name+".txt")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(p.workspace, rel)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		rel = filepath.Join(outputDir, fmt.Sprintf("%s-%d.txt", name, i))
+	}
+
+	if err := os.WriteFile(filepath.Join(p.workspace, rel), []byte(output), 0o644); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// executeView 按行读取工作目录里的文件, 返回的内容不超过 outputLimit
+func (p *PlanExecutor) executeView(args string) string {
+	var view struct {
+		Path   string `json:"path"`
+		Offset int    `json:"offset"`
+		Limit  int    `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(args), &view); err != nil {
+		return fmt.Sprintf("response format umarshal failed: %s", err.Error())
+	}
+	if view.Offset < 1 {
+		view.Offset = 1
+	}
+	if view.Limit <= 0 {
+		view.Limit = defaultViewLines
+	}
+
+	path, err := p.resolve(view.Path)
+	if err != nil {
+		return err.Error()
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line, last := 0, 0
+	for scanner.Scan() {
+		line++
+		if line < view.Offset || line >= view.Offset+view.Limit {
+			continue
+		}
+		text := fmt.Sprintf("%6d| %s\n", line, scanner.Text())
+		if p.outputLimit > 0 && b.Len()+len(text) > p.outputLimit && last != 0 {
+			continue
+		}
+		b.WriteString(text)
+		last = line
+	}
+	if err = scanner.Err(); err != nil {
+		return err.Error()
+	}
+
+	if last == 0 {
+		return fmt.Sprintf("%s has %d lines, nothing at line %d", view.Path, line, view.Offset)
+	}
+	fmt.Fprintf(&b, "(lines %d-%d of %d)", view.Offset, last, line)
+	return b.String()
+}
+
+// resolve 只允许访问工作目录里的文件, 包括通过符号链接指向外面的情况
+func (p *PlanExecutor) resolve(path string) (string, error) {
+	if p.workspace == "" {
+		return "", errors.New("view_file needs a workspace")
+	}
+
+	root, err := filepath.EvalSymlinks(p.workspace)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the workspace", path)
+	}
+	return real, nil
+}
+
+func (p *PlanExecutor) newViewTool() domain.Tool {
+	return domain.Tool{
+		Type: "function",
+		Function: domain.Function{
+			Name: "view_file",
+			Description: `View a text file in the workspace with line numbers, page by page.
+Use it to read long tool outputs that were truncated and saved to a file, passing offset to continue where the previous page ended.`,
+			Parameters: &domain.FunctionParameters{
+				Properties: params.NewViewParams(),
+				Required:   []string{"path"},
+			},
+		},
+	}
+}
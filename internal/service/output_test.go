@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 100, "note"))
+
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %02d", i))
+	}
+	output := truncate(strings.Join(lines, "\n"), 120, "note")
+	assert.True(t, strings.HasPrefix(output, "line 00\n"))
+	assert.True(t, strings.HasSuffix(output, "\nline 99"))
+	assert.Contains(t, output, "bytes omitted. note]")
+
+	// 截断的位置不会留下半个字符
+	output = truncate(strings.Repeat("执行", 100), 31, "note")
+	assert.True(t, strings.HasPrefix(output, "执行"))
+	assert.NotContains(t, output, "�")
+}
+
+func TestOutputSpill(t *testing.T) {
+	workspace := t.TempDir()
+	p := NewPlanExecutor(nil, WithWorkspace(workspace), WithOutputLimit(100))
+
+	var b strings.Builder
+	for i := 1; i <= 50; i++ {
+		fmt.Fprintf(&b, "row %d\n", i)
+	}
+	record := &domain.ToolCallRecord{Id: "call_1", Name: "bash", Arguments: `{"command": "for i in $(seq 1 50); do echo row $i; done"}`}
+	_, err := p.executeTool(context.Background(), record)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(record.Output), 200)
+	assert.Contains(t, record.Output, "full output saved to .outputs/call_1.txt")
+
+	data, err := os.ReadFile(filepath.Join(workspace, ".outputs", "call_1.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), string(data))
+
+	// 保存的输出不会被当作产物
+	assert.Empty(t, p.snapshot())
+
+	// 通过 view_file 分页读取完整的输出, 结果本身不会再被截断
+	view := &domain.ToolCallRecord{Id: "call_2", Name: "view_file", Arguments: `{"path": ".outputs/call_1.txt", "offset": 10, "limit": 3}`}
+	_, err = p.executeTool(context.Background(), view)
+	require.NoError(t, err)
+	assert.Equal(t, "    10| row 10\n    11| row 11\n    12| row 12\n(lines 10-12 of 50)", view.Output)
+}
+
+func TestViewOutsideWorkspace(t *testing.T) {
+	workspace := t.TempDir()
+	p := NewPlanExecutor(nil, WithWorkspace(workspace))
+
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(outside, []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(workspace, "link.txt")))
+
+	for _, path := range []string{"../secret.txt", outside, "link.txt"} {
+		output := p.executeView(fmt.Sprintf(`{"path": %q}`, path))
+		assert.NotContains(t, output, "secret\n", path)
+	}
+	assert.Contains(t, p.executeView(`{"path": "link.txt"}`), "outside the workspace")
+
+	output := NewPlanExecutor(nil).executeView(`{"path": "a.txt"}`)
+	assert.Equal(t, "view_file needs a workspace", output)
+}
@@ -2,35 +2,119 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/yumosx/agent/internal/domain"
 	"github.com/yumosx/agent/internal/domain/params"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/logging"
+	"github.com/yumosx/agent/internal/render"
 	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 	"regexp"
 	"strings"
-)
-
-const (
-	NO_STARTED  = "no_started"
-	IN_PROGRESS = "in_progress"
-	COMPLETED   = "completed"
-	BLOCKED     = "blocked"
+	"sync"
+	"time"
 )
 
 type PlanService struct {
 	Id       string
-	handler  *llm.Handler
-	plan     *domain.Plan
+	handler  llm.Invoker
 	executor *PlanExecutor
+	// bus 发布 plan 和 step 的变化, 保存、日志、指标等通过订阅处理
+	bus *event.Bus
+	// mu 保护 plan 的写入, 以及 Record 的读取
+	mu   sync.RWMutex
+	plan *domain.Plan
+	// spent session 所有模型调用的合计, plan 的合计只包含当前记录里的调用
+	spent domain.Usage
+	// budget 每次执行 plan 的预算
+	budget domain.Budget
+	// chatting Chat 和执行 plan 共用 executor 的上下文, 不能同时进行
+	chatting bool
+	// subscriptions session 存在期间一直有效的订阅, Close 时取消
+	subscriptions []func()
+}
+
+// Observer 接收 plan 执行过程中的进度
+type Observer interface {
+	// OnStep step 的状态发生变化
+	OnStep(index int, step domain.Step)
+	// OnToolCall 一次工具调用执行结束
+	OnToolCall(record domain.ToolCallRecord)
+}
+
+func NewPlanService(handler llm.Invoker, executor *PlanExecutor) *PlanService {
+	return newPlanService(newId(), handler, executor, newBus())
+}
+
+// newPlanService executor 发布的事件和 plan 使用同一个 bus 和 session id
+func newPlanService(id string, handler llm.Invoker, executor *PlanExecutor, bus *event.Bus) *PlanService {
+	executor.bus = bus
+	executor.session = id
+	return &PlanService{Id: id, handler: handler, executor: executor, bus: bus, plan: &domain.Plan{Id: id}}
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Observe 订阅这个 session 的进度通知, Close 时取消
+func (p *PlanService) Observe(observer Observer) {
+	p.keep(p.Subscribe(observe(observer)))
+}
+
+// Subscribe 接收这个 session 之后发布的事件, 返回的函数用来取消订阅
+func (p *PlanService) Subscribe(handler event.Handler) func() {
+	return p.bus.Subscribe(func(ctx context.Context, ev event.Event) {
+		if ev.Metadata().Session == p.Id {
+			handler(ctx, ev)
+		}
+	})
+}
+
+// keep 保存 session 存在期间一直有效的订阅
+func (p *PlanService) keep(cancel func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscriptions = append(p.subscriptions, cancel)
 }
 
-func NewPlanService(handler *llm.Handler, executor *PlanExecutor) *PlanService {
-	return &PlanService{handler: handler, executor: executor, plan: &domain.Plan{Id: "1"}}
+// Close 取消 session 的订阅, bus 被所有 session 共用, 不再使用的 session 需要关闭
+func (p *PlanService) Close() {
+	p.mu.Lock()
+	subscriptions := p.subscriptions
+	p.subscriptions = nil
+	p.mu.Unlock()
+
+	for _, cancel := range subscriptions {
+		cancel()
+	}
+}
+
+// Record 返回当前 plan 以及每个 step 执行记录的拷贝
+func (p *PlanService) Record() domain.Plan {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	plan := *p.plan
+	plan.Steps = make([]domain.Step, len(p.plan.Steps))
+	copy(plan.Steps, p.plan.Steps)
+	return plan
 }
 
-func (p *PlanService) Plan(ctx context.Context, s string) (string, error) {
+func (p *PlanService) Plan(ctx context.Context, s string) (plan string, err error) {
+	ctx = p.logContext(ctx)
+	ctx, span := tracing.Start(ctx, "plan.create", attribute.String("session.id", p.Id))
+	defer func() { tracing.End(span, err) }()
+
 	var req domain.LLMRequest
 
 	req.SystemContent = `You are a planning assistant. Create a concise, actionable plan with clear steps. 
@@ -42,19 +126,22 @@ Optimize for clarity and efficiency.`
 
 	req.Tools = []domain.Tool{p.newPlanTool()}
 
-	err := p.createInitPlan(ctx, req)
+	err = p.createInitPlan(ctx, req)
 	if err != nil {
 		return "", err
 	}
-	plan := p.formatPlan()
+	plan = p.formatPlan()
+	span.SetAttributes(attribute.Int("plan.steps", len(p.Record().Steps)))
 	return plan, nil
 }
 
 func (p *PlanService) createInitPlan(ctx context.Context, req domain.LLMRequest) error {
-	resp, err := p.handler.Invoke(ctx, req)
+	start := time.Now()
+	resp, err := invoke(ctx, p.bus, p.Id, p.handler, req)
 	if err != nil {
 		return err
 	}
+	call := domain.LLMCall{Model: resp.Model, Usage: resp.Usage, StartedAt: start, Duration: time.Since(start)}
 
 	if len(resp.ToolCalls) == 0 {
 		return errors.New("LLM 返回的 toolCalls 为空")
@@ -62,36 +149,277 @@ func (p *PlanService) createInitPlan(ctx context.Context, req domain.LLMRequest)
 
 	for _, t := range resp.ToolCalls {
 		if t.Function.Name == "planning" {
-			return p.initPlanWithArgs(t.Function.Arguments)
+			if err = p.initPlanWithArgs(t.Function.Arguments); err != nil {
+				return err
+			}
+			p.recordCall(call)
+			p.bus.Publish(ctx, &event.PlanCreated{Meta: event.Meta{Session: p.Id}, Plan: p.Record()})
+			return nil
 		}
 	}
 
 	return errors.New("LLM 返回的 Function name 非法")
 }
 
-func (p *PlanService) Execute(ctx context.Context) error {
-	var err error
+// Start 在后台执行 plan, 通过 Record 查看进度
+func (p *PlanService) Start() error {
+	ctx := context.Background()
+	if err := p.begin(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		p.finish(ctx, p.Execute(ctx))
+	}()
+	return nil
+}
+
+// Run 同步执行 plan, 和 Start 一样会更新 plan 的运行状态
+func (p *PlanService) Run(ctx context.Context) error {
+	if err := p.begin(ctx); err != nil {
+		return err
+	}
+
+	err := p.Execute(ctx)
+	p.finish(ctx, err)
+	return err
+}
+
+func (p *PlanService) begin(ctx context.Context) error {
+	p.mu.Lock()
+	if p.plan.Status != domain.PLANNED {
+		p.mu.Unlock()
+		return fmt.Errorf("plan 当前状态为 %s, 无法执行", p.plan.Status)
+	}
+	if p.chatting {
+		p.mu.Unlock()
+		return errors.New("正在对话, 无法执行")
+	}
+	p.plan.Status = domain.RUNNING
+	p.plan.Error = ""
+	p.plan.Exhausted = ""
+	p.mu.Unlock()
+
+	p.bus.Publish(ctx, &event.PlanStarted{Meta: event.Meta{Session: p.Id}, Plan: p.Record()})
+	return nil
+}
+
+func (p *PlanService) finish(ctx context.Context, err error) {
+	p.mu.Lock()
+	if err != nil {
+		p.plan.Status = domain.FAILED
+		p.plan.Error = err.Error()
+	} else {
+		p.plan.Status = domain.FINISHED
+	}
+	p.mu.Unlock()
+
+	p.bus.Publish(ctx, &event.PlanFinished{Meta: event.Meta{Session: p.Id}, Plan: p.Record()})
+}
+
+// restore 恢复保存的 plan, 中断或者失败的 step 重新执行
+func (p *PlanService) restore(plan domain.Plan) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.plan.Status == domain.RUNNING {
+		return errors.New("plan 正在执行")
+	}
+
+	for i := range plan.Steps {
+		switch plan.Steps[i].State {
+		case domain.IN_PROGRESS, domain.BLOCKED, domain.ABORTED:
+			plan.Steps[i].State = domain.NO_STARTED
+		}
+	}
+	plan.Status = domain.PLANNED
+	plan.Error = ""
+	plan.Exhausted = ""
+	p.plan = &plan
+	// 之前的进程花费的部分只能从 plan 的记录里恢复
+	if p.spent == (domain.Usage{}) {
+		p.spent = plan.Usage
+	}
+	return nil
+}
+
+// Skip 跳过 index 对应的 step, 执行的时候不会再选中它
+func (p *PlanService) Skip(index int) error {
+	if err := p.editable(index); err != nil {
+		return err
+	}
+	return p.markStep(p.stepContext(p.logContext(context.Background()), index), index, domain.SKIPPED)
+}
+
+// Retry 清空 index 对应 step 的执行结果, 下一次执行的时候重新执行
+func (p *PlanService) Retry(index int) error {
+	if err := p.editable(index); err != nil {
+		return err
+	}
+	p.saveResult(index, domain.StepResult{})
+	return p.markStep(p.stepContext(p.logContext(context.Background()), index), index, domain.NO_STARTED)
+}
+
+// editable 执行中的 plan 不能修改, 已经结束的 plan 修改之后可以再次执行
+func (p *PlanService) editable(index int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.plan.Status == domain.RUNNING {
+		return errors.New("plan 正在执行")
+	}
+	if index < 0 || index >= len(p.plan.Steps) {
+		return errors.New("当前 step index 非法")
+	}
+	p.plan.Status = domain.PLANNED
+	return nil
+}
+
+// Chat 不经过 plan, 直接在 executor 的上下文里继续对话, plan 执行期间不能对话
+func (p *PlanService) Chat(ctx context.Context, msg string) (domain.StepResult, error) {
+	p.mu.Lock()
+	if p.plan.Status == domain.RUNNING {
+		p.mu.Unlock()
+		return domain.StepResult{}, fmt.Errorf("plan 当前状态为 %s, 无法执行", domain.RUNNING)
+	}
+	if p.chatting {
+		p.mu.Unlock()
+		return domain.StepResult{}, errors.New("正在对话, 无法执行")
+	}
+	p.chatting = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.chatting = false
+		p.mu.Unlock()
+	}()
+
+	ctx, span := tracing.Start(p.logContext(ctx), "chat", attribute.String("session.id", p.Id))
+	result, err := p.executor.Run(ctx, msg)
+	tracing.End(span, err)
+
+	p.mu.Lock()
+	p.spent = p.spent.Add(result.Usage())
+	p.mu.Unlock()
+	return result, err
+}
+
+// Execute 依次执行未完成的 step, 预算耗尽时剩下的 step 标记为 aborted 并返回 *BudgetError
+func (p *PlanService) Execute(ctx context.Context) (err error) {
+	ctx = p.logContext(ctx)
+	ctx, span := tracing.Start(ctx, "plan.execute", attribute.String("session.id", p.Id), attribute.String("plan.id", p.Record().Id))
+	defer func() {
+		if exhausted := p.Record().Exhausted; exhausted != "" {
+			span.SetAttributes(attribute.String("plan.budget_exhausted", exhausted))
+		}
+		tracing.End(span, err)
+	}()
+
+	tracker := newTracker(p.budget)
+	if p.budget.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.budget.MaxDuration)
+		defer cancel()
+	}
+	p.executor.tracker = tracker
+	defer func() { p.executor.tracker = nil }()
+
 	for {
-		var (
-			index int
-			step  string
-		)
-		index, step, err = p.getStepInfo()
-		if err != nil {
-			return err
+		if err = tracker.check(); err != nil {
+			return p.abort(ctx, err)
+		}
+		index, step := p.getStepInfo()
+		if index == -1 {
+			break
 		}
 		err = p.executeStep(ctx, p.executor, index, step)
 		if err != nil {
+			var budgetErr *BudgetError
+			if errors.As(err, &budgetErr) {
+				return p.abort(ctx, err)
+			}
 			return err
 		}
 		if index == len(p.plan.Steps)-1 {
 			break
 		}
 	}
+
+	// 所有 step 都执行完了, 预算不够生成总结时只记录耗尽的预算
+	if err = tracker.check(); err != nil {
+		_ = p.abort(ctx, err)
+		return nil
+	}
+	return tracker.wrap(ctx, p.finalize(ctx))
+}
+
+// abort 记录耗尽的预算, 还没有执行的 step 标记为 aborted
+func (p *PlanService) abort(ctx context.Context, err error) error {
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		return err
+	}
+
+	p.mu.Lock()
+	p.plan.Exhausted = budgetErr.Budget
+	var remaining []int
+	for i, step := range p.plan.Steps {
+		if step.State == domain.NO_STARTED {
+			remaining = append(remaining, i)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, i := range remaining {
+		if markErr := p.markStep(p.stepContext(ctx, i), i, domain.ABORTED); markErr != nil {
+			return markErr
+		}
+	}
+	return err
+}
+
+// finalize 所有 step 执行完之后, 让模型根据 plan 和每个 step 的结果生成总结
+func (p *PlanService) finalize(ctx context.Context) error {
+	var req domain.LLMRequest
+
+	req.SystemContent = `You are a reporting assistant. Summarize the outcome of an executed plan for readers who did not watch the run.
+Be concise: state what was achieved, key results of each step, produced files, and anything that failed or needs follow-up.`
+
+	req.Msgs = []domain.Msg{
+		{Role: domain.USER, Content: fmt.Sprintf("Write the final report for this plan:\n%s\n%s", p.formatPlan(), p.formatDetails())}}
+
+	start := time.Now()
+	resp, err := invoke(ctx, p.bus, p.Id, p.handler, req)
+	if err != nil {
+		return err
+	}
+	p.recordCall(domain.LLMCall{Model: resp.Model, Usage: resp.Usage, StartedAt: start, Duration: time.Since(start)})
+
+	p.mu.Lock()
+	p.plan.Summary = resp.Content
+	p.mu.Unlock()
+
+	p.bus.Publish(ctx, &event.PlanUpdated{Meta: event.Meta{Session: p.Id}, Plan: p.Record()})
 	return nil
 }
 
-func (p *PlanService) getStepInfo() (int, string, error) {
+// formatDetails 把每个 step 的总结和产物拼接起来, 用来生成最终报告
+func (p *PlanService) formatDetails() string {
+	output := "STEP RESULTS:\n"
+	for i, step := range p.plan.Steps {
+		output += fmt.Sprintf("step %d (%s): %s\n", i, step.State, step.Content)
+		if step.Summary != "" {
+			output += fmt.Sprintf("  summary: %s\n", step.Summary)
+		}
+		if len(step.Artifacts) != 0 {
+			output += fmt.Sprintf("  artifacts: %s\n", strings.Join(step.Artifacts, ", "))
+		}
+	}
+	return output
+}
+
+// getStepInfo 返回下一个还没有开始的 step, 没有时返回 -1
+func (p *PlanService) getStepInfo() (int, string) {
 	steps := p.plan.Steps
 
 	for i, step := range steps {
@@ -99,37 +427,59 @@ func (p *PlanService) getStepInfo() (int, string, error) {
 		match := re.FindStringSubmatch(step.Content)
 		if len(match) != 0 {
 			typeMath := match[1]
-			fmt.Printf("step %d type %s", i, typeMath)
+			slog.Debug("step type", "plan_id", p.Id, "step", i, "type", typeMath)
 		}
 
-		if step.State == NO_STARTED {
-			err := p.markStep(i, IN_PROGRESS)
-			if err != nil {
-				return 0, "", err
-			}
-			return i, step.Content, nil
+		if step.State == domain.NO_STARTED {
+			return i, step.Content
 		}
 	}
-	return -1, "", nil
+	return -1, ""
 }
 
-func (p *PlanService) executeStep(ctx context.Context, executor *PlanExecutor, index int, step string) error {
+func (p *PlanService) executeStep(ctx context.Context, executor *PlanExecutor, index int, step string) (err error) {
+	ctx = p.stepContext(ctx, index)
+	ctx, span := tracing.Start(ctx, "plan.step", attribute.Int("step.index", index), attribute.String("step.content", step))
+	defer func() {
+		span.SetAttributes(attribute.String("step.state", p.Record().Steps[index].State))
+		tracing.End(span, err)
+	}()
+
+	if err = p.markStep(ctx, index, domain.IN_PROGRESS); err != nil {
+		return err
+	}
+
 	plan := p.formatPlan()
 	stepPrompt := fmt.Sprintf(`
 CURRENT PLAN STATUS:
 %s
+%s
 YOUR CURRENT TASK:
 You are now working on step %d: %s
 Please execute this step using the appropriate tools. When you're done, provide a summary of what you accomplished.
-`, plan, index, step)
+`, plan, p.formatResults(), index, step)
 
-	str, err := executor.Run(ctx, stepPrompt)
+	result, err := executor.Run(ctx, stepPrompt)
+	err = executor.tracker.wrap(ctx, err)
 	if err != nil {
+		result.Notes = append(result.Notes, err.Error())
+	}
+	p.saveResult(index, result)
+
+	if err != nil {
+		// 预算耗尽打断的 step 没有失败, resume 的时候重新执行
+		state := domain.BLOCKED
+		var budgetErr *BudgetError
+		if errors.As(err, &budgetErr) {
+			state = domain.ABORTED
+		}
+		if markErr := p.markStep(ctx, index, state); markErr != nil {
+			return markErr
+		}
 		return err
 	}
 
-	fmt.Println(str)
-	err = p.markStep(index, COMPLETED)
+	err = p.markStep(ctx, index, domain.COMPLETED)
 
 	if err != nil {
 		return err
@@ -137,6 +487,69 @@ Please execute this step using the appropriate tools. When you're done, provide
 	return nil
 }
 
+// formatResults 把已经完成的 step 总结拼接起来, 作为后续 step 的上下文
+func (p *PlanService) formatResults() string {
+	output := ""
+	for i, step := range p.plan.Steps {
+		if step.State != domain.COMPLETED || step.Summary == "" {
+			continue
+		}
+		output += fmt.Sprintf("step %d: %s\n", i, step.Summary)
+	}
+
+	if output == "" {
+		return ""
+	}
+	return "PREVIOUS STEP RESULTS:\n" + output
+}
+
+func (p *PlanService) saveResult(index int, result domain.StepResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= len(p.plan.Steps) {
+		return
+	}
+	step := &p.plan.Steps[index]
+	step.Summary = result.Summary
+	step.Notes = result.Notes
+	step.ToolCalls = result.ToolCalls
+	step.LLMCalls = result.LLMCalls
+	step.Usage = result.Usage()
+	step.Artifacts = result.Artifacts
+	p.plan.Usage = p.plan.TotalUsage()
+	p.spent = p.spent.Add(step.Usage)
+}
+
+// recordCall 记录不属于任何 step 的模型调用
+func (p *PlanService) recordCall(call domain.LLMCall) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.plan.LLMCalls = append(p.plan.LLMCalls, call)
+	p.plan.Usage = p.plan.TotalUsage()
+	p.spent = p.spent.Add(call.Usage)
+}
+
+// logContext 这个 session 里的日志都带上 session 和 plan 的 id
+func (p *PlanService) logContext(ctx context.Context) context.Context {
+	p.mu.RLock()
+	planId := p.plan.Id
+	p.mu.RUnlock()
+	return logging.With(ctx, "session_id", p.Id, "plan_id", planId)
+}
+
+// stepContext 之后的日志和事件都属于 index 这个 step
+func (p *PlanService) stepContext(ctx context.Context, index int) context.Context {
+	return event.WithStep(logging.With(ctx, "step", index), index)
+}
+
+// Usage session 创建以来所有模型调用的合计, 包括重新生成的 plan、重试之前的 step 和 Chat
+func (p *PlanService) Usage() domain.Usage {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.spent
+}
+
 func (p *PlanService) newPlanTool() domain.Tool {
 	var t domain.Tool
 	t.Type = "function"
@@ -167,78 +580,56 @@ func (p *PlanService) initPlanWithArgs(args string) error {
 		return errors.New("args 非 create")
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.plan.Title = parsedArgs["title"].(string)
+	p.plan.Status = domain.PLANNED
+	p.plan.Summary = ""
+	p.plan.Error = ""
+	p.plan.LLMCalls = nil
+	p.plan.Usage = domain.Usage{}
 
 	steps := parsedArgs["steps"].([]interface{})
 	p.plan.Steps = make([]domain.Step, len(steps))
 	for i, step := range steps {
 		if s, ok := step.(string); ok {
-			p.plan.Steps[i] = domain.Step{State: NO_STARTED, Content: s}
+			p.plan.Steps[i] = domain.Step{State: domain.NO_STARTED, Content: s}
 		}
 	}
 	return nil
 }
 
-func (p *PlanService) markStep(index int, state string) error {
-	if index >= len(p.plan.Steps) {
+func (p *PlanService) markStep(ctx context.Context, index int, state string) error {
+	p.mu.Lock()
+	if index < 0 || index >= len(p.plan.Steps) {
+		p.mu.Unlock()
 		return errors.New("当前 step index 非法")
 	}
-	p.plan.Steps[index].State = state
-	return nil
-}
-
-func (p *PlanService) formatPlan() string {
-	output := fmt.Sprintf("Plan: %s (ID: %s)\n", p.plan.Title, p.Id)
-	output += strings.Repeat("=", len(output)) + "\n\n"
-	total := len(p.plan.Steps)
-
-	noStarted := 0
-	progress := 0
-	completed := 0
-	blocked := 0
 
-	for _, step := range p.plan.Steps {
-		if step.State == NO_STARTED {
-			noStarted += 1
-		}
-
-		if step.State == IN_PROGRESS {
-			progress += 1
-		}
-
-		if step.State == COMPLETED {
-			completed += 1
-		}
-
-		if step.State == BLOCKED {
-			blocked += 1
+	now := time.Now()
+	step := &p.plan.Steps[index]
+	step.State = state
+	switch state {
+	case domain.NO_STARTED:
+		step.StartedAt = nil
+		step.FinishedAt = nil
+	case domain.IN_PROGRESS:
+		step.StartedAt = &now
+	case domain.COMPLETED, domain.BLOCKED, domain.SKIPPED:
+		step.FinishedAt = &now
+	case domain.ABORTED:
+		if step.StartedAt != nil {
+			step.FinishedAt = &now
 		}
 	}
+	changed := *step
+	p.mu.Unlock()
 
-	output += fmt.Sprintf("Progress: %d / %d steps completed ", completed, total)
-	if total > 0 {
-		percentage := float64(completed) / float64(total) * 100
-		output += fmt.Sprintf("(%.1f%%)\n", percentage)
-	} else {
-		output += "(0%)\n"
-	}
-
-	output += fmt.Sprintf("status: %d completed, %d progress, %d no strated, %d blocked", completed, progress, noStarted, blocked)
-	output += "Steps:\n"
+	p.bus.Publish(ctx, &event.StepChanged{Meta: event.Meta{Session: p.Id, Step: &index}, Index: index, Step: changed, Plan: p.Record()})
+	return nil
+}
 
-	statusSymbol := "[ ]"
-	for i, step := range p.plan.Steps {
-		switch step.State {
-		case NO_STARTED:
-			statusSymbol = "[-]"
-		case IN_PROGRESS:
-			statusSymbol = "[→]"
-		case COMPLETED:
-			statusSymbol = "[✓]"
-		case BLOCKED:
-			statusSymbol = "[!]"
-		}
-		output += fmt.Sprintf("%d. %s %s\n", i, statusSymbol, step.Content)
-	}
-	return output
+func (p *PlanService) formatPlan() string {
+	return render.Text(*p.plan)
 }
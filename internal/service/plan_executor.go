@@ -6,15 +6,47 @@ import (
 	"fmt"
 	"github.com/yumosx/agent/internal/domain"
 	"github.com/yumosx/agent/internal/domain/params"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/policy"
 	"github.com/yumosx/agent/internal/service/llm"
 	"github.com/yumosx/agent/internal/tool"
+	"github.com/yumosx/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
 	"time"
 )
 
 type PlanExecutor struct {
 	maxStep int
-	tools   []domain.Tool
-	handler *llm.Handler
+	// tools 开启的工具, terminate 总是开启
+	tools       []domain.Tool
+	bashTimeout time.Duration
+	handler     llm.Invoker
+	// 工具执行的工作目录, 为空时不记录产物
+	workspace string
+	// 执行工具之前的审批, 为空时直接执行
+	approver policy.Approver
+	// bash 命令的策略检查和审计, 为空时不检查
+	bashPolicy *policy.BashPolicy
+	audit      *policy.Audit
+	session    string
+	// 工具进程的资源限制
+	sandbox *tool.Sandbox
+	// 按照添加的顺序从外到内包装工具的执行
+	middlewares []domain.ToolMiddleware
+	// bus 发布模型调用和工具调用的事件, 由 PlanService 设置
+	bus *event.Bus
+	// 当前运行的预算, 由 PlanService 在执行 plan 的时候设置
+	tracker *tracker
+	// outputLimit 工具输出的上限, 单位字节, 超过时截断并保存完整的输出, 0 表示不限制
+	outputLimit int
+	// contextLimit 模型的上下文窗口, 估计的 token 数接近时压缩较早的消息, 0 表示不压缩
+	contextLimit int
 	// 用户模型的上下文
 	messages []domain.Msg
 	results  []string
@@ -26,20 +58,226 @@ const (
 If you want to stop the interaction at any point, use the "terminate" tool/function call.`
 )
 
-func NewPlanExecutor(handler *llm.Handler) *PlanExecutor {
-	return &PlanExecutor{handler: handler, messages: make([]domain.Msg, 0)}
+// defaultGoTimeout sandbox 没有配置 go_timeout 时 golang_execute 的超时时间
+const defaultGoTimeout = 60 * time.Second
+
+type ExecutorOption interface {
+	Option(p *PlanExecutor)
+}
+
+type ExecutorOptionFunc func(p *PlanExecutor)
+
+func (fn ExecutorOptionFunc) Option(p *PlanExecutor) {
+	fn(p)
+}
+
+func WithWorkspace(workspace string) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.workspace = workspace
+	})
+}
+
+func WithMaxStep(maxStep int) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.maxStep = maxStep
+	})
+}
+
+func WithApprover(approver policy.Approver) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.approver = approver
+	})
+}
+
+func WithBashPolicy(bashPolicy *policy.BashPolicy) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.bashPolicy = bashPolicy
+	})
+}
+
+// WithAudit 把 bash 命令的检查结果记录到审计日志, session 用来区分不同的任务
+func WithAudit(audit *policy.Audit, session string) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.audit = audit
+		p.session = session
+	})
+}
+
+func WithSandbox(sandbox *tool.Sandbox) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.sandbox = sandbox
+	})
+}
+
+func WithBashTimeout(timeout time.Duration) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.bashTimeout = timeout
+	})
+}
+
+// WithTools 只开启 names 里的工具
+func WithTools(names []string) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		tools := []domain.Tool{p.newTrimTool()}
+		for _, t := range p.allTools() {
+			for _, name := range names {
+				if t.Function.Name == name {
+					tools = append(tools, t)
+				}
+			}
+		}
+		p.tools = tools
+	})
+}
+
+// WithOutputLimit 工具输出的上限, 单位字节
+func WithOutputLimit(bytes int) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.outputLimit = bytes
+	})
+}
+
+// WithContextLimit 模型的上下文窗口大小, 单位 token
+func WithContextLimit(tokens int) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.contextLimit = tokens
+	})
 }
 
-func (p *PlanExecutor) Run(ctx context.Context, step string) (string, error) {
+// WithToolMiddleware 包装工具的执行, 先添加的在最外层
+func WithToolMiddleware(middlewares ...domain.ToolMiddleware) ExecutorOption {
+	return ExecutorOptionFunc(func(p *PlanExecutor) {
+		p.middlewares = append(p.middlewares, middlewares...)
+	})
+}
+
+func NewPlanExecutor(handler llm.Invoker, opts ...ExecutorOption) *PlanExecutor {
+	p := &PlanExecutor{handler: handler, maxStep: 10, bashTimeout: 20 * time.Second, outputLimit: defaultOutputLimit, messages: make([]domain.Msg, 0)}
+	p.tools = append([]domain.Tool{p.newTrimTool()}, p.allTools()...)
+
+	for _, opt := range opts {
+		opt.Option(p)
+	}
+
+	return p
+}
+
+// Run 执行一个 step, 直到模型调用 terminate、不再调用工具或者达到 maxStep
+func (p *PlanExecutor) Run(ctx context.Context, step string) (domain.StepResult, error) {
+	var result domain.StepResult
+
+	before := p.snapshot()
 	p.messages = append(p.messages, domain.Msg{Role: domain.USER, Content: step})
-	result, err := p.step(ctx)
-	if err != nil {
-		return "", err
+
+	for i := 0; i < p.maxStep; i++ {
+		done, err := p.step(ctx, &result)
+		if err != nil {
+			return result, err
+		}
+		if done {
+			break
+		}
 	}
+
+	result.Artifacts = p.artifacts(before)
 	return result, nil
 }
 
-func (p *PlanExecutor) step(ctx context.Context) (string, error) {
+func (p *PlanExecutor) step(ctx context.Context, result *domain.StepResult) (bool, error) {
+	req := p.request()
+	if err := p.fit(ctx, req, result); err != nil {
+		return false, err
+	}
+	req = p.request()
+	if err := p.tracker.check(); err != nil {
+		return false, err
+	}
+	start := time.Now()
+	resp, err := invoke(ctx, p.bus, p.session, p.handler, req)
+	if err != nil {
+		return false, err
+	}
+	p.tracker.addCall(resp.Usage)
+	result.LLMCalls = append(result.LLMCalls, domain.LLMCall{Model: resp.Model, Usage: resp.Usage, StartedAt: start, Duration: time.Since(start)})
+
+	p.messages = append(p.messages, domain.Msg{Role: domain.ASSISTANT, Content: resp.Content, ToolCalls: resp.ToolCalls})
+
+	if resp.Content != "" {
+		result.Notes = append(result.Notes, resp.Content)
+		result.Summary = resp.Content
+	}
+
+	if len(resp.ToolCalls) == 0 {
+		return true, nil
+	}
+
+	done := false
+	// 预算耗尽或者等待审批时被取消之后剩下的工具调用不再执行, 但是仍然要返回结果, 保证每个调用都有对应的结果,
+	// 否则之后的请求里 assistant 的 tool_calls 没有对应的 tool 消息, 会被模型接口拒绝
+	var exhausted, failed error
+	for _, t := range resp.ToolCalls {
+		record := domain.ToolCallRecord{
+			Id:        t.ID,
+			Name:      t.Function.Name,
+			Arguments: t.Function.Arguments,
+			StartedAt: time.Now(),
+		}
+		outcome := metrics.OK
+		toolCtx, span := tracing.Start(ctx, "tool.execute", attribute.String("tool.name", record.Name), attribute.String("tool.call_id", record.Id))
+		p.bus.Publish(toolCtx, &event.ToolStarted{Meta: event.Meta{Session: p.session}, Call: record})
+
+		switch {
+		case failed != nil:
+			record.Output = fmt.Sprintf("error: %s", failed.Error())
+			outcome = metrics.ABORTED
+		case exhausted != nil:
+			record.Output = exhausted.Error()
+			outcome = metrics.ABORTED
+		case !p.enabled(t.Function.Name):
+			record.Output = fmt.Sprintf("tool %s is not enabled", t.Function.Name)
+			outcome = metrics.DISABLED
+		case t.Function.Name == "terminate":
+			record.Output = p.executeTrim(t.Function.Arguments)
+			if result.Summary == "" {
+				result.Summary = record.Output
+			}
+			done = true
+		case t.Function.Name == "create_chat_completion":
+			record.Output = p.executeChat(t.Function.Arguments)
+			result.Notes = append(result.Notes, record.Output)
+			result.Summary = record.Output
+		default:
+			if exhausted = p.tracker.checkTool(); exhausted != nil {
+				record.Output = exhausted.Error()
+				outcome = metrics.ABORTED
+				break
+			}
+			var err error
+			if outcome, err = p.executeTool(toolCtx, &record); err != nil {
+				failed = err
+				record.Output = fmt.Sprintf("error: %s", err.Error())
+				outcome = metrics.ABORTED
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+
+		record.Duration = time.Since(record.StartedAt)
+		p.bus.Publish(toolCtx, &event.ToolFinished{Meta: event.Meta{Session: p.session}, Record: record, Outcome: outcome})
+		endTool(span, record)
+		result.ToolCalls = append(result.ToolCalls, record)
+		p.messages = append(p.messages, domain.Msg{Role: domain.TOOL, Id: t.ID, Content: record.Output})
+	}
+	if failed != nil {
+		return false, failed
+	}
+	if exhausted != nil {
+		return false, exhausted
+	}
+	return done, nil
+}
+
+func (p *PlanExecutor) request() domain.LLMRequest {
 	var req domain.LLMRequest
 	req.SystemContent = system
 
@@ -52,30 +290,170 @@ func (p *PlanExecutor) step(ctx context.Context) (string, error) {
 		Role:    domain.USER,
 		Content: nextStep,
 	})
-	req.Tools = []domain.Tool{p.newChatTool(), p.newTrimTool(), p.newGoTool(), p.newBashTool()}
-	resp, err := p.handler.Invoke(ctx, req)
-	if err != nil {
+	req.Tools = p.tools
+	return req
+}
+
+// allTools terminate 之外可以开启的工具
+func (p *PlanExecutor) allTools() []domain.Tool {
+	return []domain.Tool{p.newChatTool(), p.newGoTool(), p.newBashTool(), p.newViewTool()}
+}
+
+func (p *PlanExecutor) enabled(name string) bool {
+	for _, t := range p.tools {
+		if t.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// executeTool 审批通过之后执行 bash 或 golang_execute, 返回调用的结果, 用来记录指标
+func (p *PlanExecutor) executeTool(ctx context.Context, record *domain.ToolCallRecord) (string, error) {
+	if !p.checkPolicy(record) {
+		return metrics.BLOCKED, nil
+	}
+
+	if err := p.approve(ctx, record); err != nil {
 		return "", err
 	}
+	if record.Decision == policy.DENY {
+		return metrics.DENIED, nil
+	}
+	// 编辑之后的命令需要重新检查
+	if record.Decision == policy.EDIT && !p.checkPolicy(record) {
+		return metrics.BLOCKED, nil
+	}
 
-	p.messages = append(p.messages, domain.Msg{Role: domain.ASSISTANT, Content: resp.Content})
+	run := p.runTool
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		run = p.middlewares[i](run)
+	}
+	runCtx, exit := withExitCode(ctx)
+	record.Output = run(runCtx, record.Name, record.Arguments)
+	if exit.set {
+		record.ExitCode = &exit.code
+	}
+	if record.Name != "view_file" {
+		record.Output = p.limitOutput(record.Id, record.Output)
+	}
+	if record.ExitCode != nil && *record.ExitCode != 0 {
+		return metrics.FAILED, nil
+	}
+	return metrics.OK, nil
+}
 
-	toolCalls := resp.ToolCalls
-	var result string
+func (p *PlanExecutor) runTool(ctx context.Context, name string, args string) string {
+	switch name {
+	case "golang_execute":
+		output, code := p.executeCode(args)
+		setExitCode(ctx, code)
+		return output
+	case "bash":
+		output, code := p.executeBash(args)
+		setExitCode(ctx, code)
+		return output
+	case "view_file":
+		return p.executeView(args)
+	default:
+		return fmt.Sprintf("unknown tool: %s", name)
+	}
+}
 
-	for _, t := range toolCalls {
-		switch t.Function.Name {
-		case "terminate":
-			return t.Function.Arguments, nil
-		case "golang_execute":
-			p.executeCode(t.Function.Arguments)
-		case "bash":
-			p.executeBash(t.Function.Arguments)
-		default:
-			continue
+// checkPolicy 检查 bash 命令是否违反策略, 违反时把原因作为工具的错误返回给模型, 没有配置策略时只禁止内置的危险命令
+func (p *PlanExecutor) checkPolicy(record *domain.ToolCallRecord) bool {
+	if record.Name != "bash" {
+		return true
+	}
+	bash := p.bashPolicy
+	if bash == nil {
+		bash = policy.DefaultBashPolicy()
+	}
+
+	var cmd map[string]string
+	if err := json.Unmarshal([]byte(record.Arguments), &cmd); err != nil {
+		record.Output = fmt.Sprintf("response format umarshal failed: %s", err.Error())
+		return false
+	}
+
+	entry := policy.AuditEntry{Session: p.session, Tool: record.Name, Command: cmd["command"], Allowed: true}
+	err := bash.Check(cmd["command"])
+	if err != nil {
+		entry.Allowed = false
+		entry.Reason = err.Error()
+		record.Output = fmt.Sprintf("error: %s", err.Error())
+	}
+
+	if p.audit != nil {
+		if auditErr := p.audit.Record(entry); auditErr != nil {
+			slog.Warn("write audit log failed", "session_id", p.session, "error", auditErr)
 		}
 	}
-	return result, nil
+	return err == nil
+}
+
+// approve 等待人工审批, 拒绝时把原因作为工具的输出返回给模型, 编辑时替换参数
+func (p *PlanExecutor) approve(ctx context.Context, record *domain.ToolCallRecord) error {
+	if p.approver == nil {
+		return nil
+	}
+
+	d, err := p.approver.Approve(ctx, record.Name, record.Arguments)
+	if err != nil {
+		return err
+	}
+
+	switch d.Action {
+	case policy.APPROVE:
+		record.Decision = policy.APPROVE
+	case policy.EDIT:
+		record.Decision = policy.EDIT
+		record.Arguments = d.Arguments
+	default:
+		record.Decision = policy.DENY
+		record.Output = fmt.Sprintf("the tool call was denied by the user: %s", d.Reason)
+	}
+	return nil
+}
+
+// snapshot 记录 workspace 下所有文件的修改时间
+func (p *PlanExecutor) snapshot() map[string]time.Time {
+	files := make(map[string]time.Time)
+	if p.workspace == "" {
+		return files
+	}
+
+	_ = filepath.WalkDir(p.workspace, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && d.Name() == outputDir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(p.workspace, path)
+		if err != nil {
+			return nil
+		}
+		files[rel] = info.ModTime()
+		return nil
+	})
+	return files
+}
+
+// artifacts 和 before 对比, 返回新建或者修改过的文件
+func (p *PlanExecutor) artifacts(before map[string]time.Time) []string {
+	var files []string
+	for path, mod := range p.snapshot() {
+		if old, ok := before[path]; !ok || mod.After(old) {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files
 }
 
 func (p *PlanExecutor) newChatTool() domain.Tool {
@@ -180,45 +558,64 @@ func (p *PlanExecutor) newFileWrite() domain.Tool {
 	}
 }
 
-func (p *PlanExecutor) executeTrim(status string) string {
-	return fmt.Sprintf("The interaction has been completed with status: %s", status)
+func (p *PlanExecutor) executeTrim(args string) string {
+	var status map[string]string
+	if err := json.Unmarshal([]byte(args), &status); err != nil {
+		return fmt.Sprintf("response format umarshal failed: %s", err.Error())
+	}
+	return fmt.Sprintf("The interaction has been completed with status: %s", status["status"])
+}
+
+func (p *PlanExecutor) executeChat(args string) string {
+	var chat map[string]string
+	if err := json.Unmarshal([]byte(args), &chat); err != nil {
+		return fmt.Sprintf("response format umarshal failed: %s", err.Error())
+	}
+	return chat["response"]
 }
 
-func (p *PlanExecutor) executeBash(args string) string {
+func (p *PlanExecutor) executeBash(args string) (string, int) {
 	var cmd map[string]string
 	if err := json.Unmarshal([]byte(args), &cmd); err != nil {
-		return fmt.Sprintf("response format umarshal failed: %s", err.Error())
+		return fmt.Sprintf("response format umarshal failed: %s", err.Error()), -1
 	}
 
 	c := cmd["command"]
 
-	bash := tool.NewBashSession(20 * time.Second)
-	err := bash.Start()
-	if err != nil {
-		return err.Error()
-	}
-
+	bash := tool.NewBashSession(p.bashTimeout, p.workspace, p.sandbox)
 	result, errOutput, err := bash.Run(c)
 
 	if err != nil {
-		return err.Error()
+		return err.Error(), bash.ExitCode()
 	}
 
 	if errOutput != "" {
-		return errOutput
+		return result + errOutput, bash.ExitCode()
 	}
 
-	return result
+	return result, bash.ExitCode()
 }
 
-func (p *PlanExecutor) executeCode(args string) string {
+func (p *PlanExecutor) executeCode(args string) (string, int) {
 	var code map[string]string
 	if err := json.Unmarshal([]byte(args), &code); err != nil {
-		return fmt.Sprintf("response format umarshal failed: %s", err.Error())
+		return fmt.Sprintf("response format umarshal failed: %s", err.Error()), -1
+	}
+
+	timeout := defaultGoTimeout
+	if p.sandbox != nil && p.sandbox.GoTimeout > 0 {
+		timeout = p.sandbox.GoTimeout
+	}
+	golang := tool.NewGoSession(timeout, p.sandbox)
+	result, errOutput, err := golang.Run(code["code"])
+
+	if err != nil {
+		return err.Error(), golang.ExitCode()
 	}
 
-	c := code["code"]
-	println(c)
+	if errOutput != "" {
+		return result + errOutput, golang.ExitCode()
+	}
 
-	return c
+	return result, golang.ExitCode()
 }
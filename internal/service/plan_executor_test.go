@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
+	"testing"
+)
+
+// approver 按照顺序返回审批结果
+type approver struct {
+	decisions []policy.Decision
+}
+
+func (a *approver) Approve(ctx context.Context, tool string, args string) (policy.Decision, error) {
+	d := a.decisions[0]
+	a.decisions = a.decisions[1:]
+	return d, nil
+}
+
+func TestExecutorTools(t *testing.T) {
+	bash := &policy.BashPolicy{Deny: []string{"sudo"}}
+
+	fake := llmtest.New().
+		Then(llmtest.Call("",
+			llmtest.Tool("bash", `{"command": "sudo ls"}`),
+			llmtest.Tool("bash", `{"command": "echo denied"}`),
+			llmtest.Tool("bash", `{"command": "echo original"}`),
+			llmtest.Tool("golang_execute", `{"code": "package main"}`),
+		)).
+		Then(llmtest.Call("done", llmtest.Tool("terminate", `{"status": "success"}`)))
+
+	executor := NewPlanExecutor(fake,
+		WithWorkspace(t.TempDir()),
+		WithBashPolicy(bash),
+		WithTools([]string{"bash"}),
+		WithApprover(&approver{decisions: []policy.Decision{
+			{Action: policy.DENY, Reason: "not now"},
+			{Action: policy.EDIT, Arguments: `{"command": "echo edited"}`},
+		}}))
+
+	result, err := executor.Run(context.Background(), "step")
+	require.NoError(t, err)
+	assert.Equal(t, "done", result.Summary)
+	require.Len(t, result.ToolCalls, 5)
+
+	assert.Contains(t, result.ToolCalls[0].Output, `command blocked by policy: "sudo" is denied`)
+	assert.Equal(t, policy.DENY, result.ToolCalls[1].Decision)
+	assert.Equal(t, "the tool call was denied by the user: not now", result.ToolCalls[1].Output)
+	assert.Equal(t, policy.EDIT, result.ToolCalls[2].Decision)
+	assert.Equal(t, "edited\n", result.ToolCalls[2].Output)
+	assert.Equal(t, "tool golang_execute is not enabled", result.ToolCalls[3].Output)
+
+	// 关闭的工具不会提供给模型
+	for _, tool := range fake.Requests()[0].Tools {
+		assert.Contains(t, []string{"terminate", "bash"}, tool.Function.Name)
+	}
+	assert.Equal(t, domain.TOOL, fake.Requests()[1].Msgs[5].Role)
+}
+
+func TestExecutorDefaultBashPolicy(t *testing.T) {
+	fake := llmtest.New().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "bash -c 'sudo ls'"}`))).
+		Then(llmtest.Call("done", llmtest.Tool("terminate", `{"status": "success"}`)))
+
+	// 没有配置 bash 策略时也会禁止内置的危险命令
+	executor := NewPlanExecutor(fake, WithWorkspace(t.TempDir()), WithTools([]string{"bash"}))
+
+	result, err := executor.Run(context.Background(), "step")
+	require.NoError(t, err)
+	require.Len(t, result.ToolCalls, 2)
+	assert.Contains(t, result.ToolCalls[0].Output, `command blocked by policy: "sudo" is denied`)
+}
+
+func TestExecutorBashStderr(t *testing.T) {
+	fake := llmtest.New().
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "echo out; echo err >&2"}`))).
+		Then(llmtest.Call("done", llmtest.Tool("terminate", `{"status": "success"}`)))
+
+	executor := NewPlanExecutor(fake, WithWorkspace(t.TempDir()), WithTools([]string{"bash"}))
+
+	result, err := executor.Run(context.Background(), "step")
+	require.NoError(t, err)
+	require.Len(t, result.ToolCalls, 2)
+	// 和 golang_execute 一样同时返回 stdout 和 stderr
+	assert.Equal(t, "out\nerr\n", result.ToolCalls[0].Output)
+}
+
+// canceled 等待审批的时候被取消
+type canceled struct{}
+
+func (canceled) Approve(ctx context.Context, tool string, args string) (policy.Decision, error) {
+	return policy.Decision{}, context.Canceled
+}
+
+func TestExecutorApproveCanceled(t *testing.T) {
+	fake := llmtest.New().
+		Then(llmtest.Call("",
+			llmtest.Tool("bash", `{"command": "echo a"}`),
+			llmtest.Tool("bash", `{"command": "echo b"}`),
+		)).
+		Then(llmtest.Call("done", llmtest.Tool("terminate", `{"status": "success"}`)))
+
+	executor := NewPlanExecutor(fake, WithWorkspace(t.TempDir()), WithTools([]string{"bash"}), WithApprover(canceled{}))
+	_, err := executor.Run(context.Background(), "step")
+	require.ErrorIs(t, err, context.Canceled)
+
+	// 每个工具调用都有对应的结果, 之后的请求仍然合法
+	msgs := executor.messages
+	require.Len(t, msgs, 4)
+	assert.Len(t, msgs[1].ToolCalls, 2)
+	for i, msg := range msgs[2:] {
+		assert.Equal(t, domain.TOOL, msg.Role)
+		assert.Equal(t, msgs[1].ToolCalls[i].ID, msg.Id)
+		assert.Equal(t, "error: context canceled", msg.Content)
+	}
+}
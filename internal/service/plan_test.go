@@ -2,17 +2,24 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/cohesion-org/deepseek-go"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
 	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/service/llm/llmtest"
 	"os"
 	"testing"
 )
 
 func TestPlanExecute(t *testing.T) {
 	token := os.Getenv("token")
+	if token == "" {
+		t.Skip("需要设置 token 环境变量才能调用真实的模型")
+	}
 	client := deepseek.NewClient(token)
-	handler := llm.NewHandler(client)
+	handler := llm.NewHandler(client, deepseek.DeepSeekChat)
 
 	executor := NewPlanExecutor(handler)
 	plan := NewPlanService(handler, executor)
@@ -26,3 +33,186 @@ func TestPlanExecute(t *testing.T) {
 	err = plan.Execute(context.Background())
 	require.NoError(t, err)
 }
+
+func newFakePlan() *llmtest.Fake {
+	return llmtest.New().
+		WhenOnce(llmtest.HasTool("planning"), llmtest.Call("",
+			llmtest.Tool("planning", `{"command": "create", "title": "hello", "steps": ["write a.txt", "show a.txt"]}`))).
+		When(llmtest.SystemContains("reporting assistant"), llmtest.Text("wrote and showed a.txt"))
+}
+
+func TestPlanExecuteFake(t *testing.T) {
+	fake := newFakePlan().
+		Then(llmtest.Call("writing the file", llmtest.Tool("bash", `{"command": "echo hi > a.txt"}`))).
+		Then(withModel(llmtest.Call("a.txt written", llmtest.Tool("terminate", `{"status": "success"}`)), "fallback/model")).
+		Then(llmtest.Call("", llmtest.Tool("bash", `{"command": "cat a.txt"}`))).
+		Then(llmtest.Text("a.txt contains hi"))
+
+	workspace := t.TempDir()
+	plan := NewPlanService(fake, NewPlanExecutor(fake, WithWorkspace(workspace)))
+	ctx := context.Background()
+
+	s, err := plan.Plan(ctx, "write a file")
+	require.NoError(t, err)
+	assert.Contains(t, s, "0. [-] write a.txt")
+
+	require.NoError(t, plan.Run(ctx))
+	assert.Zero(t, fake.Remaining())
+
+	record := plan.Record()
+	assert.Equal(t, domain.FINISHED, record.Status)
+	assert.Equal(t, "wrote and showed a.txt", record.Summary)
+
+	first := record.Steps[0]
+	assert.Equal(t, domain.COMPLETED, first.State)
+	assert.Equal(t, "a.txt written", first.Summary)
+	assert.Equal(t, []string{"writing the file", "a.txt written"}, first.Notes)
+	assert.Equal(t, []string{"a.txt"}, first.Artifacts)
+	require.Len(t, first.ToolCalls, 2)
+	assert.Equal(t, "bash", first.ToolCalls[0].Name)
+	require.NotNil(t, first.ToolCalls[0].ExitCode)
+	assert.Equal(t, 0, *first.ToolCalls[0].ExitCode)
+	require.NotNil(t, first.StartedAt)
+	require.NotNil(t, first.FinishedAt)
+	// 每次模型调用都记录了实际使用的模型, plan 和报告的调用记录在 plan 上
+	require.Len(t, first.LLMCalls, 2)
+	assert.Equal(t, "fallback/model", first.LLMCalls[1].Model)
+	assert.Len(t, record.LLMCalls, 2)
+
+	second := record.Steps[1]
+	assert.Equal(t, "a.txt contains hi", second.Summary)
+	assert.Equal(t, "hi\n", second.ToolCalls[0].Output)
+	assert.Empty(t, second.Artifacts)
+
+	// 第二个 step 的 prompt 里带上了第一个 step 的总结, 工具的输出也返回给了模型
+	requests := fake.Requests()
+	last := requests[len(requests)-2]
+	assert.True(t, llmtest.UserContains("PREVIOUS STEP RESULTS:\nstep 0: a.txt written")(last))
+	tool := last.Msgs[len(last.Msgs)-2]
+	assert.Equal(t, domain.TOOL, tool.Role)
+	assert.Equal(t, "hi\n", tool.Content)
+}
+
+func TestPlanExecuteError(t *testing.T) {
+	fake := newFakePlan().ThenError(errors.New("rate limited"))
+
+	plan := NewPlanService(fake, NewPlanExecutor(fake))
+	ctx := context.Background()
+
+	_, err := plan.Plan(ctx, "write a file")
+	require.NoError(t, err)
+	require.Error(t, plan.Run(ctx))
+
+	record := plan.Record()
+	assert.Equal(t, domain.FAILED, record.Status)
+	assert.Equal(t, "rate limited", record.Error)
+	assert.Equal(t, domain.BLOCKED, record.Steps[0].State)
+	assert.Equal(t, []string{"rate limited"}, record.Steps[0].Notes)
+	assert.Equal(t, domain.NO_STARTED, record.Steps[1].State)
+}
+
+func TestPlanEdit(t *testing.T) {
+	plan := NewPlanService(nil, NewPlanExecutor(nil))
+	require.NoError(t, plan.restore(domain.Plan{
+		Id:     plan.Id,
+		Status: domain.FINISHED,
+		Steps: []domain.Step{
+			{State: domain.COMPLETED, Content: "build", Summary: "ok"},
+			{State: domain.NO_STARTED, Content: "deploy"},
+		},
+	}))
+
+	require.NoError(t, plan.Skip(1))
+	require.NoError(t, plan.Retry(0))
+	assert.Error(t, plan.Skip(2))
+
+	record := plan.Record()
+	assert.Equal(t, domain.PLANNED, record.Status)
+	assert.Equal(t, domain.NO_STARTED, record.Steps[0].State)
+	assert.Empty(t, record.Steps[0].Summary)
+	assert.Equal(t, domain.SKIPPED, record.Steps[1].State)
+}
+
+func TestPlanChatBusy(t *testing.T) {
+	fake := llmtest.New().Then(llmtest.Text("hi"))
+	plan := NewPlanService(fake, NewPlanExecutor(fake))
+	require.NoError(t, plan.restore(domain.Plan{Id: plan.Id, Steps: []domain.Step{{State: domain.NO_STARTED, Content: "build"}}}))
+	ctx := context.Background()
+
+	// plan 执行期间对话会和执行争用 executor 的上下文
+	plan.plan.Status = domain.RUNNING
+	_, err := plan.Chat(ctx, "hello")
+	assert.EqualError(t, err, "plan 当前状态为 running, 无法执行")
+	assert.Equal(t, 1, fake.Remaining())
+
+	plan.plan.Status = domain.PLANNED
+	plan.chatting = true
+	assert.EqualError(t, plan.Run(ctx), "正在对话, 无法执行")
+	assert.Equal(t, domain.PLANNED, plan.Record().Status)
+
+	plan.chatting = false
+	result, err := plan.Chat(ctx, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hi", result.Summary)
+	assert.False(t, plan.chatting)
+}
+
+func withModel(resp domain.LLMResponse, model string) domain.LLMResponse {
+	resp.Model = model
+	return resp
+}
+
+func TestPlanBudget(t *testing.T) {
+	first := llmtest.Call("", llmtest.Tool("bash", `{"command": "echo a"}`), llmtest.Tool("bash", `{"command": "echo b"}`))
+	first.Usage = domain.Usage{TotalTokens: 10}
+	fake := newFakePlan().Then(first)
+
+	plan := NewPlanService(fake, NewPlanExecutor(fake, WithWorkspace(t.TempDir())))
+	plan.budget = domain.Budget{MaxToolCalls: 1}
+	ctx := context.Background()
+
+	_, err := plan.Plan(ctx, "write a file")
+	require.NoError(t, err)
+
+	err = plan.Run(ctx)
+	var budgetErr *BudgetError
+	require.ErrorAs(t, err, &budgetErr)
+	assert.Equal(t, "tool_calls", budgetErr.Budget)
+
+	record := plan.Record()
+	assert.Equal(t, domain.FAILED, record.Status)
+	assert.Equal(t, "tool_calls", record.Exhausted)
+	assert.Equal(t, domain.ABORTED, record.Steps[0].State)
+	assert.Equal(t, domain.ABORTED, record.Steps[1].State)
+	assert.Nil(t, record.Steps[1].StartedAt)
+	// 第二个工具调用没有执行, 但是仍然有结果返回给模型
+	require.Len(t, record.Steps[0].ToolCalls, 2)
+	assert.Equal(t, "a\n", record.Steps[0].ToolCalls[0].Output)
+	assert.Contains(t, record.Steps[0].ToolCalls[1].Output, "预算耗尽")
+
+	// resume 的时候 aborted 的 step 重新执行
+	require.NoError(t, plan.restore(record))
+	assert.Equal(t, domain.NO_STARTED, plan.Record().Steps[0].State)
+	assert.Empty(t, plan.Record().Exhausted)
+}
+
+func TestTracker(t *testing.T) {
+	spent := newTracker(domain.Budget{MaxTokens: 100, MaxLLMCalls: 3})
+	require.NoError(t, spent.check())
+
+	spent.addCall(domain.Usage{TotalTokens: 60})
+	require.NoError(t, spent.check())
+
+	spent.addCall(domain.Usage{TotalTokens: 60})
+	var budgetErr *BudgetError
+	require.ErrorAs(t, spent.check(), &budgetErr)
+	assert.Equal(t, "tokens", budgetErr.Budget)
+	assert.Equal(t, "预算耗尽: tokens 已使用 120, 上限 100", budgetErr.Error())
+
+	// 为空时不限制
+	var unlimited *tracker
+	assert.NoError(t, unlimited.checkTool())
+
+	merged := domain.Budget{MaxTokens: 100, MaxCost: 1}.Merge(&domain.Budget{MaxTokens: 500, MaxCost: 0.5, MaxToolCalls: 3})
+	assert.Equal(t, domain.Budget{MaxTokens: 100, MaxCost: 0.5, MaxToolCalls: 3}, merged)
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/metrics"
+	"github.com/yumosx/agent/internal/policy"
+	"github.com/yumosx/agent/internal/service/llm"
+	"github.com/yumosx/agent/internal/tool"
+	"github.com/yumosx/agent/internal/trajectory"
+	"github.com/yumosx/agent/internal/webhook"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session 一个任务对应的 plan、工作目录和审批
+type Session struct {
+	*PlanService
+	Gate      *policy.Gate
+	Workspace string
+	Sandbox   *tool.Sandbox
+	// Trajectory 为空时不记录运行轨迹
+	Trajectory *trajectory.Trajectory
+	// Owner 创建 session 的 API key 的名称, 没有开启认证时为空
+	Owner     string
+	CreatedAt time.Time
+}
+
+// SessionConfig 创建 session 时由调用方指定的配置
+type SessionConfig struct {
+	// Sandbox 和默认配置合并, 只能比默认配置更严格
+	Sandbox *tool.Sandbox `json:"sandbox"`
+	// Rules 在默认的审批规则之外追加的规则
+	Rules []policy.Rule `json:"-"`
+	// Budget 和默认预算合并, 只能比默认预算更严格
+	Budget *domain.Budget `json:"budget"`
+	// Webhooks 只接收这个 session 事件的 webhook
+	Webhooks []webhook.Endpoint `json:"webhooks"`
+	// Owner 由 handler 根据 API key 设置, 调用方不能指定
+	Owner string `json:"-"`
+}
+
+// Sessions 管理每个任务对应的 Session, 每个 session 有独立的工作目录和模型上下文
+type Sessions struct {
+	handler   llm.Invoker
+	workspace string
+	rules     []policy.Rule
+	bash      *policy.BashPolicy
+	audit     *policy.Audit
+	sandbox   *tool.Sandbox
+	budget    domain.Budget
+	executor  []ExecutorOption
+	store     *Store
+	metrics   *metrics.Metrics
+	// bus 所有 session 共用, 事件里带有 session 的 id
+	bus *event.Bus
+	// trajectories 保存运行轨迹的目录, 为空时不记录
+	trajectories string
+	// webhooks 为空时不投递 webhook
+	webhooks *webhook.Dispatcher
+
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+type SessionsOption interface {
+	Option(s *Sessions)
+}
+
+type SessionsOptionFunc func(s *Sessions)
+
+func (fn SessionsOptionFunc) Option(s *Sessions) {
+	fn(s)
+}
+
+// WithPolicy 命中 cfg.Approval 的工具调用需要人工审批, bash 命令按照 cfg.Bash 检查, audit 不为空时记录检查结果
+func WithPolicy(cfg *policy.Config, audit *policy.Audit) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.rules = cfg.Approval
+		s.bash = cfg.Bash
+		s.audit = audit
+	})
+}
+
+// WithDefaultSandbox 所有 session 的工具进程默认的资源限制
+func WithDefaultSandbox(sandbox *tool.Sandbox) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.sandbox = sandbox
+	})
+}
+
+// WithBudget 每个 session 每次执行 plan 的默认预算
+func WithBudget(budget domain.Budget) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.budget = budget
+	})
+}
+
+// WithMetrics 记录 session、plan、工具调用的指标
+func WithMetrics(m *metrics.Metrics) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.metrics = m
+	})
+}
+
+// WithTrajectory 把每个 session 的运行轨迹以 JSONL 格式保存到 dir 下
+func WithTrajectory(dir string) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.trajectories = dir
+	})
+}
+
+// WithWebhooks 把 plan 完成、step 阻塞、等待审批和执行失败的事件投递给 webhook
+func WithWebhooks(d *webhook.Dispatcher) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.webhooks = d
+	})
+}
+
+// WithExecutorOptions 创建每个 session 的 executor 时使用的配置
+func WithExecutorOptions(opts ...ExecutorOption) SessionsOption {
+	return SessionsOptionFunc(func(s *Sessions) {
+		s.executor = append(s.executor, opts...)
+	})
+}
+
+func NewSessions(handler llm.Invoker, workspace string, opts ...SessionsOption) *Sessions {
+	s := &Sessions{
+		handler:   handler,
+		workspace: workspace,
+		store:     NewStore(filepath.Join(workspace, ".plans")),
+		bus:       newBus(),
+		sessions:  make(map[string]*Session),
+	}
+
+	for _, opt := range opts {
+		opt.Option(s)
+	}
+
+	s.bus.Subscribe(s.store.Handle)
+	if s.metrics != nil {
+		s.bus.Subscribe(s.metrics.Handle)
+	}
+	if s.webhooks != nil {
+		s.bus.Subscribe(s.webhooks.Handle)
+	}
+	return s
+}
+
+// Webhooks 没有开启 webhook 时返回空
+func (s *Sessions) Webhooks() *webhook.Dispatcher {
+	return s.webhooks
+}
+
+// Subscribe 接收所有 session 之后发布的事件, 返回的函数用来取消订阅
+func (s *Sessions) Subscribe(handler event.Handler) func() {
+	return s.bus.Subscribe(handler)
+}
+
+func (s *Sessions) Create(cfg SessionConfig) (*Session, error) {
+	// 先注册 webhook, 失败时还没有创建工作目录和订阅
+	id := newId()
+	if err := s.register(id, cfg.Webhooks); err != nil {
+		return nil, err
+	}
+
+	session, err := s.newSession(id, cfg)
+	if err != nil {
+		s.unregister(id)
+		_ = os.RemoveAll(filepath.Join(s.workspace, id))
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[session.Id] = session
+	s.metrics.SetSessions(len(s.sessions))
+	s.mu.Unlock()
+	return session, nil
+}
+
+// Resume 从保存的 plan 恢复 session, 未完成的 step 会重新执行,
+// session 还在内存里时继续使用创建时的配置, 这时不能再指定 webhook
+func (s *Sessions) Resume(id string, cfg SessionConfig) (*Session, error) {
+	plan, err := s.store.Load(id)
+	if err != nil {
+		return nil, fmt.Errorf("加载 plan %s 失败: %w", id, err)
+	}
+
+	if session, ok := s.Get(plan.Id); ok {
+		if len(cfg.Webhooks) != 0 {
+			return nil, fmt.Errorf("session %s 已经存在, 不能再指定 webhook", plan.Id)
+		}
+		if err = session.restore(plan); err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+
+	if err = s.register(plan.Id, cfg.Webhooks); err != nil {
+		return nil, err
+	}
+	// 工作目录里是之前执行的结果, 失败时保留
+	session, err := s.newSession(plan.Id, cfg)
+	if err != nil {
+		s.unregister(plan.Id)
+		return nil, err
+	}
+	if err = session.restore(plan); err != nil {
+		session.Close()
+		s.unregister(plan.Id)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[session.Id] = session
+	s.metrics.SetSessions(len(s.sessions))
+	s.mu.Unlock()
+	return session, nil
+}
+
+// register 注册 session 自己的 webhook, 失败时删除已经注册的
+func (s *Sessions) register(id string, endpoints []webhook.Endpoint) error {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	if s.webhooks == nil {
+		return errors.New("没有开启 webhook")
+	}
+	for _, endpoint := range endpoints {
+		if err := s.webhooks.Register(id, endpoint); err != nil {
+			s.webhooks.Unregister(id)
+			return fmt.Errorf("webhook 配置错误: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Sessions) unregister(id string) {
+	if s.webhooks != nil {
+		s.webhooks.Unregister(id)
+	}
+}
+
+func (s *Sessions) newSession(id string, cfg SessionConfig) (*Session, error) {
+	workspace := filepath.Join(s.workspace, id)
+	if err := os.MkdirAll(workspace, 0o755); err != nil {
+		return nil, err
+	}
+
+	rules := append(append([]policy.Rule(nil), s.rules...), cfg.Rules...)
+	gate, err := policy.NewGate(rules, workspace)
+	if err != nil {
+		return nil, err
+	}
+	gate.Notify(func(req policy.Request) {
+		s.bus.Publish(context.Background(), &event.ApprovalRequired{Meta: event.Meta{Session: id}, Request: req})
+	})
+
+	var traj *trajectory.Trajectory
+	if s.trajectories != "" {
+		traj, err = trajectory.Open(s.trajectories, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sandbox := s.sandbox.Merge(cfg.Sandbox)
+	opts := append([]ExecutorOption{
+		WithWorkspace(workspace),
+		WithApprover(gate),
+		WithBashPolicy(s.bash),
+		WithAudit(s.audit, id),
+		WithSandbox(sandbox),
+	}, s.executor...)
+	executor := NewPlanExecutor(s.handler, opts...)
+
+	svc := newPlanService(id, s.handler, executor, s.bus)
+	svc.budget = s.budget.Merge(cfg.Budget)
+	if traj != nil {
+		svc.keep(svc.Subscribe(traj.Handle))
+	}
+	return &Session{
+		PlanService: svc,
+		Gate:        gate,
+		Workspace:   workspace,
+		Sandbox:     sandbox,
+		Trajectory:  traj,
+		Owner:       cfg.Owner,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// Delete 移除 session 并且取消它的订阅, 正在执行的 session 不能删除
+func (s *Sessions) Delete(id string) error {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("session 不存在")
+	}
+	if session.Record().Status == domain.RUNNING {
+		s.mu.Unlock()
+		return errors.New("plan 正在执行")
+	}
+	delete(s.sessions, id)
+	s.metrics.SetSessions(len(s.sessions))
+	s.mu.Unlock()
+
+	session.Close()
+	s.unregister(id)
+	return nil
+}
+
+func (s *Sessions) Get(id string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[id]
+	return session, ok
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/webhook"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionsDelete(t *testing.T) {
+	workspace := t.TempDir()
+	sessions := NewSessions(nil, workspace, WithTrajectory(filepath.Join(workspace, ".trajectories")))
+	session, err := sessions.Create(SessionConfig{})
+	require.NoError(t, err)
+
+	publish := func() {
+		sessions.bus.Publish(context.Background(), &event.PlanCreated{Meta: event.Meta{Session: session.Id}, Plan: domain.Plan{Title: "hello"}})
+	}
+	publish()
+	data, err := os.ReadFile(session.Trajectory.Path())
+	require.NoError(t, err)
+	assert.NotEmpty(t, data)
+
+	session.plan.Status = domain.RUNNING
+	assert.EqualError(t, sessions.Delete(session.Id), "plan 正在执行")
+	session.plan.Status = domain.FINISHED
+	require.NoError(t, sessions.Delete(session.Id))
+	_, ok := sessions.Get(session.Id)
+	assert.False(t, ok)
+	assert.EqualError(t, sessions.Delete(session.Id), "session 不存在")
+
+	// 删除之后取消了运行轨迹的订阅
+	publish()
+	after, err := os.ReadFile(session.Trajectory.Path())
+	require.NoError(t, err)
+	assert.Equal(t, data, after)
+}
+
+type stepRecorder struct {
+	steps []int
+}
+
+func (r *stepRecorder) OnStep(index int, step domain.Step) {
+	r.steps = append(r.steps, index)
+}
+
+func (r *stepRecorder) OnToolCall(record domain.ToolCallRecord) {}
+
+func TestObserveClose(t *testing.T) {
+	bus := newBus()
+	plan := newPlanService("1", nil, NewPlanExecutor(nil), bus)
+	other := newPlanService("2", nil, NewPlanExecutor(nil), bus)
+	observer := &stepRecorder{}
+	plan.Observe(observer)
+
+	ctx := context.Background()
+	bus.Publish(ctx, &event.StepChanged{Meta: event.Meta{Session: plan.Id}, Index: 0})
+	bus.Publish(ctx, &event.StepChanged{Meta: event.Meta{Session: other.Id}, Index: 1})
+	plan.Close()
+	bus.Publish(ctx, &event.StepChanged{Meta: event.Meta{Session: plan.Id}, Index: 2})
+
+	assert.Equal(t, []int{0}, observer.steps)
+}
+
+func TestSessionsCreateWebhook(t *testing.T) {
+	workspace := t.TempDir()
+	sessions := NewSessions(nil, workspace, WithWebhooks(webhook.New(webhook.DefaultConfig())))
+
+	_, err := sessions.Create(SessionConfig{Webhooks: []webhook.Endpoint{
+		{URL: "https://ci.example.com/hooks", Secret: "s"},
+		{URL: "http://169.254.169.254/latest/meta-data", Secret: "s"},
+	}})
+	assert.ErrorContains(t, err, "link-local")
+
+	// 注册失败时没有创建 session 的工作目录
+	entries, err := os.ReadDir(workspace)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	session, err := sessions.Create(SessionConfig{Webhooks: []webhook.Endpoint{{URL: "https://ci.example.com/hooks", Secret: "s"}}})
+	require.NoError(t, err)
+	assert.Len(t, sessions.Webhooks().Endpoints(session.Id), 1)
+	require.NoError(t, sessions.Delete(session.Id))
+	assert.Empty(t, sessions.Webhooks().Endpoints(session.Id))
+}
+
+func TestSessionsResumeWebhook(t *testing.T) {
+	sessions := NewSessions(nil, t.TempDir(), WithWebhooks(webhook.New(webhook.DefaultConfig())))
+	require.NoError(t, sessions.store.Save(domain.Plan{Id: "1", Title: "hello", Steps: []domain.Step{{Content: "say hello"}}}))
+
+	// 注册失败时不会留下 session 和已经注册的 webhook
+	_, err := sessions.Resume("1", SessionConfig{Webhooks: []webhook.Endpoint{
+		{URL: "https://ci.example.com/hooks", Secret: "s"},
+		{URL: "http://10.0.0.1/hooks", Secret: "s"},
+	}})
+	assert.ErrorContains(t, err, "webhook 配置错误")
+	_, ok := sessions.Get("1")
+	assert.False(t, ok)
+	assert.Empty(t, sessions.Webhooks().Endpoints("1"))
+
+	webhooks := []webhook.Endpoint{{URL: "https://ci.example.com/hooks", Secret: "s"}}
+	session, err := sessions.Resume("1", SessionConfig{Webhooks: webhooks})
+	require.NoError(t, err)
+	assert.Equal(t, webhooks, sessions.Webhooks().Endpoints(session.Id))
+
+	// 已经在内存里的 session 不会重新创建, 指定的 webhook 不能生效
+	_, err = sessions.Resume("1", SessionConfig{Webhooks: webhooks})
+	assert.Error(t, err)
+	resumed, err := sessions.Resume("1", SessionConfig{})
+	require.NoError(t, err)
+	assert.Same(t, session, resumed)
+	assert.Len(t, sessions.Webhooks().Endpoints(session.Id), 1)
+}
+
+func TestSessionConfigBudget(t *testing.T) {
+	var cfg SessionConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"budget": {"max_duration": "90s", "max_tokens": 100}}`), &cfg))
+	assert.Equal(t, &domain.Budget{MaxDuration: 90 * time.Second, MaxTokens: 100}, cfg.Budget)
+
+	// 和配置文件一样只接受时长字符串, 不接受没有单位的数字
+	assert.Error(t, json.Unmarshal([]byte(`{"budget": {"max_duration": 60}}`), &cfg))
+	assert.Error(t, json.Unmarshal([]byte(`{"budget": {"max_duration": "60"}}`), &cfg))
+
+	// 负数和 0 一样不能放宽默认的预算
+	merged := domain.Budget{MaxTokens: 100, MaxToolCalls: 10}.Merge(&domain.Budget{MaxTokens: -1, MaxToolCalls: 5, MaxLLMCalls: -1})
+	assert.Equal(t, domain.Budget{MaxTokens: 100, MaxToolCalls: 5}, merged)
+
+	data, err := json.Marshal(domain.Budget{MaxDuration: time.Minute, MaxCost: 0.5})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"max_duration": "1m0s", "max_cost": 0.5}`, string(data))
+}
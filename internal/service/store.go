@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Store 把 plan 以 JSON 文件的形式保存在 dir 下, 用来在重启之后恢复执行
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Store) Save(plan domain.Plan) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再 rename, 避免中断的时候留下不完整的文件
+	tmp := s.path(plan.Id) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(plan.Id))
+}
+
+// Handle 订阅 plan 的变化, 每次变化之后保存, 失败的时候不影响执行
+func (s *Store) Handle(ctx context.Context, ev event.Event) {
+	plan, ok := event.PlanOf(ev)
+	if !ok {
+		return
+	}
+
+	if err := s.Save(plan); err != nil {
+		slog.WarnContext(ctx, "save plan failed", "plan_id", plan.Id, "error", err)
+	}
+}
+
+func (s *Store) Load(id string) (domain.Plan, error) {
+	var plan domain.Plan
+
+	data, err := os.ReadFile(s.path(filepath.Base(id)))
+	if err != nil {
+		return plan, err
+	}
+
+	err = json.Unmarshal(data, &plan)
+	return plan, err
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	plan := domain.Plan{
+		Id:     "1",
+		Title:  "list files",
+		Status: domain.FAILED,
+		Steps: []domain.Step{
+			{State: domain.COMPLETED, Content: "run ls", Summary: "done"},
+			{State: domain.IN_PROGRESS, Content: "write report"},
+			{State: domain.BLOCKED, Content: "upload"},
+		},
+	}
+	require.NoError(t, store.Save(plan))
+
+	loaded, err := store.Load("1")
+	require.NoError(t, err)
+	assert.Equal(t, plan, loaded)
+
+	_, err = store.Load("2")
+	assert.Error(t, err)
+
+	svc := newPlanService("1", nil, NewPlanExecutor(nil), newBus())
+	require.NoError(t, svc.restore(loaded))
+
+	record := svc.Record()
+	assert.Equal(t, domain.PLANNED, record.Status)
+	assert.Equal(t, domain.COMPLETED, record.Steps[0].State)
+	assert.Equal(t, domain.NO_STARTED, record.Steps[1].State)
+	assert.Equal(t, domain.NO_STARTED, record.Steps[2].State)
+}
@@ -2,68 +2,56 @@ package tool
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os/exec"
 	"time"
 )
 
 type BashTool struct {
-	process  *exec.Cmd
-	sentinel string
-	timeout  time.Duration
+	dir     string
+	timeout time.Duration
+	sandbox *Sandbox
+	// exitCode 最近一次 Run 的退出码
+	exitCode int
 }
 
-func NewBashSession(timeout time.Duration) *BashTool {
-	return &BashTool{timeout: timeout, sentinel: "<<exit>>"}
-}
-
-func (bash *BashTool) Start() error {
-	bash.process = exec.Command("/bin/bash")
-	bash.process.Stdin = &bytes.Buffer{}
-	bash.process.Stdout = &bytes.Buffer{}
-	bash.process.Stderr = &bytes.Buffer{}
-
-	err := bash.process.Start()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (bash *BashTool) Stop() error {
-	if bash.process.ProcessState != nil && bash.process.ProcessState.Exited() {
-		return nil
-	}
-
-	return bash.process.Process.Kill()
+// NewBashSession sandbox 为空时不限制资源, 但是超时的时候仍然会 kill 整个进程组
+func NewBashSession(timeout time.Duration, dir string, sandbox *Sandbox) *BashTool {
+	return &BashTool{timeout: timeout, dir: dir, sandbox: sandbox}
 }
 
+// Run 在 dir 目录下执行 cmd, 返回 stdout 和 stderr
 func (bash *BashTool) Run(cmd string) (string, string, error) {
-	_, err := bash.process.Stdin.(*bytes.Buffer).WriteString(cmd + "; echo" + bash.sentinel + "'\n'")
-	if err != nil {
-		return "", "", err
+	ctx, cancel := context.WithTimeout(context.Background(), bash.timeout)
+	defer cancel()
+
+	process := exec.CommandContext(ctx, "/bin/bash", "-c", bash.sandbox.wrap(cmd))
+	process.Dir = bash.dir
+	bash.sandbox.apply(process)
+	// 后台进程可能一直持有 stdout, 超时之后不再等待
+	process.WaitDelay = time.Second
+
+	var stdout, stderr bytes.Buffer
+	process.Stdout = &stdout
+	process.Stderr = &stderr
+
+	err := process.Run()
+	bash.exitCode = process.ProcessState.ExitCode()
+	if ctx.Err() == context.DeadlineExceeded {
+		return stdout.String(), stderr.String(), errors.New("bash commend timeout")
 	}
-	done := make(chan error, 1)
-	go func() {
-		_, err = bash.process.Process.Wait()
-		done <- err
-	}()
 
-	select {
-	case <-time.After(bash.timeout):
-		return "", "", errors.New("bash commend timeout")
-	case err = <-done:
-		if err != nil {
-			return "", "", err
-		}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// 非 0 退出码也是正常的执行结果, 交给模型处理
+		return stdout.String(), stderr.String(), nil
 	}
 
-	output := bash.process.Stdout.(*bytes.Buffer).String()
-	errOut := bash.process.Stderr.(*bytes.Buffer).String()
-
-	if idx := bytes.Index([]byte(output), []byte(bash.sentinel)); idx != -1 {
-		output = output[:idx]
-	}
+	return stdout.String(), stderr.String(), err
+}
 
-	return output, errOut, nil
+// ExitCode 最近一次 Run 的退出码, 进程没有启动或者被信号终止时为 -1
+func (bash *BashTool) ExitCode() int {
+	return bash.exitCode
 }
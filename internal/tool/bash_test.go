@@ -0,0 +1,33 @@
+package tool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBashRun(t *testing.T) {
+	dir := t.TempDir()
+	bash := NewBashSession(time.Second, dir, nil)
+
+	out, errOut, err := bash.Run("echo hello > a.txt && cat a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", out)
+	assert.Empty(t, errOut)
+	assert.Equal(t, 0, bash.ExitCode())
+
+	_, err = os.Stat(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+
+	_, errOut, err = bash.Run("ls not_exist")
+	require.NoError(t, err)
+	assert.NotEmpty(t, errOut)
+	assert.Equal(t, 2, bash.ExitCode())
+
+	_, _, err = bash.Run("sleep 3")
+	assert.Error(t, err)
+	assert.Equal(t, -1, bash.ExitCode())
+}
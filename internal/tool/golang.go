@@ -0,0 +1,41 @@
+package tool
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type GoTool struct {
+	timeout time.Duration
+	sandbox *Sandbox
+	// exitCode 最近一次 Run 的退出码
+	exitCode int
+}
+
+func NewGoSession(timeout time.Duration, sandbox *Sandbox) *GoTool {
+	return &GoTool{timeout: timeout, sandbox: sandbox}
+}
+
+// Run 把 code 写到临时目录的 main.go 里, 使用 go run 执行, 返回 stdout 和 stderr
+func (g *GoTool) Run(code string) (string, string, error) {
+	g.exitCode = -1
+	dir, err := os.MkdirTemp("", "golang_execute")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(code), 0o644); err != nil {
+		return "", "", err
+	}
+
+	bash := NewBashSession(g.timeout, dir, g.sandbox)
+	defer func() { g.exitCode = bash.ExitCode() }()
+	return bash.Run("go run main.go")
+}
+
+// ExitCode 最近一次 Run 的退出码, 编译失败时也不为 0
+func (g *GoTool) ExitCode() int {
+	return g.exitCode
+}
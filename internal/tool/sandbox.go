@@ -0,0 +1,87 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"strings"
+	"time"
+)
+
+// Sandbox 限制工具进程可以使用的资源, 0 表示不限制
+type Sandbox struct {
+	// CPUSeconds 进程可以使用的 CPU 时间
+	CPUSeconds int `yaml:"cpu_seconds" json:"cpu_seconds"`
+	// MemoryMB 进程数据段的大小
+	MemoryMB int `yaml:"memory_mb" json:"memory_mb"`
+	// FileSizeMB 进程可以写入的单个文件大小
+	FileSizeMB int `yaml:"file_size_mb" json:"file_size_mb"`
+	// Processes 当前用户可以同时运行的进程数量
+	Processes int `yaml:"processes" json:"processes"`
+
+	// 使用非特权的 namespace 隔离, 只在 Linux 上生效
+	UserNamespace    bool `yaml:"user_namespace" json:"user_namespace"`
+	MountNamespace   bool `yaml:"mount_namespace" json:"mount_namespace"`
+	NetworkNamespace bool `yaml:"network_namespace" json:"network_namespace"`
+
+	// GoTimeout golang_execute 编译和运行的超时时间, 为 0 时使用默认的 60s
+	GoTimeout time.Duration `yaml:"go_timeout" json:"-"`
+}
+
+// Validate 资源限制不能小于 0
+func (s *Sandbox) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.CPUSeconds < 0 || s.MemoryMB < 0 || s.FileSizeMB < 0 || s.Processes < 0 || s.GoTimeout < 0 {
+		return errors.New("sandbox 不能小于 0")
+	}
+	return nil
+}
+
+// Merge 合并 session 自己的配置, 只允许比默认配置更严格
+func (s *Sandbox) Merge(other *Sandbox) *Sandbox {
+	if s == nil {
+		return other
+	}
+	if other == nil {
+		return s
+	}
+
+	return &Sandbox{
+		CPUSeconds:       domain.Stricter(s.CPUSeconds, other.CPUSeconds),
+		MemoryMB:         domain.Stricter(s.MemoryMB, other.MemoryMB),
+		FileSizeMB:       domain.Stricter(s.FileSizeMB, other.FileSizeMB),
+		Processes:        domain.Stricter(s.Processes, other.Processes),
+		UserNamespace:    s.UserNamespace || other.UserNamespace,
+		MountNamespace:   s.MountNamespace || other.MountNamespace,
+		NetworkNamespace: s.NetworkNamespace || other.NetworkNamespace,
+		GoTimeout:        domain.Stricter(s.GoTimeout, other.GoTimeout),
+	}
+}
+
+// wrap 在命令前面加上 ulimit, 同时设置 soft 和 hard limit, 进程内无法再调大
+func (s *Sandbox) wrap(cmd string) string {
+	if s == nil {
+		return cmd
+	}
+
+	var limits []string
+	if s.CPUSeconds > 0 {
+		limits = append(limits, fmt.Sprintf("-t %d", s.CPUSeconds))
+	}
+	if s.MemoryMB > 0 {
+		limits = append(limits, fmt.Sprintf("-d %d", s.MemoryMB*1024))
+	}
+	if s.FileSizeMB > 0 {
+		limits = append(limits, fmt.Sprintf("-f %d", s.FileSizeMB*1024))
+	}
+	if s.Processes > 0 {
+		limits = append(limits, fmt.Sprintf("-u %d", s.Processes))
+	}
+
+	if len(limits) == 0 {
+		return cmd
+	}
+	return fmt.Sprintf("ulimit %s || exit 1\n%s", strings.Join(limits, " "), cmd)
+}
@@ -0,0 +1,33 @@
+package tool
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// apply 把进程放到单独的进程组, 超时的时候整组 kill; 按照配置创建 namespace
+func (s *Sandbox) apply(process *exec.Cmd) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+
+	if s != nil {
+		if s.MountNamespace {
+			attr.Cloneflags |= syscall.CLONE_NEWNS
+		}
+		if s.NetworkNamespace {
+			attr.Cloneflags |= syscall.CLONE_NEWNET
+		}
+		// 非特权用户创建其它 namespace 需要先创建 user namespace
+		if s.UserNamespace || attr.Cloneflags != 0 {
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+			attr.GidMappingsEnableSetgroups = false
+		}
+	}
+
+	process.SysProcAttr = attr
+	process.Cancel = func() error {
+		return syscall.Kill(-process.Process.Pid, syscall.SIGKILL)
+	}
+}
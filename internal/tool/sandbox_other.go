@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tool
+
+import (
+	"os/exec"
+)
+
+// apply 其它平台没有进程组和 namespace, 只支持 ulimit, 超时的时候只 kill bash 本身
+func (s *Sandbox) apply(process *exec.Cmd) {
+}
@@ -0,0 +1,48 @@
+package tool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSandboxMerge(t *testing.T) {
+	base := &Sandbox{CPUSeconds: 10, MemoryMB: 512, GoTimeout: time.Minute}
+	merged := base.Merge(&Sandbox{CPUSeconds: 60, MemoryMB: 128, Processes: 64, NetworkNamespace: true, GoTimeout: time.Hour})
+
+	assert.Equal(t, &Sandbox{CPUSeconds: 10, MemoryMB: 128, Processes: 64, NetworkNamespace: true, GoTimeout: time.Minute}, merged)
+	assert.Equal(t, base, base.Merge(nil))
+
+	// 负数不能放宽默认的限制
+	assert.Equal(t, base, base.Merge(&Sandbox{CPUSeconds: -1, MemoryMB: -1, GoTimeout: -time.Second}))
+	assert.Error(t, (&Sandbox{MemoryMB: -1}).Validate())
+}
+
+func TestSandboxLimits(t *testing.T) {
+	dir := t.TempDir()
+	bash := NewBashSession(5*time.Second, dir, &Sandbox{FileSizeMB: 1})
+
+	_, errOut, err := bash.Run("head -c 2097152 /dev/zero > big.bin")
+	require.NoError(t, err)
+	assert.NotEmpty(t, errOut)
+
+	info, err := os.Stat(filepath.Join(dir, "big.bin"))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(1024*1024))
+}
+
+func TestSandboxKillGroup(t *testing.T) {
+	dir := t.TempDir()
+	bash := NewBashSession(500*time.Millisecond, dir, nil)
+
+	// 后台的子进程在超时的时候也会被 kill, 不会写入文件
+	_, _, err := bash.Run("(sleep 1 && touch leaked) & sleep 5")
+	assert.Error(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "leaked"))
+	assert.True(t, os.IsNotExist(err))
+}
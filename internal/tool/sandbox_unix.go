@@ -0,0 +1,16 @@
+//go:build unix && !linux
+
+package tool
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// apply 把进程放到单独的进程组, 超时的时候整组 kill; namespace 只在 Linux 上支持, 这里忽略
+func (s *Sandbox) apply(process *exec.Cmd) {
+	process.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	process.Cancel = func() error {
+		return syscall.Kill(-process.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// name instrumentation 的名称
+const name = "github.com/yumosx/agent"
+
+// Config trace 的导出方式, Exporter 为空时不记录
+type Config struct {
+	// Exporter 为 otlp、stdout 或者 file
+	Exporter string `yaml:"exporter"`
+	// Endpoint otlp 的 host:port, 为空时使用 OTEL_EXPORTER_OTLP_ENDPOINT 或者 localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// Insecure otlp 使用 http 而不是 https
+	Insecure bool `yaml:"insecure"`
+	// Path file 导出时写入的文件, 每个 span 一行 JSON
+	Path string `yaml:"path"`
+	// ServiceName 资源上的 service.name
+	ServiceName string `yaml:"service_name"`
+}
+
+func DefaultConfig() Config {
+	return Config{ServiceName: "agent"}
+}
+
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case "", "otlp", "stdout":
+		return nil
+	case "file":
+		if c.Path == "" {
+			return errors.New("tracing.path 不能为空")
+		}
+		return nil
+	default:
+		return fmt.Errorf("tracing.exporter 不支持 %q", c.Exporter)
+	}
+}
+
+// Setup 按照配置设置全局的 TracerProvider, 返回的 shutdown 用来导出剩下的 span
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	exporter, closer, err := newExporter(ctx, cfg)
+	if err != nil || exporter == nil {
+		return func(context.Context) error { return nil }, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer())
+		}
+		return err
+	}, nil
+}
+
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, func() error, error) {
+	switch cfg.Exporter {
+	case "":
+		return nil, nil, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("创建 otlp exporter 失败: %w", err)
+		}
+		return exporter, nil, nil
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		return exporter, nil, err
+	case "file":
+		file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("打开 trace 文件失败: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, nil, err
+		}
+		return exporter, file.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("tracing.exporter 不支持 %q", cfg.Exporter)
+	}
+}
+
+// Start 使用全局的 TracerProvider 创建 span, 没有调用 Setup 时不记录
+func Start(ctx context.Context, spanName string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(name).Start(ctx, spanName, trace.WithAttributes(attrs...))
+}
+
+// End 记录 err 之后结束 span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileExporter(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Setup(context.Background(), Config{Exporter: "file", Path: path, ServiceName: "agent-test"})
+	require.NoError(t, err)
+
+	ctx, parent := Start(context.Background(), "plan.execute", attribute.String("plan.id", "abc"))
+	_, child := Start(ctx, "llm.invoke")
+	End(child, errors.New("rate limited"))
+	End(parent, nil)
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var span struct {
+		Name   string
+		Parent struct{ SpanID string }
+		Status struct{ Code string }
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &span))
+	assert.Equal(t, "llm.invoke", span.Name)
+	assert.Equal(t, "Error", span.Status.Code)
+	assert.NotEqual(t, "0000000000000000", span.Parent.SpanID)
+	assert.Contains(t, string(data), "agent-test")
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+	assert.NoError(t, Config{Exporter: "otlp"}.Validate())
+	assert.Error(t, Config{Exporter: "file"}.Validate())
+	assert.Error(t, Config{Exporter: "jaeger"}.Validate())
+}
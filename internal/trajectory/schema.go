@@ -0,0 +1,162 @@
+package trajectory
+
+import (
+	"github.com/yumosx/agent/internal/domain"
+	"time"
+)
+
+// Version 记录格式的版本, 只会增加字段, 删除或者修改字段的含义时加 1
+const Version = 1
+
+// Record 的类型, 每种类型对应的 Data 见下面的结构
+const (
+	// PLAN 生成 plan 之后的标题和 step, Data 为 Plan
+	PLAN = "plan"
+	// LLM_REQUEST 发给模型的完整请求, Data 为 Request
+	LLM_REQUEST = "llm_request"
+	// LLM_RESPONSE 模型的回复或者调用失败的原因, Data 为 Response
+	LLM_RESPONSE = "llm_response"
+	// TOOL_RESULT 一次工具调用的参数和输出, Data 为 ToolResult
+	TOOL_RESULT = "tool_result"
+	// STEP step 的状态变化, Data 为 Step
+	STEP = "step"
+	// FINAL 一次执行结束时 plan 的状态, Data 为 Final
+	FINAL = "final"
+)
+
+// Record JSONL 文件里的一行
+type Record struct {
+	Version int `json:"v"`
+	// Seq 同一个 session 里从 1 开始递增
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session_id"`
+	Type    string    `json:"type"`
+	// Step 产生这条记录的 step, 生成 plan 和最后的总结不属于任何 step
+	Step *int `json:"step,omitempty"`
+	Data any  `json:"data"`
+}
+
+type Plan struct {
+	Title string   `json:"title"`
+	Steps []string `json:"steps"`
+}
+
+// Request 和 OpenAI chat completions 的格式一致, system prompt 是第一条 role 为 system 的消息
+type Request struct {
+	Messages []Message `json:"messages"`
+	Tools    []Tool    `json:"tools,omitempty"`
+}
+
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// ToolCall 和 OpenAI 一样, 名称和参数在 function 里, type 固定为 function
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Tool 和 OpenAI 的 tools 一致, type 固定为 function
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+// Function 工具的名称、描述和参数的 JSON Schema
+type Function struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+type Response struct {
+	// Model 实际返回结果的模型
+	Model     string       `json:"model,omitempty"`
+	Content   string       `json:"content"`
+	ToolCalls []ToolCall   `json:"tool_calls,omitempty"`
+	Usage     domain.Usage `json:"usage"`
+	// Error 调用失败时的错误, 这时其他字段为空
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type ToolResult struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	// Output 返回给模型的输出, 超过上限时是截断之后的内容
+	Output   string `json:"output"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	// Decision 人工审批的结果, 不需要审批时为空
+	Decision   string `json:"decision,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type Step struct {
+	Index   int    `json:"index"`
+	Content string `json:"content"`
+	State   string `json:"state"`
+	Summary string `json:"summary,omitempty"`
+}
+
+type Final struct {
+	Status  string `json:"status"`
+	Summary string `json:"summary,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Exhausted 耗尽的预算, 没有耗尽时为空
+	Exhausted string       `json:"exhausted,omitempty"`
+	Usage     domain.Usage `json:"usage"`
+}
+
+func newRequest(req domain.LLMRequest) Request {
+	messages := make([]Message, 0, len(req.Msgs)+1)
+	if req.SystemContent != "" {
+		messages = append(messages, Message{Role: "system", Content: req.SystemContent})
+	}
+	for _, msg := range req.Msgs {
+		messages = append(messages, Message{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCalls:  newToolCalls(msg.ToolCalls),
+			ToolCallID: msg.Id,
+		})
+	}
+
+	var tools []Tool
+	for _, t := range req.Tools {
+		function := Function{Name: t.Function.Name, Description: t.Function.Description, Parameters: map[string]any{"type": "object"}}
+		if t.Function.Parameters != nil {
+			if t.Function.Parameters.Properties != nil {
+				function.Parameters["properties"] = t.Function.Parameters.Properties.ToMap()
+			}
+			if len(t.Function.Parameters.Required) != 0 {
+				function.Parameters["required"] = t.Function.Parameters.Required
+			}
+		}
+		tools = append(tools, Tool{Type: "function", Function: function})
+	}
+	return Request{Messages: messages, Tools: tools}
+}
+
+func newToolCalls(calls []domain.LLMToolCall) []ToolCall {
+	var result []ToolCall
+	for _, call := range calls {
+		result = append(result, ToolCall{
+			ID:       call.ID,
+			Type:     "function",
+			Function: ToolCallFunction{Name: call.Function.Name, Arguments: call.Function.Arguments},
+		})
+	}
+	return result
+}
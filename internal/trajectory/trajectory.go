@@ -0,0 +1,151 @@
+package trajectory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/yumosx/agent/internal/event"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Trajectory 把一个 session 的运行过程追加写到 JSONL 文件, resume 之后继续追加, 方法在 t 为空时什么都不做
+type Trajectory struct {
+	session string
+	path    string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Open 打开 dir 下 session 对应的文件, 已经存在时接着之前的 seq 追加
+func Open(dir string, session string) (*Trajectory, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, session+".jsonl")
+
+	seq := 0
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seq = bytes.Count(data, []byte("\n"))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &Trajectory{session: session, path: path, seq: seq}, nil
+}
+
+// Path JSONL 文件的路径
+func (t *Trajectory) Path() string {
+	if t == nil {
+		return ""
+	}
+	return t.path
+}
+
+// Handle 订阅 session 的事件, 把生成的 plan、模型调用、工具调用、step 和最后的结果写到文件, 其他 session 的事件直接忽略
+func (t *Trajectory) Handle(ctx context.Context, ev event.Event) {
+	if t == nil || ev.Metadata().Session != t.session {
+		return
+	}
+
+	meta := ev.Metadata()
+	switch ev := ev.(type) {
+	case *event.PlanCreated:
+		steps := make([]string, len(ev.Plan.Steps))
+		for i, step := range ev.Plan.Steps {
+			steps[i] = step.Content
+		}
+		t.write(ctx, meta, PLAN, Plan{Title: ev.Plan.Title, Steps: steps})
+	case *event.LLMRequest:
+		t.write(ctx, meta, LLM_REQUEST, newRequest(ev.Request))
+	case *event.LLMResponse:
+		response := Response{Error: ev.Error, DurationMs: ev.Duration.Milliseconds()}
+		if ev.Error == "" {
+			response.Model = ev.Response.Model
+			response.Content = ev.Response.Content
+			response.ToolCalls = newToolCalls(ev.Response.ToolCalls)
+			response.Usage = ev.Response.Usage
+		}
+		t.write(ctx, meta, LLM_RESPONSE, response)
+	case *event.ToolFinished:
+		record := ev.Record
+		t.write(ctx, meta, TOOL_RESULT, ToolResult{
+			ID:         record.Id,
+			Name:       record.Name,
+			Arguments:  record.Arguments,
+			Output:     record.Output,
+			ExitCode:   record.ExitCode,
+			Decision:   record.Decision,
+			DurationMs: record.Duration.Milliseconds(),
+		})
+	case *event.StepChanged:
+		t.write(ctx, meta, STEP, Step{Index: ev.Index, Content: ev.Step.Content, State: ev.Step.State, Summary: ev.Step.Summary})
+	case *event.PlanFinished:
+		t.write(ctx, meta, FINAL, Final{
+			Status:    ev.Plan.Status,
+			Summary:   ev.Plan.Summary,
+			Error:     ev.Plan.Error,
+			Exhausted: ev.Plan.Exhausted,
+			Usage:     ev.Plan.Usage,
+		})
+	}
+}
+
+// write 每次写入时打开文件, session 很多时不会一直占用文件句柄, 写入失败时只记录日志, 不影响执行
+func (t *Trajectory) write(ctx context.Context, meta *event.Meta, typ string, data any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	record := Record{Version: Version, Seq: t.seq, Time: meta.Time.UTC(), Session: t.session, Type: typ, Step: meta.Step, Data: data}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = appendLine(t.path, line)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "write trajectory failed", "session_id", t.session, "error", err)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read 读取 JSONL 文件里的所有记录, Data 保持为 json.RawMessage
+func Read(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record struct {
+			Record
+			Data json.RawMessage `json:"data"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		record.Record.Data = record.Data
+		records = append(records, record.Record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,86 @@
+package trajectory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/domain/params"
+	"github.com/yumosx/agent/internal/event"
+	"testing"
+)
+
+func TestTrajectory(t *testing.T) {
+	dir := t.TempDir()
+	traj, err := Open(dir, "abc")
+	require.NoError(t, err)
+
+	bus := event.NewBus()
+	bus.Subscribe(traj.Handle)
+	meta := event.Meta{Session: "abc"}
+
+	req := domain.LLMRequest{
+		SystemContent: "be helpful",
+		Msgs:          []domain.Msg{{Role: domain.USER, Content: "list files"}},
+		Tools: []domain.Tool{{Type: "function", Function: domain.Function{
+			Name:       "bash",
+			Parameters: &domain.FunctionParameters{Properties: params.NewBashParams(), Required: []string{"command"}},
+		}}},
+	}
+	resp := domain.LLMResponse{Content: "listing", ToolCalls: []domain.LLMToolCall{{ID: "call_1", Type: "function", Function: domain.LLMToolCallFunction{Name: "bash", Arguments: `{"command": "ls"}`}}}}
+
+	ctx := event.WithStep(context.Background(), 0)
+	bus.Publish(ctx, &event.LLMRequest{Meta: meta, Request: req})
+	bus.Publish(ctx, &event.LLMResponse{Meta: meta, Response: resp})
+	exit := 0
+	bus.Publish(ctx, &event.ToolFinished{Meta: meta, Record: domain.ToolCallRecord{Id: "call_1", Name: "bash", Arguments: `{"command": "ls"}`, Output: "a.txt\n", ExitCode: &exit}})
+	// 其他 session 的事件不会写入
+	bus.Publish(ctx, &event.ToolFinished{Meta: event.Meta{Session: "other"}})
+	bus.Publish(context.Background(), &event.LLMRequest{Meta: meta, Request: req})
+	bus.Publish(context.Background(), &event.LLMResponse{Meta: meta, Error: "rate limited"})
+
+	// 重新打开之后接着之前的 seq 追加
+	traj, err = Open(dir, "abc")
+	require.NoError(t, err)
+	traj.Handle(context.Background(), &event.PlanFinished{Meta: meta, Plan: domain.Plan{Status: domain.FAILED, Error: "rate limited"}})
+
+	records, err := Read(traj.Path())
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+
+	var types []string
+	for i, record := range records {
+		assert.Equal(t, i+1, record.Seq)
+		assert.Equal(t, Version, record.Version)
+		assert.Equal(t, "abc", record.Session)
+		types = append(types, record.Type)
+	}
+	assert.Equal(t, []string{LLM_REQUEST, LLM_RESPONSE, TOOL_RESULT, LLM_REQUEST, LLM_RESPONSE, FINAL}, types)
+	require.NotNil(t, records[0].Step)
+	assert.Equal(t, 0, *records[0].Step)
+	assert.Nil(t, records[3].Step)
+
+	var request Request
+	require.NoError(t, json.Unmarshal(records[0].Data.(json.RawMessage), &request))
+	assert.Equal(t, Message{Role: "system", Content: "be helpful"}, request.Messages[0])
+	assert.Equal(t, "function", request.Tools[0].Type)
+	assert.Equal(t, "bash", request.Tools[0].Function.Name)
+	assert.Equal(t, []any{"command"}, request.Tools[0].Function.Parameters["required"])
+
+	var response Response
+	require.NoError(t, json.Unmarshal(records[1].Data.(json.RawMessage), &response))
+	assert.Equal(t, ToolCall{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "bash", Arguments: `{"command": "ls"}`}}, response.ToolCalls[0])
+
+	// 和 OpenAI 的格式一样, 工具的名称在 function 里
+	var raw struct {
+		Tools []map[string]json.RawMessage `json:"tools"`
+	}
+	require.NoError(t, json.Unmarshal(records[0].Data.(json.RawMessage), &raw))
+	assert.JSONEq(t, `"function"`, string(raw.Tools[0]["type"]))
+	assert.Contains(t, string(raw.Tools[0]["function"]), `"name":"bash"`)
+
+	var failed Response
+	require.NoError(t, json.Unmarshal(records[4].Data.(json.RawMessage), &failed))
+	assert.Equal(t, "rate limited", failed.Error)
+}
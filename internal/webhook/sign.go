@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 每次投递带上的请求头
+const (
+	HeaderEvent     = "X-Agent-Event"
+	HeaderDelivery  = "X-Agent-Delivery"
+	HeaderTimestamp = "X-Agent-Timestamp"
+	HeaderSignature = "X-Agent-Signature"
+)
+
+// Sign 使用 secret 对 "<timestamp>.<body>" 计算 HMAC-SHA256, 返回 sha256=<hex>
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 接收方用来校验签名, 时间戳和当前时间相差超过 tolerance 时拒绝, 避免重放, tolerance 为 0 时不检查
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(HeaderTimestamp)
+	signature := header.Get(HeaderSignature)
+	if timestamp == "" || signature == "" {
+		return errors.New("缺少签名")
+	}
+
+	if tolerance > 0 {
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("时间戳非法")
+		}
+		if diff := time.Since(time.Unix(unix, 0)); diff > tolerance || diff < -tolerance {
+			return errors.New("时间戳过期")
+		}
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("签名不匹配")
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// webhook 的事件
+const (
+	PLAN_COMPLETED    = "plan.completed"
+	STEP_BLOCKED      = "step.blocked"
+	APPROVAL_REQUIRED = "approval.required"
+	RUN_FAILED        = "run.failed"
+)
+
+// Events 支持订阅的事件
+var Events = []string{PLAN_COMPLETED, STEP_BLOCKED, APPROVAL_REQUIRED, RUN_FAILED}
+
+// 内存里最多保留的投递记录
+const maxDeliveries = 1000
+
+// Endpoint 接收事件的地址, 每次投递使用 Secret 签名
+type Endpoint struct {
+	URL    string `yaml:"url" json:"url"`
+	Secret string `yaml:"secret" json:"secret,omitempty"`
+	// Events 订阅的事件, 为空时接收所有事件
+	Events []string `yaml:"events" json:"events,omitempty"`
+}
+
+func (e Endpoint) Validate() error {
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url 必须是 http 或者 https 地址: %q", e.URL)
+	}
+	if e.Secret == "" {
+		return errors.New("secret 不能为空")
+	}
+	for _, typ := range e.Events {
+		if !slices.Contains(Events, typ) {
+			return fmt.Errorf("events 不支持 %q", typ)
+		}
+	}
+	return nil
+}
+
+func (e Endpoint) accepts(typ string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, typ)
+}
+
+// Config 全局的 webhook 以及投递的重试
+type Config struct {
+	// Endpoints 接收所有 session 的事件
+	Endpoints []Endpoint `yaml:"endpoints"`
+	// MaxAttempts 每次投递最多尝试的次数, 包括第一次
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// Timeout 每次请求的超时
+	Timeout time.Duration `yaml:"timeout"`
+	// Log 投递记录追加写入的 JSONL 文件, 为空时只保留在内存里
+	Log string `yaml:"log"`
+	// AllowLocal 允许 session 的 webhook 指向 loopback、link-local 和内网地址, 只用于本地测试
+	AllowLocal bool `yaml:"allow_local"`
+}
+
+func DefaultConfig() Config {
+	return Config{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute, Timeout: 10 * time.Second}
+}
+
+// Validate 返回所有不合法的配置项
+func (c Config) Validate() error {
+	var errs []error
+	for i, endpoint := range c.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("webhooks.endpoints[%d].%w", i, err))
+		}
+	}
+	if c.MaxAttempts <= 0 {
+		errs = append(errs, errors.New("webhooks.max_attempts 必须大于 0"))
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 || c.Timeout < 0 {
+		errs = append(errs, errors.New("webhooks 的时间不能小于 0"))
+	}
+	return errors.Join(errs...)
+}
+
+// Payload POST 给 webhook 的 JSON
+type Payload struct {
+	// Id 同一个事件的重试使用相同的 id, 接收方可以用来去重
+	Id      string    `json:"id"`
+	Type    string    `json:"type"`
+	Session string    `json:"session_id"`
+	Time    time.Time `json:"time"`
+	Step    *int      `json:"step,omitempty"`
+	// Data plan.completed 和 run.failed 为 plan, step.blocked 为 StepBlocked, approval.required 为审批请求
+	Data any `json:"data"`
+}
+
+type StepBlocked struct {
+	Index int         `json:"index"`
+	Step  domain.Step `json:"step"`
+}
+
+// Delivery 一次投递尝试的记录
+type Delivery struct {
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	Session string `json:"session_id"`
+	URL     string `json:"url"`
+	Attempt int    `json:"attempt"`
+	// StatusCode 没有收到响应时为 0
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Delivered 收到 2xx 的响应
+	Delivered  bool      `json:"delivered"`
+	DurationMs int64     `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+// Dispatcher 订阅事件总线, 在后台把事件投递给全局和 session 的 webhook, 失败时按照指数退避重试
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+	// restricted 投递 session 的 webhook, 连接时拒绝 loopback、link-local 和内网地址, 避免通过 DNS 绕过 Check
+	restricted *http.Client
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	mu         sync.Mutex
+	sessions   map[string][]Endpoint
+	deliveries []Delivery
+}
+
+func New(cfg Config) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[string][]Endpoint),
+	}
+	d.restricted = d.client
+	if !cfg.AllowLocal {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		// 经过代理时检查的是代理的地址
+		transport.Proxy = nil
+		d.restricted = &http.Client{Timeout: cfg.Timeout, Transport: transport}
+	}
+	return d
+}
+
+// Check 校验调用方提供的 webhook, 除了 Validate 之外不能指向 loopback、link-local 和内网地址
+func (d *Dispatcher) Check(endpoint Endpoint) error {
+	if err := endpoint.Validate(); err != nil {
+		return err
+	}
+	if d.cfg.AllowLocal {
+		return nil
+	}
+
+	u, _ := url.Parse(endpoint.URL)
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("url 不能指向本机: %q", endpoint.URL)
+	}
+	if ip := net.ParseIP(host); ip != nil && !public(ip) {
+		return fmt.Errorf("url 不能指向 loopback、link-local 或者内网地址: %q", endpoint.URL)
+	}
+	return nil
+}
+
+// Register 添加只接收 session 事件的 webhook
+func (d *Dispatcher) Register(session string, endpoint Endpoint) error {
+	if err := d.Check(endpoint); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions[session] = append(d.sessions[session], endpoint)
+	return nil
+}
+
+// Unregister 删除 session 的所有 webhook
+func (d *Dispatcher) Unregister(session string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.sessions, session)
+}
+
+// Endpoints 返回 session 自己的 webhook, 不包括全局的
+func (d *Dispatcher) Endpoints(session string) []Endpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.sessions[session])
+}
+
+// Deliveries 返回 session 最近的投递记录, session 为空时返回所有的记录
+func (d *Dispatcher) Deliveries(session string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := make([]Delivery, 0)
+	for _, delivery := range d.deliveries {
+		if session == "" || delivery.Session == session {
+			result = append(result, delivery)
+		}
+	}
+	return result
+}
+
+// Handle 订阅事件总线, 只投递 webhook 支持的事件, 不会阻塞执行
+func (d *Dispatcher) Handle(ctx context.Context, ev event.Event) {
+	payload, ok := newPayload(ev)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	endpoints := append(slices.Clone(d.cfg.Endpoints), d.sessions[payload.Session]...)
+	d.mu.Unlock()
+
+	var body []byte
+	for i, endpoint := range endpoints {
+		if !endpoint.accepts(payload.Type) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				slog.WarnContext(ctx, "encode webhook payload failed", "type", payload.Type, "error", err)
+				return
+			}
+		}
+
+		// 全局的 webhook 由配置指定, session 的 webhook 由调用方指定, 只能访问公网地址
+		client := d.client
+		if i >= len(d.cfg.Endpoints) {
+			client = d.restricted
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.deliver(client, endpoint, payload, body)
+		}()
+	}
+}
+
+// Close 等待正在进行的投递, 超过一次请求的超时之后取消剩下的重试
+func (d *Dispatcher) Close() {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d.cfg.Timeout):
+	}
+	d.cancel()
+	<-done
+}
+
+func newPayload(ev event.Event) (Payload, bool) {
+	meta := ev.Metadata()
+	payload := Payload{Session: meta.Session, Time: meta.Time, Step: meta.Step}
+
+	switch ev := ev.(type) {
+	case *event.PlanFinished:
+		payload.Type = RUN_FAILED
+		if ev.Plan.Status == domain.FINISHED {
+			payload.Type = PLAN_COMPLETED
+		}
+		payload.Data = ev.Plan
+	case *event.StepChanged:
+		if ev.Step.State != domain.BLOCKED {
+			return payload, false
+		}
+		payload.Type = STEP_BLOCKED
+		payload.Data = StepBlocked{Index: ev.Index, Step: ev.Step}
+	case *event.ApprovalRequired:
+		payload.Type = APPROVAL_REQUIRED
+		payload.Data = ev.Request
+	default:
+		return payload, false
+	}
+
+	payload.Id = newId()
+	return payload, true
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliver 连接失败、429 和 5xx 时重试, 其他的 4xx 说明接收方拒绝, 不再重试
+func (d *Dispatcher) deliver(client *http.Client, endpoint Endpoint, payload Payload, body []byte) {
+	for attempt := 1; attempt <= d.cfg.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(d.backoff(attempt - 1)):
+			}
+		}
+
+		delivery := Delivery{Id: payload.Id, Type: payload.Type, Session: payload.Session, URL: endpoint.URL, Attempt: attempt, Time: time.Now().UTC()}
+		retry := d.post(client, endpoint, body, &delivery)
+		d.record(delivery)
+		if !retry {
+			return
+		}
+	}
+	slog.Warn("webhook delivery failed", "url", endpoint.URL, "type", payload.Type, "session_id", payload.Session, "attempts", d.cfg.MaxAttempts)
+}
+
+// post 发送一次请求, 返回是否需要重试
+func (d *Dispatcher) post(client *http.Client, endpoint Endpoint, body []byte, delivery *Delivery) bool {
+	start := time.Now()
+	defer func() { delivery.DurationMs = time.Since(start).Milliseconds() }()
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "agent-webhook")
+	req.Header.Set(HeaderEvent, delivery.Type)
+	req.Header.Set(HeaderDelivery, delivery.Id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return true
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Delivered = true
+		return false
+	}
+	delivery.Error = resp.Status
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff 第 attempt 次重试之前等待的时间
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	wait := d.cfg.InitialBackoff
+	for i := 1; i < attempt && wait < d.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if d.cfg.MaxBackoff > 0 {
+		wait = min(wait, d.cfg.MaxBackoff)
+	}
+	return wait
+}
+
+// dialPublic 在解析完域名之后检查实际连接的地址
+func dialPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !public(ip) {
+		return fmt.Errorf("不能连接 loopback、link-local 或者内网地址: %s", address)
+	}
+	return nil
+}
+
+// public 不是本机、link-local 或者 10/8、172.16/12、192.168/16、fc00::/7 这样的内网地址
+func public(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified() && !ip.IsPrivate()
+}
+
+// record 保存投递记录, 写文件失败时只记录日志
+func (d *Dispatcher) record(delivery Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > maxDeliveries {
+		d.deliveries = slices.Clone(d.deliveries[len(d.deliveries)-maxDeliveries:])
+	}
+
+	if d.cfg.Log == "" {
+		return
+	}
+	line, err := json.Marshal(delivery)
+	if err == nil {
+		err = appendLine(d.cfg.Log, line)
+	}
+	if err != nil {
+		slog.Warn("write webhook delivery log failed", "path", d.cfg.Log, "error", err)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
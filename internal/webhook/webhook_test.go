@@ -0,0 +1,250 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yumosx/agent/internal/domain"
+	"github.com/yumosx/agent/internal/event"
+	"github.com/yumosx/agent/internal/policy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver 记录收到的请求, 前 fail 次返回 status
+type receiver struct {
+	secret string
+	status int
+	fail   int
+
+	mu       sync.Mutex
+	payloads []Payload
+	headers  []http.Header
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if err := Verify(r.secret, req.Header, body, time.Minute); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(r.status)
+		return
+	}
+
+	var payload Payload
+	_ = json.Unmarshal(body, &payload)
+	r.payloads = append(r.payloads, payload)
+	r.headers = append(r.headers, req.Header.Clone())
+}
+
+func (r *receiver) received() []Payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Payload(nil), r.payloads...)
+}
+
+func testConfig(t *testing.T) Config {
+	cfg := DefaultConfig()
+	cfg.InitialBackoff = time.Millisecond
+	cfg.MaxAttempts = 3
+	cfg.Log = filepath.Join(t.TempDir(), "deliveries.jsonl")
+	// 测试的接收方都在本机
+	cfg.AllowLocal = true
+	return cfg
+}
+
+func TestDispatcher(t *testing.T) {
+	global := &receiver{secret: "global", status: http.StatusServiceUnavailable, fail: 1}
+	globalServer := httptest.NewServer(global)
+	defer globalServer.Close()
+	session := &receiver{secret: "session"}
+	sessionServer := httptest.NewServer(session)
+	defer sessionServer.Close()
+
+	cfg := testConfig(t)
+	cfg.Endpoints = []Endpoint{{URL: globalServer.URL, Secret: "global", Events: []string{PLAN_COMPLETED}}}
+	d := New(cfg)
+	require.NoError(t, d.Register("abc", Endpoint{URL: sessionServer.URL, Secret: "session"}))
+	assert.Error(t, d.Register("abc", Endpoint{URL: sessionServer.URL}))
+
+	bus := event.NewBus()
+	bus.Subscribe(d.Handle)
+	ctx := context.Background()
+	bus.Publish(event.WithStep(ctx, 1), &event.StepChanged{Meta: event.Meta{Session: "abc"}, Index: 1, Step: domain.Step{State: domain.BLOCKED}})
+	bus.Publish(ctx, &event.StepChanged{Meta: event.Meta{Session: "abc"}, Index: 0, Step: domain.Step{State: domain.COMPLETED}})
+	bus.Publish(ctx, &event.ApprovalRequired{Meta: event.Meta{Session: "abc"}, Request: policy.Request{Id: "1", Tool: "bash"}})
+	bus.Publish(ctx, &event.PlanFinished{Meta: event.Meta{Session: "abc"}, Plan: domain.Plan{Id: "abc", Status: domain.FINISHED}})
+	// 其他 session 只投递给全局的 webhook
+	bus.Publish(ctx, &event.PlanFinished{Meta: event.Meta{Session: "other"}, Plan: domain.Plan{Id: "other", Status: domain.FAILED}})
+	d.Close()
+
+	types := map[string]Payload{}
+	for _, payload := range session.received() {
+		assert.Equal(t, "abc", payload.Session)
+		types[payload.Type] = payload
+	}
+	assert.Len(t, types, 3)
+	require.NotNil(t, types[STEP_BLOCKED].Step)
+	assert.Equal(t, 1, *types[STEP_BLOCKED].Step)
+	assert.Equal(t, "bash", types[APPROVAL_REQUIRED].Data.(map[string]any)["tool"])
+
+	// 第一次返回 503 之后重试成功, run.failed 不在订阅的事件里
+	received := global.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, PLAN_COMPLETED, received[0].Type)
+	assert.Equal(t, PLAN_COMPLETED, global.headers[0].Get(HeaderEvent))
+	assert.Equal(t, received[0].Id, global.headers[0].Get(HeaderDelivery))
+
+	var attempts []Delivery
+	for _, delivery := range d.Deliveries("abc") {
+		if delivery.URL == globalServer.URL {
+			attempts = append(attempts, delivery)
+		}
+	}
+	require.Len(t, attempts, 2)
+	assert.Equal(t, http.StatusServiceUnavailable, attempts[0].StatusCode)
+	assert.False(t, attempts[0].Delivered)
+	assert.True(t, attempts[1].Delivered)
+	assert.Equal(t, 2, attempts[1].Attempt)
+	assert.Equal(t, attempts[0].Id, attempts[1].Id)
+	assert.Len(t, d.Deliveries(""), 5)
+	assert.Empty(t, d.Deliveries("other"))
+	assert.Len(t, d.Endpoints("abc"), 1)
+}
+
+func TestDispatcherGiveUp(t *testing.T) {
+	rejected := &receiver{secret: "secret", status: http.StatusBadRequest, fail: 10}
+	rejectedServer := httptest.NewServer(rejected)
+	defer rejectedServer.Close()
+	broken := &receiver{secret: "secret", status: http.StatusInternalServerError, fail: 10}
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+
+	d := New(testConfig(t))
+	require.NoError(t, d.Register("abc", Endpoint{URL: rejectedServer.URL, Secret: "secret"}))
+	require.NoError(t, d.Register("abc", Endpoint{URL: brokenServer.URL, Secret: "secret"}))
+	d.Handle(context.Background(), &event.PlanFinished{Meta: event.Meta{Session: "abc"}, Plan: domain.Plan{Status: domain.FAILED}})
+	d.Close()
+
+	counts := map[string]int{}
+	for _, delivery := range d.Deliveries("abc") {
+		assert.False(t, delivery.Delivered)
+		assert.Equal(t, RUN_FAILED, delivery.Type)
+		counts[delivery.URL]++
+	}
+	// 4xx 不重试, 5xx 重试到 max_attempts
+	assert.Equal(t, 1, counts[rejectedServer.URL])
+	assert.Equal(t, 3, counts[brokenServer.URL])
+
+	data, err := os.ReadFile(d.cfg.Log)
+	require.NoError(t, err)
+	assert.Equal(t, 4, bytes.Count(data, []byte("\n")))
+}
+
+func TestCheck(t *testing.T) {
+	d := New(DefaultConfig())
+	assert.NoError(t, d.Check(Endpoint{URL: "https://ci.example.com/hooks", Secret: "s"}))
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hooks",
+		"http://localhost/hooks",
+		"http://api.localhost/hooks",
+		"http://[::1]/hooks",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hooks",
+		"http://10.0.0.5/hooks",
+		"http://172.16.3.4/hooks",
+		"http://192.168.1.1/hooks",
+		"http://[fd00::1]/hooks",
+	} {
+		assert.Error(t, d.Check(Endpoint{URL: u, Secret: "s"}), u)
+		assert.Error(t, d.Register("abc", Endpoint{URL: u, Secret: "s"}), u)
+	}
+	assert.Empty(t, d.Endpoints("abc"))
+
+	require.NoError(t, d.Register("abc", Endpoint{URL: "https://ci.example.com/hooks", Secret: "s"}))
+	d.Unregister("abc")
+	assert.Empty(t, d.Endpoints("abc"))
+}
+
+func TestDispatcherRestricted(t *testing.T) {
+	local := &receiver{secret: "secret"}
+	server := httptest.NewServer(local)
+	defer server.Close()
+
+	cfg := testConfig(t)
+	cfg.AllowLocal = false
+	cfg.MaxAttempts = 1
+	cfg.Endpoints = []Endpoint{{URL: server.URL, Secret: "secret"}}
+	d := New(cfg)
+	// 域名解析到本机时 Check 拦不住, 连接的时候再检查一次
+	d.sessions["abc"] = []Endpoint{{URL: server.URL, Secret: "secret"}}
+	d.Handle(context.Background(), &event.PlanFinished{Meta: event.Meta{Session: "abc"}, Plan: domain.Plan{Status: domain.FINISHED}})
+	d.Close()
+
+	// 全局的 webhook 由配置指定, 不受限制
+	assert.Len(t, local.received(), 1)
+	deliveries := d.Deliveries("abc")
+	require.Len(t, deliveries, 2)
+	delivered := 0
+	for _, delivery := range deliveries {
+		if delivery.Delivered {
+			delivered++
+		} else {
+			assert.Contains(t, delivery.Error, "loopback")
+		}
+	}
+	assert.Equal(t, 1, delivered)
+}
+
+func TestDialPublic(t *testing.T) {
+	assert.NoError(t, dialPublic("tcp", "93.184.216.34:443", nil))
+	for _, address := range []string{"127.0.0.1:80", "169.254.169.254:80", "10.1.2.3:80", "192.168.0.10:443", "[fc00::1]:80"} {
+		assert.ErrorContains(t, dialPublic("tcp", address, nil), "内网", address)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"plan.completed"}`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderSignature, Sign("secret", timestamp, body))
+
+	assert.NoError(t, Verify("secret", header, body, time.Minute))
+	assert.Error(t, Verify("other", header, body, time.Minute))
+	assert.Error(t, Verify("secret", header, []byte(`{"type":"run.failed"}`), time.Minute))
+
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	header.Set(HeaderTimestamp, expired)
+	header.Set(HeaderSignature, Sign("secret", expired, body))
+	assert.Error(t, Verify("secret", header, body, time.Minute))
+	assert.NoError(t, Verify("secret", header, body, 0))
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Endpoints = []Endpoint{{URL: "ftp://example.com", Secret: "s"}, {URL: "https://example.com", Secret: "s", Events: []string{"plan.created"}}}
+	cfg.MaxAttempts = 0
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webhooks.endpoints[0].url")
+	assert.Contains(t, err.Error(), `webhooks.endpoints[1].events 不支持 "plan.created"`)
+	assert.Contains(t, err.Error(), "webhooks.max_attempts")
+}